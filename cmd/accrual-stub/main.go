@@ -0,0 +1,79 @@
+// Command accrual-stub imitates the accrual system for local development and
+// tests. The answers for every order are scripted by a rules file, see
+// rules.example.json.
+package main
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"os"
+	"os/signal"
+
+	"github.com/Tomap-Tomap/go-loyalty-service/iternal/accrualstub"
+	"github.com/Tomap-Tomap/go-loyalty-service/iternal/logger"
+	"go.uber.org/zap"
+)
+
+func main() {
+	var addr, rulesPath string
+	f := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	f.StringVar(&addr, "a", "localhost:8080", "address and port to run accrual stub")
+	f.StringVar(&rulesPath, "rules", "", "path to rules file, all orders are processed with 500 points without it")
+	f.Parse(os.Args[1:])
+
+	if envAddr := os.Getenv("RUN_ADDRESS"); envAddr != "" {
+		addr = envAddr
+	}
+
+	if envRules := os.Getenv("ACCRUAL_STUB_RULES"); envRules != "" {
+		rulesPath = envRules
+	}
+
+	if err := logger.Initialize("INFO", "stderr"); err != nil {
+		panic(err)
+	}
+
+	rules := accrualstub.DefaultRules()
+
+	if rulesPath != "" {
+		file, err := os.Open(rulesPath)
+
+		if err != nil {
+			logger.Log.Fatal("Open rules", zap.Error(err))
+		}
+
+		rules, err = accrualstub.LoadRules(file)
+		file.Close()
+
+		if err != nil {
+			logger.Log.Fatal("Load rules", zap.String("path", rulesPath), zap.Error(err))
+		}
+	}
+
+	s, err := accrualstub.NewServer(rules)
+
+	if err != nil {
+		logger.Log.Fatal("Create accrual stub", zap.Error(err))
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	httpServer := &http.Server{
+		Addr:    addr,
+		Handler: logger.RequestLogger(s.Handler()),
+	}
+
+	go func() {
+		<-ctx.Done()
+		logger.Log.Info("Stop accrual stub")
+		httpServer.Shutdown(context.Background())
+	}()
+
+	logger.Log.Info("Run accrual stub", zap.String("address", addr), zap.Int("rules", len(rules.Rules)))
+
+	if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.Log.Fatal("Run accrual stub", zap.Error(err))
+	}
+}
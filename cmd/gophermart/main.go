@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
@@ -9,58 +11,158 @@ import (
 	"github.com/Tomap-Tomap/go-loyalty-service/iternal/agent"
 	"github.com/Tomap-Tomap/go-loyalty-service/iternal/client"
 	"github.com/Tomap-Tomap/go-loyalty-service/iternal/handlers"
+	"github.com/Tomap-Tomap/go-loyalty-service/iternal/hasher"
 	"github.com/Tomap-Tomap/go-loyalty-service/iternal/logger"
+	"github.com/Tomap-Tomap/go-loyalty-service/iternal/migrations"
 	"github.com/Tomap-Tomap/go-loyalty-service/iternal/parameters"
 	"github.com/Tomap-Tomap/go-loyalty-service/iternal/storage"
 	"github.com/Tomap-Tomap/go-loyalty-service/iternal/tokenworker"
-	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
 )
 
+const (
+	modeServe = "serve"
+	modeAgent = "agent"
+	modeAll   = "all"
+)
+
+// main runs the HTTP API and the accrual agent. The first argument selects
+// what the process runs: serve starts only the API, agent only the agent with
+// the health endpoint, all (the default) both of them.
 func main() {
+	mode := modeAll
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			err := runMigrate()
+
+			if errors.Is(err, errMigrateUsage) {
+				fmt.Fprintln(os.Stderr, migrateUsage)
+				os.Exit(2)
+			}
+
+			if err != nil {
+				logger.Log.Error("Migrate", zap.Error(err))
+				os.Exit(1)
+			}
+
+			return
+		case modeServe, modeAgent, modeAll:
+			mode = os.Args[1]
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+		}
+	}
+
 	p := parameters.ParseFlags()
 
 	if err := logger.Initialize("INFO", "stderr"); err != nil {
 		panic(err)
 	}
 
-	logger.Log.Info("Create database storage")
+	if err := p.Validate(); err != nil {
+		logger.Log.Fatal("Invalid parameters", zap.Error(err))
+	}
+
+	if mode != modeAll && p.Storage == "memory" {
+		logger.Log.Fatal("Memory storage is not shared between processes, run with mode all", zap.String("mode", mode))
+	}
+
+	hp := hasher.DefaultParams
+	hp.Memory = uint32(p.HashMemory)
+	hp.Iterations = uint32(p.HashIterations)
+	hp.Parallelism = uint8(p.HashParallelism)
+
+	if err := hasher.Initialize(hp); err != nil {
+		logger.Log.Fatal("Initialize password hasher", zap.Error(err))
+	}
 
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, os.Kill)
 	defer cancel()
 	eg, egCtx := errgroup.WithContext(ctx)
 
-	conn, err := pgx.Connect(ctx, p.DataBaseURI)
+	logger.Log.Info("Create storage", zap.String("type", p.Storage))
+	storage, closeStorage, err := newRepository(ctx, p)
 
 	if err != nil {
-		logger.Log.Fatal("Connect to database", zap.Error(err))
+		logger.Log.Fatal("Create storage", zap.Error(err))
 	}
-	defer conn.Close(ctx)
+	defer closeStorage()
 
-	storage, err := storage.NewStorage(conn)
+	mux := http.NewServeMux()
+	health := make(map[string]handlers.HealthReporter)
 
-	if err != nil {
-		logger.Log.Fatal("Create storage", zap.Error(err))
+	if mode != modeAgent {
+		logger.Log.Info("Create token worker")
+		rv := tokenworker.NewRevocations(storage, p.RevocationTTL)
+		kr, err := newKeyring(p)
+
+		if err != nil {
+			logger.Log.Fatal("Load jwt keyring", zap.Error(err))
+		}
+
+		sources, err := tokenworker.ParseTokenSources(p.TokenSources)
+
+		if err != nil {
+			logger.Log.Fatal("Parse token sources", zap.Error(err))
+		}
+
+		accessLife := p.AccessTokenLife
+
+		if p.SecetKeyLife > 0 {
+			logger.Log.Warn("-kl and SECRET_KEY_LIFE are deprecated, use -atl and ACCESS_TOKEN_LIFE")
+			accessLife = p.SecetKeyLife
+		}
+
+		sessions := tokenworker.NewSessions(storage, p.RefreshTokenLife)
+		tw := tokenworker.NewToken(kr, accessLife, rv, sessions, sources)
+		logger.Log.Info("Create handlers")
+		h := handlers.NewHandlers(storage, *tw)
+		logger.Log.Info("Create mux")
+		mux = handlers.ServiceMux(h)
+
+		if p.WebhookSecret != "" {
+			logger.Log.Info("Enable accrual webhook")
+			handlers.HandleAccrualWebhook(mux, storage, []byte(p.WebhookSecret), p.WebhookTolerance)
+		}
 	}
 
-	logger.Log.Info("Create token worker")
-	tw := tokenworker.NewToken(p.SecretKey, p.SecetKeyLife)
-	logger.Log.Info("Create handlers")
-	h := handlers.NewHandlers(storage, *tw)
-	logger.Log.Info("Create mux")
-	mux := handlers.ServiceMux(h)
-	logger.Log.Info("Create client")
-	c := client.NewClient(p.AccrualSystemAddr)
-	logger.Log.Info("Create agent")
-	a := agent.NewAgent(storage, c, p.GetInterval, p.WorkerLimit)
+	if mode != modeServe {
+		logger.Log.Info("Create client")
+		c := client.NewClient(p.AccrualSystemAddr, p.AccrualRateLimit, client.BreakerConfig{
+			FailureThreshold: p.BreakerFailures,
+			OpenTimeout:      p.BreakerTimeout,
+			HalfOpenRequests: p.BreakerHalfOpen,
+		})
+		health["accrual"] = c
+		logger.Log.Info("Create agent")
+		a := agent.NewAgent(storage, c, p.GetInterval, p.WorkerLimit, agent.Backoff{
+			Base:        p.RetryBackoffBase,
+			Max:         p.RetryBackoffMax,
+			MaxAttempts: p.RetryMaxAttempts,
+		}, p.UnregisteredTTL, p.ShutdownTimeout)
+		health["agent"] = &a
+
+		eg.Go(func() error {
+			logger.Log.Info("Run agent")
+			if err := a.Run(egCtx); err != nil {
+				return err
+			}
+
+			return nil
+		})
+	}
+
+	handlers.HandleHealth(mux, health)
 
 	httpServer := &http.Server{
 		Addr:    p.RunAddr,
 		Handler: mux,
 	}
 	eg.Go(func() error {
-		logger.Log.Info("Run server")
+		logger.Log.Info("Run server", zap.String("mode", mode))
 		err := httpServer.ListenAndServe()
 		if err != nil && err != http.ErrServerClosed {
 			return err
@@ -75,16 +177,65 @@ func main() {
 		return httpServer.Shutdown(context.Background())
 	})
 
-	eg.Go(func() error {
-		logger.Log.Info("Run agent")
-		if err := a.Run(egCtx); err != nil {
-			return err
-		}
-
-		return nil
-	})
-
 	if err := eg.Wait(); err != nil {
 		logger.Log.Fatal("Problem with working server", zap.Error(err))
 	}
 }
+
+type repository interface {
+	handlers.Repository
+	agent.Repository
+	tokenworker.RevocationStore
+	tokenworker.RefreshStore
+}
+
+func newRepository(ctx context.Context, p parameters.Parameters) (repository, func(), error) {
+	switch p.Storage {
+	case "memory":
+		return storage.NewMemoryStorage(), func() {}, nil
+	case "postgres":
+	default:
+		return nil, nil, fmt.Errorf("unknown storage type %s", p.Storage)
+	}
+
+	pool, err := newPool(ctx, p)
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("connect to database: %w", err)
+	}
+
+	logger.Log.Info("Apply migrations")
+	m, err := migrations.NewMigrator(pool)
+
+	if err != nil {
+		pool.Close()
+		return nil, nil, fmt.Errorf("create migrator: %w", err)
+	}
+
+	if err := m.Up(ctx); err != nil {
+		pool.Close()
+		return nil, nil, fmt.Errorf("apply migrations: %w", err)
+	}
+
+	return storage.NewStorage(pool), pool.Close, nil
+}
+
+func newKeyring(p parameters.Parameters) (*tokenworker.Keyring, error) {
+	switch {
+	case p.SecretKeyringFile != "":
+		return tokenworker.LoadKeyringFile(p.SecretKeyringFile)
+	case p.SecretKeys != "":
+		return tokenworker.ParseKeyring(p.SecretKeys, p.SecretKeyActive)
+	default:
+		return tokenworker.NewSecretKeyring(p.SecretKey), nil
+	}
+}
+
+func newPool(ctx context.Context, p parameters.Parameters) (*pgxpool.Pool, error) {
+	return storage.NewPool(ctx, p.DataBaseURI, storage.PoolConfig{
+		MaxConns:          int32(p.DBMaxConns),
+		MinConns:          int32(p.DBMinConns),
+		MaxConnIdleTime:   p.DBMaxConnIdleTime,
+		HealthCheckPeriod: p.DBHealthCheck,
+	})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/Tomap-Tomap/go-loyalty-service/iternal/logger"
+	"github.com/Tomap-Tomap/go-loyalty-service/iternal/migrations"
+	"github.com/Tomap-Tomap/go-loyalty-service/iternal/parameters"
+)
+
+const migrateUsage = "usage: gophermart migrate up|down|status [flags]"
+
+var errMigrateUsage error = fmt.Errorf(migrateUsage)
+
+// runMigrate runs the migrate command. It returns the error instead of
+// exiting, so the pool is closed and the advisory lock released first.
+func runMigrate() error {
+	if len(os.Args) < 3 {
+		return errMigrateUsage
+	}
+
+	action := os.Args[2]
+
+	if action != "up" && action != "down" && action != "status" {
+		return errMigrateUsage
+	}
+
+	os.Args = append(os.Args[:1], os.Args[3:]...)
+	p := parameters.ParseFlags()
+
+	if err := logger.Initialize("INFO", "stderr"); err != nil {
+		return fmt.Errorf("initialize logger: %w", err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, os.Kill)
+	defer cancel()
+
+	pool, err := newPool(ctx, p)
+
+	if err != nil {
+		return fmt.Errorf("connect to database: %w", err)
+	}
+	defer pool.Close()
+
+	m, err := migrations.NewMigrator(pool)
+
+	if err != nil {
+		return fmt.Errorf("create migrator: %w", err)
+	}
+
+	switch action {
+	case "up":
+		err = m.Up(ctx)
+	case "down":
+		err = m.Down(ctx)
+	case "status":
+		var statuses []migrations.Status
+		statuses, err = m.Status(ctx)
+
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Format(time.RFC3339)
+			}
+
+			fmt.Printf("%04d_%s\t%s\n", s.Version, s.Name, applied)
+		}
+	default:
+		return errMigrateUsage
+	}
+
+	if err != nil {
+		return fmt.Errorf("migrate %s: %w", action, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,154 @@
+package accrualstub
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/Tomap-Tomap/go-loyalty-service/iternal/models"
+)
+
+// Duration is a time.Duration written as "150ms" in the rules file.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string: %w", err)
+	}
+
+	v, err := time.ParseDuration(s)
+
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(v)
+	return nil
+}
+
+// Step is one scripted answer for an order. A step with Code other than 200
+// answers with that code, otherwise it returns Status and Accrual. The step
+// holds for Polls requests, the last step holds forever.
+type Step struct {
+	Status     string        `json:"status,omitempty"`
+	Accrual    *models.Money `json:"accrual,omitempty"`
+	Code       int           `json:"code,omitempty"`
+	RetryAfter uint          `json:"retry_after,omitempty"`
+	Latency    Duration      `json:"latency,omitempty"`
+	Polls      uint          `json:"polls,omitempty"`
+}
+
+// Rule scripts the answers for the orders whose number matches Match, an
+// empty Match matches every order.
+type Rule struct {
+	Match string `json:"match"`
+	Steps []Step `json:"steps"`
+
+	re *regexp.Regexp
+}
+
+// Rules is the content of the rules file. RateLimit is the number of requests
+// per minute after which the stub answers 429 like the real accrual system,
+// zero is unlimited. The first matching rule wins, orders without a rule are
+// not registered.
+type Rules struct {
+	RateLimit uint   `json:"rate_limit,omitempty"`
+	Rules     []Rule `json:"rules"`
+}
+
+// DefaultRules moves every order through REGISTERED and PROCESSING to
+// PROCESSED with 500 points.
+func DefaultRules() *Rules {
+	accrual := models.Money(50000)
+
+	return &Rules{
+		Rules: []Rule{{
+			Steps: []Step{
+				{Status: "REGISTERED"},
+				{Status: models.StatusProcessing},
+				{Status: models.StatusProcessed, Accrual: &accrual},
+			},
+		}},
+	}
+}
+
+func LoadRules(r io.Reader) (*Rules, error) {
+	var rules Rules
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(&rules); err != nil {
+		return nil, fmt.Errorf("decode rules: %w", err)
+	}
+
+	if err := rules.compile(); err != nil {
+		return nil, err
+	}
+
+	return &rules, nil
+}
+
+func (rs *Rules) compile() error {
+	for i := range rs.Rules {
+		r := &rs.Rules[i]
+
+		if len(r.Steps) == 0 {
+			return fmt.Errorf("rule %d has no steps", i)
+		}
+
+		for j, st := range r.Steps {
+			if st.Code != 0 && http.StatusText(st.Code) == "" {
+				return fmt.Errorf("rule %d step %d: unknown code %d", i, j, st.Code)
+			}
+
+			if (st.Code == 0 || st.Code == http.StatusOK) && st.Status == "" {
+				return fmt.Errorf("rule %d step %d: status is required", i, j)
+			}
+		}
+
+		re, err := regexp.Compile(r.Match)
+
+		if err != nil {
+			return fmt.Errorf("rule %d: compile match: %w", i, err)
+		}
+
+		r.re = re
+	}
+
+	return nil
+}
+
+// find returns the rule for the order number or nil.
+func (rs *Rules) find(number string) *Rule {
+	for i := range rs.Rules {
+		if rs.Rules[i].re.MatchString(number) {
+			return &rs.Rules[i]
+		}
+	}
+
+	return nil
+}
+
+// step returns the step answering the poll with the zero-based number.
+func (r *Rule) step(poll uint) Step {
+	for i, st := range r.Steps {
+		if i == len(r.Steps)-1 {
+			return st
+		}
+
+		hold := max(st.Polls, 1)
+
+		if poll < hold {
+			return st
+		}
+
+		poll -= hold
+	}
+
+	return r.Steps[len(r.Steps)-1]
+}
@@ -0,0 +1,146 @@
+package accrualstub
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Tomap-Tomap/go-loyalty-service/iternal/models"
+)
+
+const defaultRetryAfter = 60
+
+type orderResponse struct {
+	Order   string        `json:"order"`
+	Status  string        `json:"status"`
+	Accrual *models.Money `json:"accrual,omitempty"`
+}
+
+// Server imitates GET /api/orders/{number} of the accrual system following
+// the rules.
+type Server struct {
+	rules *Rules
+
+	mu          sync.Mutex
+	polls       map[string]uint
+	windowStart time.Time
+	windowCount uint
+	now         func() time.Time
+}
+
+func NewServer(rules *Rules) (*Server, error) {
+	if err := rules.compile(); err != nil {
+		return nil, err
+	}
+
+	return &Server{rules: rules, polls: make(map[string]uint), now: time.Now}, nil
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/orders/", s.getOrder)
+
+	return mux
+}
+
+func (s *Server) getOrder(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	number := strings.TrimPrefix(r.URL.Path, "/api/orders/")
+
+	if number == "" || strings.Contains(number, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	if retryAfter, limited := s.limit(); limited {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprintf(w, "No more than %d requests per minute allowed", s.rules.RateLimit)
+		return
+	}
+
+	rule := s.rules.find(number)
+
+	if rule == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	st := rule.step(s.poll(number))
+
+	if st.Latency > 0 {
+		select {
+		case <-time.After(time.Duration(st.Latency)):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	switch st.Code {
+	case 0, http.StatusOK:
+	case http.StatusTooManyRequests:
+		retryAfter := st.RetryAfter
+
+		if retryAfter == 0 {
+			retryAfter = defaultRetryAfter
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Retry-After", strconv.FormatUint(uint64(retryAfter), 10))
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprintf(w, "No more than %d requests per minute allowed", s.rules.RateLimit)
+		return
+	default:
+		w.WriteHeader(st.Code)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(orderResponse{Order: number, Status: st.Status, Accrual: st.Accrual})
+}
+
+// poll returns the zero-based number of the current poll of the order.
+func (s *Server) poll(number string) uint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := s.polls[number]
+	s.polls[number] = n + 1
+
+	return n
+}
+
+// limit counts the request in the current minute window and reports the
+// seconds left in the window when the rate limit is exceeded.
+func (s *Server) limit() (int, bool) {
+	if s.rules.RateLimit == 0 {
+		return 0, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+
+	if now.Sub(s.windowStart) >= time.Minute {
+		s.windowStart = now
+		s.windowCount = 0
+	}
+
+	if s.windowCount >= s.rules.RateLimit {
+		left := s.windowStart.Add(time.Minute).Sub(now)
+		return int(left.Round(time.Second) / time.Second), true
+	}
+
+	s.windowCount++
+	return 0, false
+}
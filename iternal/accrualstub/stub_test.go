@@ -0,0 +1,184 @@
+package accrualstub
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Tomap-Tomap/go-loyalty-service/iternal/agent"
+	"github.com/Tomap-Tomap/go-loyalty-service/iternal/client"
+	"github.com/Tomap-Tomap/go-loyalty-service/iternal/models"
+	"github.com/Tomap-Tomap/go-loyalty-service/iternal/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadRules(t *testing.T) {
+	t.Run("example", func(t *testing.T) {
+		file, err := os.Open("../../cmd/accrual-stub/rules.example.json")
+		require.NoError(t, err)
+		defer file.Close()
+
+		rules, err := LoadRules(file)
+		require.NoError(t, err)
+		require.Equal(t, uint(600), rules.RateLimit)
+		require.Len(t, rules.Rules, 5)
+		require.Equal(t, models.Money(72998), *rules.Rules[2].Steps[1].Accrual)
+		require.Equal(t, Duration(300*time.Millisecond), rules.Rules[3].Steps[1].Latency)
+	})
+
+	tests := []struct {
+		name  string
+		rules string
+	}{
+		{"not json", `rules`},
+		{"unknown field", `{"rules": [], "test": 1}`},
+		{"no steps", `{"rules": [{"match": "1"}]}`},
+		{"bad match", `{"rules": [{"match": "(", "steps": [{"status": "NEW"}]}]}`},
+		{"no status", `{"rules": [{"steps": [{"polls": 1}]}]}`},
+		{"unknown code", `{"rules": [{"steps": [{"code": 999}]}]}`},
+		{"bad latency", `{"rules": [{"steps": [{"status": "NEW", "latency": "fast"}]}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadRules(strings.NewReader(tt.rules))
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestRule_step(t *testing.T) {
+	r := Rule{Steps: []Step{
+		{Status: "REGISTERED"},
+		{Status: "PROCESSING", Polls: 2},
+		{Status: "PROCESSED"},
+	}}
+
+	statuses := make([]string, 0)
+	for poll := uint(0); poll < 6; poll++ {
+		statuses = append(statuses, r.step(poll).Status)
+	}
+
+	require.Equal(t, []string{"REGISTERED", "PROCESSING", "PROCESSING", "PROCESSED", "PROCESSED", "PROCESSED"}, statuses)
+}
+
+func newStub(t *testing.T, rules string) *httptest.Server {
+	rs, err := LoadRules(strings.NewReader(rules))
+	require.NoError(t, err)
+
+	s, err := NewServer(rs)
+	require.NoError(t, err)
+
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+
+	return ts
+}
+
+func TestServer_withClient(t *testing.T) {
+	ts := newStub(t, `{"rules": [
+		{"match": "^1", "steps": [{"status": "REGISTERED"}, {"status": "PROCESSING"}, {"status": "PROCESSED", "accrual": 500}]},
+		{"match": "^2", "steps": [{"status": "INVALID"}]},
+		{"match": "^3", "steps": [{"code": 500}]},
+		{"match": "^4", "steps": [{"code": 429, "retry_after": 0, "polls": 1}, {"status": "PROCESSED"}]},
+		{"match": "^5", "steps": [{"status": "PROCESSED", "latency": "50ms"}]}
+	]}`)
+	c := client.NewClient(ts.URL, 0, client.DefaultBreakerConfig)
+	ctx := context.Background()
+
+	statuses := make([]string, 0)
+	for i := 0; i < 3; i++ {
+		o, err := c.GetOrder(ctx, "1")
+		require.NoError(t, err)
+		statuses = append(statuses, o.Status)
+	}
+
+	require.Equal(t, []string{models.StatusNew, models.StatusProcessing, models.StatusProcessed}, statuses)
+
+	o, err := c.GetOrder(ctx, "2")
+	require.NoError(t, err)
+	require.Equal(t, models.StatusInvalid, o.Status)
+
+	_, err = c.GetOrder(ctx, "3")
+	require.ErrorIs(t, err, client.ErrAccrualUnavailable)
+
+	_, err = c.GetOrder(ctx, "9")
+	require.ErrorIs(t, err, client.ErrOrderNotRegistered)
+
+	start := time.Now()
+	o, err = c.GetOrder(ctx, "5")
+	require.NoError(t, err)
+	require.Equal(t, models.StatusProcessed, o.Status)
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	res, err := http.Get(ts.URL + "/api/orders/4")
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+	require.Equal(t, "60", res.Header.Get("Retry-After"))
+}
+
+func TestServer_rateLimit(t *testing.T) {
+	ts := newStub(t, `{"rate_limit": 2, "rules": [{"steps": [{"status": "PROCESSED"}]}]}`)
+
+	for i := 0; i < 2; i++ {
+		res, err := http.Get(ts.URL + "/api/orders/1")
+		require.NoError(t, err)
+		res.Body.Close()
+		require.Equal(t, http.StatusOK, res.StatusCode)
+	}
+
+	c := client.NewClient(ts.URL, 0, client.DefaultBreakerConfig)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, err := c.GetOrder(ctx, "1")
+	require.Error(t, err)
+	require.Equal(t, uint(2), c.ThrottleState().RequestsPerMinute)
+	require.True(t, c.ThrottleState().Throttled(time.Now()))
+}
+
+func TestServer_withAgent(t *testing.T) {
+	ts := newStub(t, `{"rules": [
+		{"match": "^2", "steps": [{"status": "INVALID"}]},
+		{"steps": [{"status": "REGISTERED"}, {"status": "PROCESSING"}, {"status": "PROCESSED", "accrual": 729.98}]}
+	]}`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ms := storage.NewMemoryStorage()
+	require.NoError(t, ms.CreateUser(ctx, models.User{Login: "user", Password: "pwd"}))
+
+	c := client.NewClient(ts.URL, 0, client.DefaultBreakerConfig)
+	a := agent.NewAgent(ms, c, 1, 2, agent.Backoff{Base: time.Millisecond}, 0, time.Second)
+
+	done := make(chan error)
+	go func() {
+		done <- a.Run(ctx)
+	}()
+
+	require.NoError(t, ms.AddOrder(ctx, "12345678903", "user"))
+	require.NoError(t, ms.AddOrder(ctx, "2377225624", "user"))
+
+	require.Eventually(t, func() bool {
+		b, err := ms.GetBalance(ctx, "user")
+		return err == nil && b.Current == models.Money(72998)
+	}, 10*time.Second, 50*time.Millisecond)
+
+	orders, err := ms.GetOrders(ctx, "user", models.ListFilter{})
+	require.NoError(t, err)
+
+	statuses := make(map[string]string)
+	for _, o := range orders {
+		statuses[o.Number] = o.Status
+	}
+
+	require.Equal(t, map[string]string{"12345678903": models.StatusProcessed, "2377225624": models.StatusInvalid}, statuses)
+
+	cancel()
+	require.NoError(t, <-done)
+}
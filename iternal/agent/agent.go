@@ -2,11 +2,15 @@ package agent
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"os"
 	"sync"
 	"time"
 
+	"github.com/Tomap-Tomap/go-loyalty-service/iternal/client"
 	"github.com/Tomap-Tomap/go-loyalty-service/iternal/logger"
 	"github.com/Tomap-Tomap/go-loyalty-service/iternal/models"
 	"github.com/jackc/pgx/v5"
@@ -14,79 +18,474 @@ import (
 )
 
 type Repository interface {
-	GetNotProcessedOrders(ctx context.Context) ([]string, error)
+	LeaseDueOrders(ctx context.Context, owner string, limit int, ttl time.Duration) ([]models.OrderSchedule, error)
+	ExtendLeases(ctx context.Context, owner string, numbers []string, ttl time.Duration) error
+	ReleaseOrder(ctx context.Context, owner string, number string) error
+	ListenNewOrders(ctx context.Context) (<-chan struct{}, error)
+	ScheduleOrder(ctx context.Context, sched models.OrderSchedule) error
 	UpdateOrder(ctx context.Context, o models.Order) error
 }
 
+const (
+	defaultLeaseTTL     = time.Minute
+	leaseBatchPerWorker = 10
+	releaseTimeout      = 5 * time.Second
+	cycleBackoffBase    = time.Second
+	cycleBackoffMax     = time.Minute
+)
+
 type Client interface {
 	GetOrder(ctx context.Context, number string) (*models.Order, error)
+	ThrottleState() client.ThrottleState
+	BreakerState() client.BreakerState
+}
+
+// Backoff describes how long the agent waits before polling the same order
+// again. The delay doubles with every attempt starting from Base and is capped
+// by Max. After MaxAttempts attempts the order is parked, zero means no cap.
+type Backoff struct {
+	Base        time.Duration
+	Max         time.Duration
+	MaxAttempts uint
+}
+
+func (b Backoff) Delay(attempt int) time.Duration {
+	d := b.Base
+
+	for i := 1; i < attempt; i++ {
+		if b.Max > 0 && d >= b.Max {
+			break
+		}
+
+		d *= 2
+	}
+
+	if b.Max > 0 && d > b.Max {
+		d = b.Max
+	}
+
+	return d
 }
 
 type Agent struct {
-	s           Repository
-	c           Client
-	getInterval uint
-	workerLimit uint
+	s               Repository
+	c               Client
+	getInterval     uint
+	workerLimit     uint
+	backoff         Backoff
+	unregisteredTTL time.Duration
+	shutdownTimeout time.Duration
+	owner           string
+	leaseTTL        time.Duration
+	batchSize       int
+	batches         *sync.WaitGroup
+	inFlight        *leaseSet
+	abandoned       *leaseSet
+	cycleBackoff    Backoff
+	health          *healthState
 }
 
-func NewAgent(s Repository, c Client, getInterval, workerLimit uint) Agent {
-	return Agent{s, c, getInterval, workerLimit}
+// NewAgent creates an agent polling the accrual system. Orders the accrual
+// system does not know for longer than unregisteredTTL after upload are
+// marked INVALID, zero keeps polling them. On shutdown in-flight jobs get
+// shutdownTimeout to finish.
+func NewAgent(s Repository, c Client, getInterval, workerLimit uint, backoff Backoff,
+	unregisteredTTL, shutdownTimeout time.Duration) Agent {
+	return Agent{
+		s:               s,
+		c:               c,
+		getInterval:     getInterval,
+		workerLimit:     workerLimit,
+		backoff:         backoff,
+		unregisteredTTL: unregisteredTTL,
+		shutdownTimeout: shutdownTimeout,
+		owner:           newOwnerID(),
+		leaseTTL:        defaultLeaseTTL,
+		batchSize:       int(workerLimit) * leaseBatchPerWorker,
+		batches:         new(sync.WaitGroup),
+		inFlight:        newLeaseSet(nil),
+		abandoned:       newLeaseSet(nil),
+		cycleBackoff:    Backoff{Base: cycleBackoffBase, Max: cycleBackoffMax},
+		health:          new(healthState),
+	}
 }
 
+// newOwnerID identifies the agent instance in the order leases.
+func newOwnerID() string {
+	host, err := os.Hostname()
+
+	if err != nil {
+		host = "unknown"
+	}
+
+	b := make([]byte, 4)
+	rand.Read(b)
+
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b))
+}
+
+// Health reports whether the agent is polling the accrual system or backing
+// off after failed cycles.
+func (a *Agent) Health() models.ComponentHealth {
+	return a.health.snapshot()
+}
+
+// Run polls the accrual system until ctx is done or a cycle fails with an
+// unrecoverable error. Transient failures put the agent into the degraded
+// state and delay the next cycle with a backoff. On shutdown it stops
+// scheduling new jobs, waits up to the shutdown timeout for the in-flight ones
+// and then cancels them, logging the orders left unprocessed.
 func (a *Agent) Run(ctx context.Context) error {
+	work, cancelWork := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelWork()
+
 	jobs := make(chan func() error, a.workerLimit)
-	defer close(jobs)
 
+	var workers sync.WaitGroup
 	for w := uint(1); w <= a.workerLimit; w++ {
-		go worker(jobs)
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			worker(jobs)
+		}()
+	}
+
+	wake, err := a.s.ListenNewOrders(ctx)
+
+	if err != nil {
+		logger.Log.Warn("Listen new orders, rely on periodic sweep", zap.Error(err))
 	}
 
+	var runErr error
+
+	// The timer is reset only after a cycle ran, so wakes ignored while
+	// backing off do not push the retry past the time reported in health.
+	cycle := time.NewTimer(a.nextCycleDelay())
+	defer cycle.Stop()
+
+loop:
 	for {
 		select {
-		case <-time.After(time.Duration(a.getInterval) * time.Second):
-			err := a.processingOrders(ctx, jobs)
+		case <-cycle.C:
+			runErr = a.handleCycle(a.processingOrders(ctx, work, jobs))
+		case _, ok := <-wake:
+			if !ok {
+				wake = nil
+				continue
+			}
+
+			if a.health.consecutiveFailures() > 0 {
+				// Backing off, the next cycle picks the new orders up.
+				continue
+			}
 
-			if err != nil {
-				return err
+			if !cycle.Stop() {
+				<-cycle.C
 			}
+
+			logger.Log.Info("Wake up on new orders")
+			runErr = a.handleCycle(a.processingOrders(ctx, work, jobs))
 		case <-ctx.Done():
 			logger.Log.Info("Stop agent")
-			return nil
+			break loop
 		}
 
+		if runErr != nil {
+			logger.Log.Error("Agent cannot recover, stop", zap.Error(runErr))
+			break loop
+		}
+
+		cycle.Reset(a.nextCycleDelay())
 	}
+
+	close(jobs)
+	a.drain(&workers, cancelWork)
+
+	return runErr
 }
 
-func (a *Agent) processingOrders(ctx context.Context, jobs chan<- func() error) error {
-	logger.Log.Info("Get orders from db")
-	numbers, err := a.s.GetNotProcessedOrders(ctx)
+// nextCycleDelay returns the poll interval, stretched by the backoff while
+// cycles keep failing.
+func (a *Agent) nextCycleDelay() time.Duration {
+	d := time.Duration(a.getInterval) * time.Second
+
+	if failures := a.health.consecutiveFailures(); failures > 0 {
+		d = max(d, a.cycleBackoff.Delay(failures))
+	}
+
+	return d
+}
+
+// handleCycle updates the health state after a cycle and returns the error
+// only if the agent cannot go on.
+func (a *Agent) handleCycle(err error) error {
+	now := time.Now()
+
+	if err == nil {
+		if a.health.consecutiveFailures() > 0 {
+			logger.Log.Info("Agent recovered")
+		}
+
+		a.health.success(now)
+		return nil
+	}
+
+	if isUnrecoverable(err) {
+		a.health.failure(now, err, time.Time{})
+		return err
+	}
+
+	failures := a.health.consecutiveFailures() + 1
+	delay := max(time.Duration(a.getInterval)*time.Second, a.cycleBackoff.Delay(failures))
+	a.health.failure(now, err, now.Add(delay))
+
+	logger.Log.Warn("Agent cycle failed, back off",
+		zap.Error(err),
+		zap.Int("failures", failures),
+		zap.Duration("delay", delay),
+	)
+
+	return nil
+}
+
+// drain waits for the workers and the batches to finish, cancelling the
+// in-flight jobs once the shutdown timeout expires.
+func (a *Agent) drain(workers *sync.WaitGroup, cancelWork context.CancelFunc) {
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		a.batches.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(a.shutdownTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+	case <-timer.C:
+		inFlight := a.inFlight.numbers()
+		a.abandoned.add(inFlight...)
+		logger.Log.Warn("Agent shutdown timeout exceeded, cancel in-flight jobs", zap.Strings("orders", inFlight))
+		cancelWork()
+		<-done
+	}
+
+	if abandoned := a.abandoned.numbers(); len(abandoned) > 0 {
+		logger.Log.Warn("Agent stopped, orders left unprocessed", zap.Strings("orders", abandoned))
+		return
+	}
+
+	logger.Log.Info("Agent stopped, all jobs finished")
+}
+
+// processingOrders leases due orders and hands them to the workers. Jobs run
+// with the work context so that shutdown does not interrupt them, jobs not
+// started before ctx is done are abandoned and their leases released.
+func (a *Agent) processingOrders(ctx, work context.Context, jobs chan<- func() error) error {
+	if ts := a.c.ThrottleState(); ts.Throttled(time.Now()) {
+		logger.Log.Info("Accrual system throttles requests, skip cycle",
+			zap.Time("paused_until", ts.PausedUntil),
+			zap.Uint("requests_per_minute", ts.RequestsPerMinute),
+		)
+		return nil
+	}
+
+	if a.c.BreakerState() == client.StateOpen {
+		logger.Log.Info("Accrual system circuit is open, skip cycle")
+		return nil
+	}
+
+	logger.Log.Info("Lease orders from db")
+	schedules, err := a.s.LeaseDueOrders(ctx, a.owner, a.batchSize, a.leaseTTL)
 
 	if errors.Is(err, pgx.ErrNoRows) {
 		return nil
 	}
 
+	if err != nil && ctx.Err() != nil {
+		return nil
+	}
+
 	if err != nil {
 		return fmt.Errorf("get orders: %w", err)
 	}
 
+	leased := newLeaseSet(schedules)
+	stop := make(chan struct{})
+	extended := make(chan struct{})
+	batches := a.batches
+
+	batches.Add(1)
+	go func() {
+		defer batches.Done()
+		defer close(extended)
+		a.extendLeases(work, leased, stop)
+	}()
+
 	var wg sync.WaitGroup
-	for _, val := range numbers {
-		jobs <- func() error {
-			wg.Add(1)
+
+dispatch:
+	for i, val := range schedules {
+		val := val
+		job := func() error {
 			defer wg.Done()
-			return a.updateOrder(ctx, val)
+			defer a.releaseOrder(leased, val.Number)
+
+			if ctx.Err() != nil {
+				a.abandoned.add(val.Number)
+				return nil
+			}
+
+			a.inFlight.add(val.Number)
+			defer a.inFlight.remove(val.Number)
+
+			return a.updateOrder(work, val)
+		}
+
+		wg.Add(1)
+
+		select {
+		case jobs <- job:
+		case <-ctx.Done():
+			wg.Done()
+
+			for _, rest := range schedules[i:] {
+				a.abandoned.add(rest.Number)
+				a.releaseOrder(leased, rest.Number)
+			}
+
+			break dispatch
 		}
 	}
 
-	wg.Wait()
+	done := make(chan struct{})
+	batches.Add(1)
+	go func() {
+		defer batches.Done()
+		wg.Wait()
+		close(stop)
+		<-extended
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+
 	return nil
 }
 
-func (a *Agent) updateOrder(ctx context.Context, number string) error {
+// extendLeases keeps the leases of the orders that are still in work alive
+// until stop is closed.
+func (a *Agent) extendLeases(ctx context.Context, leased *leaseSet, stop <-chan struct{}) {
+	if a.leaseTTL <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(a.leaseTTL / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			numbers := leased.numbers()
+
+			if len(numbers) == 0 {
+				continue
+			}
+
+			if err := a.s.ExtendLeases(ctx, a.owner, numbers, a.leaseTTL); err != nil {
+				logger.Log.Warn("Extend order leases", zap.Error(err))
+			}
+		case <-stop:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (a *Agent) releaseOrder(leased *leaseSet, number string) {
+	leased.remove(number)
+
+	ctx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+	defer cancel()
+
+	if err := a.s.ReleaseOrder(ctx, a.owner, number); err != nil {
+		logger.Log.Warn("Release order lease", zap.String("order", number), zap.Error(err))
+	}
+}
+
+type leaseSet struct {
+	mu     sync.Mutex
+	orders map[string]struct{}
+}
+
+func (ls *leaseSet) add(numbers ...string) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	for _, n := range numbers {
+		ls.orders[n] = struct{}{}
+	}
+}
+
+func newLeaseSet(schedules []models.OrderSchedule) *leaseSet {
+	ls := &leaseSet{orders: make(map[string]struct{}, len(schedules))}
+
+	for _, s := range schedules {
+		ls.orders[s.Number] = struct{}{}
+	}
+
+	return ls
+}
+
+func (ls *leaseSet) remove(number string) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	delete(ls.orders, number)
+}
+
+func (ls *leaseSet) numbers() []string {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	numbers := make([]string, 0, len(ls.orders))
+
+	for n := range ls.orders {
+		numbers = append(numbers, n)
+	}
+
+	return numbers
+}
+
+func (a *Agent) updateOrder(ctx context.Context, sched models.OrderSchedule) error {
 	logger.Log.Info("Get order from service")
-	o, err := a.c.GetOrder(ctx, number)
+	o, err := a.c.GetOrder(ctx, sched.Number)
+
+	switch {
+	case err != nil && ctx.Err() != nil:
+		// The job was cancelled on shutdown, the order will be polled again.
+		return err
+	case errors.Is(err, client.ErrCircuitOpen), errors.Is(err, client.ErrRateLimited):
+		// The order is not to blame, poll it again without spending an attempt.
+		return err
+	case errors.Is(err, client.ErrOrderNotRegistered) && a.unregisteredTTL > 0 &&
+		time.Since(sched.UploadedAt) > a.unregisteredTTL:
+		logger.Log.Warn("Order is not registered in accrual system, mark invalid",
+			zap.String("order", sched.Number),
+			zap.Time("uploaded_at", sched.UploadedAt),
+		)
+
+		return a.s.UpdateOrder(ctx, models.Order{Number: sched.Number, Status: models.StatusInvalid})
+	case err != nil:
+		if err := a.reschedule(ctx, sched, err); err != nil {
+			logger.Log.Warn("Schedule order", zap.String("order", sched.Number), zap.Error(err))
+		}
 
-	if err != nil {
 		return err
 	}
 
@@ -97,6 +496,52 @@ func (a *Agent) updateOrder(ctx context.Context, number string) error {
 		return err
 	}
 
+	if models.IsFinalStatus(o.Status) {
+		return nil
+	}
+
+	return a.pollAgain(ctx, sched)
+}
+
+// pollAgain schedules the next poll of an order the accrual system is still
+// processing. A healthy poll clears the failed attempts, so a slow order is
+// never parked.
+func (a *Agent) pollAgain(ctx context.Context, sched models.OrderSchedule) error {
+	sched.AttemptCount = 0
+	sched.NextAttemptAt = time.Now().Add(a.backoff.Base)
+	sched.LastError = ""
+
+	if err := a.s.ScheduleOrder(ctx, sched); err != nil {
+		return fmt.Errorf("schedule order %s: %w", sched.Number, err)
+	}
+
+	return nil
+}
+
+// reschedule moves the next attempt of the failed order according to the
+// backoff and parks the order once it runs out of attempts. An order the
+// accrual system does not know yet is left to unregisteredTTL instead of
+// being parked.
+func (a *Agent) reschedule(ctx context.Context, sched models.OrderSchedule, cause error) error {
+	sched.AttemptCount++
+	sched.NextAttemptAt = time.Now().Add(a.backoff.Delay(sched.AttemptCount))
+	sched.LastError = cause.Error()
+
+	pending := errors.Is(cause, client.ErrOrderNotRegistered) && a.unregisteredTTL > 0
+
+	if !pending && a.backoff.MaxAttempts > 0 && sched.AttemptCount >= int(a.backoff.MaxAttempts) {
+		sched.Parked = true
+		logger.Log.Warn("Park order for manual review",
+			zap.String("order", sched.Number),
+			zap.Int("attempts", sched.AttemptCount),
+			zap.String("last_error", sched.LastError),
+		)
+	}
+
+	if err := a.s.ScheduleOrder(ctx, sched); err != nil {
+		return fmt.Errorf("schedule order %s: %w", sched.Number, err)
+	}
+
 	return nil
 }
 
@@ -3,12 +3,21 @@ package agent
 import (
 	"context"
 	"fmt"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/Tomap-Tomap/go-loyalty-service/iternal/client"
 	"github.com/Tomap-Tomap/go-loyalty-service/iternal/models"
+	"github.com/Tomap-Tomap/go-loyalty-service/iternal/storage"
+	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
 )
 
 type ClientMockedObject struct {
@@ -24,17 +33,56 @@ func (cm *ClientMockedObject) GetOrder(ctx context.Context, number string) (*mod
 	return args.Get(0).(*models.Order), args.Error(1)
 }
 
+func (cm *ClientMockedObject) ThrottleState() client.ThrottleState {
+	args := cm.Called()
+
+	return args.Get(0).(client.ThrottleState)
+}
+
+func (cm *ClientMockedObject) BreakerState() client.BreakerState {
+	args := cm.Called()
+
+	return args.Get(0).(client.BreakerState)
+}
+
 type RepositoryMockedObject struct {
 	mock.Mock
 }
 
-func (rm *RepositoryMockedObject) GetNotProcessedOrders(ctx context.Context) ([]string, error) {
+func (rm *RepositoryMockedObject) LeaseDueOrders(ctx context.Context, owner string, limit int, ttl time.Duration) ([]models.OrderSchedule, error) {
+	args := rm.Called(ctx, owner, limit, ttl)
+
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]models.OrderSchedule), args.Error(1)
+}
+
+func (rm *RepositoryMockedObject) ExtendLeases(ctx context.Context, owner string, numbers []string, ttl time.Duration) error {
+	args := rm.Called(ctx, owner, numbers, ttl)
+
+	return args.Error(0)
+}
+
+func (rm *RepositoryMockedObject) ReleaseOrder(ctx context.Context, owner string, number string) error {
+	args := rm.Called(ctx, owner, number)
+
+	return args.Error(0)
+}
+
+func (rm *RepositoryMockedObject) ListenNewOrders(ctx context.Context) (<-chan struct{}, error) {
 	args := rm.Called(ctx)
 
 	if args.Get(0) == nil {
 		return nil, args.Error(1)
 	}
-	return args.Get(0).([]string), args.Error(1)
+	return args.Get(0).(<-chan struct{}), args.Error(1)
+}
+
+func (rm *RepositoryMockedObject) ScheduleOrder(ctx context.Context, os models.OrderSchedule) error {
+	args := rm.Called(ctx, os)
+
+	return args.Error(0)
 }
 
 func (rm *RepositoryMockedObject) UpdateOrder(ctx context.Context, o models.Order) error {
@@ -44,7 +92,7 @@ func (rm *RepositoryMockedObject) UpdateOrder(ctx context.Context, o models.Orde
 }
 
 func TestAgent_updateOrder(t *testing.T) {
-	accrual := float64(1)
+	accrual := models.Money(100)
 	retOrderErr := &models.Order{
 		Number:  "DBError",
 		Status:  "NEW",
@@ -57,54 +105,602 @@ func TestAgent_updateOrder(t *testing.T) {
 	}
 	cm := new(ClientMockedObject)
 	cm.On("GetOrder", context.Background(), "error").Return(nil, fmt.Errorf("test error"))
+	cm.On("GetOrder", context.Background(), "open").Return(nil, client.ErrCircuitOpen)
 	cm.On("GetOrder", context.Background(), "DBError").Return(retOrderErr, nil)
 	cm.On("GetOrder", context.Background(), "NoError").Return(retOrder, nil)
 
 	rm := new(RepositoryMockedObject)
 	rm.On("UpdateOrder", context.Background(), *retOrderErr).Return(fmt.Errorf("test error"))
 	rm.On("UpdateOrder", context.Background(), *retOrder).Return(nil)
+	rm.On("ScheduleOrder", context.Background(), mock.MatchedBy(func(os models.OrderSchedule) bool {
+		return os.Number == "error" && os.AttemptCount == 1 && os.LastError == "test error" && !os.Parked
+	})).Return(nil)
+	rm.On("ScheduleOrder", context.Background(), mock.MatchedBy(func(os models.OrderSchedule) bool {
+		return os.Number == "NoError" && os.AttemptCount == 0 && os.LastError == "" && !os.Parked
+	})).Return(nil)
 
-	a := NewAgent(rm, cm, 0, 0)
+	a := NewAgent(rm, cm, 0, 0, Backoff{Base: time.Second, Max: time.Minute, MaxAttempts: 3}, 0, time.Second)
 
 	t.Run("get order error", func(t *testing.T) {
-		err := a.updateOrder(context.Background(), "error")
+		err := a.updateOrder(context.Background(), models.OrderSchedule{Number: "error"})
 		require.Error(t, err)
 	})
 
+	t.Run("circuit open", func(t *testing.T) {
+		err := a.updateOrder(context.Background(), models.OrderSchedule{Number: "open"})
+		require.ErrorIs(t, err, client.ErrCircuitOpen)
+	})
+
 	t.Run("get db error", func(t *testing.T) {
-		err := a.updateOrder(context.Background(), "DBError")
+		err := a.updateOrder(context.Background(), models.OrderSchedule{Number: "DBError"})
 		require.Error(t, err)
 	})
 
 	t.Run("get no error", func(t *testing.T) {
-		err := a.updateOrder(context.Background(), "NoError")
+		err := a.updateOrder(context.Background(), models.OrderSchedule{Number: "NoError", AttemptCount: 2})
 		require.NoError(t, err)
 	})
 
 	cm.AssertExpectations(t)
+	rm.AssertExpectations(t)
+}
+
+func TestAgent_updateOrderAccrualErrors(t *testing.T) {
+	cm := new(ClientMockedObject)
+	cm.On("GetOrder", context.Background(), "old").Return(nil, client.ErrOrderNotRegistered)
+	cm.On("GetOrder", context.Background(), "young").Return(nil, client.ErrOrderNotRegistered)
+	cm.On("GetOrder", context.Background(), "limited").Return(nil, &client.RateLimitError{RetryAfter: time.Minute})
+
+	rm := new(RepositoryMockedObject)
+	rm.On("UpdateOrder", context.Background(), models.Order{Number: "old", Status: models.StatusInvalid}).Return(nil)
+	rm.On("ScheduleOrder", context.Background(), mock.MatchedBy(func(os models.OrderSchedule) bool {
+		return os.Number == "young" && os.AttemptCount == 3 && os.LastError == client.ErrOrderNotRegistered.Error() && !os.Parked
+	})).Return(nil)
+
+	a := NewAgent(rm, cm, 0, 0, Backoff{Base: time.Second, MaxAttempts: 3}, time.Hour, time.Second)
+
+	t.Run("long unregistered", func(t *testing.T) {
+		err := a.updateOrder(context.Background(), models.OrderSchedule{Number: "old", UploadedAt: time.Now().Add(-2 * time.Hour)})
+		require.NoError(t, err)
+	})
+
+	t.Run("recently unregistered", func(t *testing.T) {
+		err := a.updateOrder(context.Background(), models.OrderSchedule{Number: "young", UploadedAt: time.Now(), AttemptCount: 2})
+		require.ErrorIs(t, err, client.ErrOrderNotRegistered)
+	})
+
+	t.Run("rate limited", func(t *testing.T) {
+		err := a.updateOrder(context.Background(), models.OrderSchedule{Number: "limited", UploadedAt: time.Now()})
+		require.ErrorIs(t, err, client.ErrRateLimited)
+	})
+
+	cm.AssertExpectations(t)
+	rm.AssertExpectations(t)
+	rm.AssertNumberOfCalls(t, "ScheduleOrder", 1)
+}
+
+func TestAgent_updateOrderSlowProcessing(t *testing.T) {
+	retOrder := &models.Order{Number: "slow", Status: models.StatusProcessing}
+	cm := new(ClientMockedObject)
+	cm.On("GetOrder", context.Background(), "slow").Return(retOrder, nil)
+
+	var scheduled []models.OrderSchedule
+	rm := new(RepositoryMockedObject)
+	rm.On("UpdateOrder", context.Background(), *retOrder).Return(nil)
+	rm.On("ScheduleOrder", context.Background(), mock.Anything).Run(func(args mock.Arguments) {
+		scheduled = append(scheduled, args.Get(1).(models.OrderSchedule))
+	}).Return(nil)
+
+	a := NewAgent(rm, cm, 0, 0, Backoff{Base: time.Second, Max: time.Minute, MaxAttempts: 3}, 0, time.Second)
+	sched := models.OrderSchedule{Number: "slow"}
+
+	for i := 0; i < 6; i++ {
+		require.NoError(t, a.updateOrder(context.Background(), sched))
+		require.Len(t, scheduled, i+1)
+
+		sched = scheduled[i]
+		require.False(t, sched.Parked)
+		require.Zero(t, sched.AttemptCount)
+		require.WithinDuration(t, time.Now().Add(time.Second), sched.NextAttemptAt, time.Second)
+	}
+}
+
+func TestAgent_updateOrderFinal(t *testing.T) {
+	accrual := models.Money(100)
+	retOrder := &models.Order{
+		Number:  "final",
+		Status:  models.StatusProcessed,
+		Accrual: &accrual,
+	}
+	cm := new(ClientMockedObject)
+	cm.On("GetOrder", context.Background(), "final").Return(retOrder, nil)
+
+	rm := new(RepositoryMockedObject)
+	rm.On("UpdateOrder", context.Background(), *retOrder).Return(nil)
+
+	a := NewAgent(rm, cm, 0, 0, Backoff{Base: time.Second}, 0, time.Second)
+
+	err := a.updateOrder(context.Background(), models.OrderSchedule{Number: "final"})
+	require.NoError(t, err)
+	rm.AssertNotCalled(t, "ScheduleOrder", mock.Anything, mock.Anything)
+}
+
+func TestBackoff_Delay(t *testing.T) {
+	tests := []struct {
+		name    string
+		backoff Backoff
+		attempt int
+		want    time.Duration
+	}{
+		{"first attempt", Backoff{Base: time.Second, Max: time.Minute}, 1, time.Second},
+		{"third attempt", Backoff{Base: time.Second, Max: time.Minute}, 3, 4 * time.Second},
+		{"capped", Backoff{Base: time.Second, Max: time.Minute}, 10, time.Minute},
+		{"many attempts", Backoff{Base: time.Second, Max: time.Minute}, 1000, time.Minute},
+		{"no max", Backoff{Base: time.Second}, 4, 8 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, tt.backoff.Delay(tt.attempt))
+		})
+	}
 }
 
 func TestAgent_processingOrders(t *testing.T) {
 	cm := new(ClientMockedObject)
+	cm.On("ThrottleState").Return(client.ThrottleState{})
+	cm.On("BreakerState").Return(client.StateClosed)
 	rm := new(RepositoryMockedObject)
-	rm.On("GetNotProcessedOrders", context.Background()).Return(nil, pgx.ErrNoRows)
+	rm.On("LeaseDueOrders", context.Background(), mock.Anything, 0, defaultLeaseTTL).Return(nil, pgx.ErrNoRows)
 
-	a := NewAgent(rm, cm, 0, 0)
+	a := NewAgent(rm, cm, 0, 0, Backoff{}, 0, time.Second)
 
 	t.Run("get order error", func(t *testing.T) {
-		err := a.processingOrders(context.Background(), nil)
+		err := a.processingOrders(context.Background(), context.Background(), nil)
 		require.NoError(t, err)
 	})
 
 	cm.AssertExpectations(t)
 
 	rm = new(RepositoryMockedObject)
-	rm.On("GetNotProcessedOrders", context.Background()).Return(nil, fmt.Errorf("test error"))
-	a = NewAgent(rm, cm, 0, 0)
+	rm.On("LeaseDueOrders", context.Background(), mock.Anything, 0, defaultLeaseTTL).Return(nil, fmt.Errorf("test error"))
+	a = NewAgent(rm, cm, 0, 0, Backoff{}, 0, time.Second)
 	t.Run("get order error", func(t *testing.T) {
-		err := a.processingOrders(context.Background(), nil)
+		err := a.processingOrders(context.Background(), context.Background(), nil)
 		require.Error(t, err)
 	})
 
 	cm.AssertExpectations(t)
+
+	cm = new(ClientMockedObject)
+	cm.On("ThrottleState").Return(client.ThrottleState{})
+	cm.On("BreakerState").Return(client.StateClosed)
+	rm = new(RepositoryMockedObject)
+	rm.On("LeaseDueOrders", context.Background(), mock.Anything, 20, defaultLeaseTTL).
+		Return([]models.OrderSchedule{{Number: "first"}, {Number: "second"}}, nil)
+
+	for _, number := range []string{"first", "second"} {
+		o := &models.Order{Number: number, Status: models.StatusInvalid}
+		cm.On("GetOrder", context.Background(), number).Return(o, nil).Once()
+		rm.On("UpdateOrder", context.Background(), *o).Return(nil).Once()
+		rm.On("ReleaseOrder", mock.Anything, mock.Anything, number).Return(nil).Once()
+	}
+
+	a = NewAgent(rm, cm, 0, 2, Backoff{}, 0, time.Second)
+	t.Run("due orders", func(t *testing.T) {
+		jobs := make(chan func() error, 2)
+		defer close(jobs)
+		go worker(jobs)
+
+		err := a.processingOrders(context.Background(), context.Background(), jobs)
+		require.NoError(t, err)
+	})
+
+	cm.AssertExpectations(t)
+	rm.AssertExpectations(t)
+
+	cm = new(ClientMockedObject)
+	cm.On("ThrottleState").Return(client.ThrottleState{PausedUntil: time.Now().Add(time.Hour)})
+	rm = new(RepositoryMockedObject)
+	a = NewAgent(rm, cm, 0, 2, Backoff{}, 0, time.Second)
+	t.Run("throttled", func(t *testing.T) {
+		err := a.processingOrders(context.Background(), context.Background(), nil)
+		require.NoError(t, err)
+	})
+
+	cm.AssertExpectations(t)
+	rm.AssertNotCalled(t, "LeaseDueOrders", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+
+	cm = new(ClientMockedObject)
+	cm.On("ThrottleState").Return(client.ThrottleState{})
+	cm.On("BreakerState").Return(client.StateOpen)
+	rm = new(RepositoryMockedObject)
+	a = NewAgent(rm, cm, 0, 2, Backoff{}, 0, time.Second)
+	t.Run("circuit open", func(t *testing.T) {
+		err := a.processingOrders(context.Background(), context.Background(), nil)
+		require.NoError(t, err)
+	})
+
+	cm.AssertExpectations(t)
+	rm.AssertNotCalled(t, "LeaseDueOrders", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+type concurrencyClient struct {
+	mu       sync.Mutex
+	inFlight map[string]bool
+	calls    map[string]int
+	t        *testing.T
+}
+
+func (cc *concurrencyClient) GetOrder(ctx context.Context, number string) (*models.Order, error) {
+	cc.mu.Lock()
+	if cc.inFlight[number] {
+		cc.t.Errorf("order %s is processed concurrently", number)
+	}
+	cc.inFlight[number] = true
+	cc.calls[number]++
+	cc.mu.Unlock()
+
+	time.Sleep(time.Millisecond)
+
+	cc.mu.Lock()
+	cc.inFlight[number] = false
+	cc.mu.Unlock()
+
+	accrual := models.Money(100)
+	return &models.Order{Number: number, Status: models.StatusProcessed, Accrual: &accrual}, nil
+}
+
+func (cc *concurrencyClient) ThrottleState() client.ThrottleState {
+	return client.ThrottleState{}
+}
+
+func (cc *concurrencyClient) BreakerState() client.BreakerState {
+	return client.StateClosed
+}
+
+func TestAgent_concurrentAgents(t *testing.T) {
+	ctx := context.Background()
+	ms := storage.NewMemoryStorage()
+	require.NoError(t, ms.CreateUser(ctx, models.User{Login: "user", Password: "pwd"}))
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, ms.AddOrder(ctx, strconv.Itoa(i), "user"))
+	}
+
+	cc := &concurrencyClient{inFlight: make(map[string]bool), calls: make(map[string]int), t: t}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		a := NewAgent(ms, cc, 0, 3, Backoff{Base: time.Minute}, 0, time.Second)
+		a.batchSize = 4
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			jobs := make(chan func() error, a.workerLimit)
+			defer close(jobs)
+
+			for w := uint(1); w <= a.workerLimit; w++ {
+				go worker(jobs)
+			}
+
+			for j := 0; j < 10; j++ {
+				assert.NoError(t, a.processingOrders(ctx, ctx, jobs))
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	require.Len(t, cc.calls, 100)
+	for number, calls := range cc.calls {
+		require.Equal(t, 1, calls, number)
+	}
+
+	b, err := ms.GetBalance(ctx, "user")
+	require.NoError(t, err)
+	require.Equal(t, models.Money(10000), b.Current)
+}
+
+type notifiedClient struct {
+	got chan string
+}
+
+func (nc *notifiedClient) GetOrder(ctx context.Context, number string) (*models.Order, error) {
+	select {
+	case nc.got <- number:
+	default:
+	}
+
+	return &models.Order{Number: number, Status: models.StatusInvalid}, nil
+}
+
+func (nc *notifiedClient) ThrottleState() client.ThrottleState {
+	return client.ThrottleState{}
+}
+
+func (nc *notifiedClient) BreakerState() client.BreakerState {
+	return client.StateClosed
+}
+
+func TestAgent_RunWakesOnNewOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ms := storage.NewMemoryStorage()
+	require.NoError(t, ms.CreateUser(ctx, models.User{Login: "user", Password: "pwd"}))
+
+	nc := &notifiedClient{got: make(chan string, 1)}
+	a := NewAgent(ms, nc, 3600, 1, Backoff{}, 0, time.Second)
+
+	done := make(chan error)
+	go func() {
+		done <- a.Run(ctx)
+	}()
+
+	// The listener may not be subscribed yet, so keep adding orders until
+	// one of them wakes the agent up long before the periodic sweep.
+	var added int
+	require.Eventually(t, func() bool {
+		added++
+		require.NoError(t, ms.AddOrder(ctx, strconv.Itoa(added), "user"))
+
+		select {
+		case <-nc.got:
+			return true
+		default:
+			return false
+		}
+	}, 5*time.Second, 50*time.Millisecond)
+
+	cancel()
+	require.NoError(t, <-done)
+}
+
+func TestAgent_RunWithoutListen(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	rm := new(RepositoryMockedObject)
+	rm.On("ListenNewOrders", mock.Anything).Return(nil, fmt.Errorf("test error"))
+
+	a := NewAgent(rm, new(ClientMockedObject), 3600, 1, Backoff{}, 0, time.Second)
+
+	done := make(chan error)
+	go func() {
+		done <- a.Run(ctx)
+	}()
+
+	cancel()
+	require.NoError(t, <-done)
+	rm.AssertExpectations(t)
+}
+
+type blockingClient struct {
+	started chan string
+	finish  chan struct{}
+}
+
+func (bc *blockingClient) GetOrder(ctx context.Context, number string) (*models.Order, error) {
+	bc.started <- number
+
+	select {
+	case <-bc.finish:
+		return &models.Order{Number: number, Status: models.StatusInvalid}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (bc *blockingClient) ThrottleState() client.ThrottleState {
+	return client.ThrottleState{}
+}
+
+func (bc *blockingClient) BreakerState() client.BreakerState {
+	return client.StateClosed
+}
+
+func TestAgent_RunShutdown(t *testing.T) {
+	newAgent := func(t *testing.T, orders []string, shutdownTimeout time.Duration) (*Agent, *storage.MemoryStorage, *blockingClient) {
+		ms := storage.NewMemoryStorage()
+		require.NoError(t, ms.CreateUser(context.Background(), models.User{Login: "user", Password: "pwd"}))
+
+		for _, o := range orders {
+			require.NoError(t, ms.AddOrder(context.Background(), o, "user"))
+		}
+
+		bc := &blockingClient{started: make(chan string, len(orders)), finish: make(chan struct{})}
+		a := NewAgent(ms, bc, 1, 1, Backoff{Base: time.Hour}, 0, shutdownTimeout)
+
+		return &a, ms, bc
+	}
+
+	run := func(ctx context.Context, a *Agent) <-chan error {
+		done := make(chan error, 1)
+		go func() {
+			done <- a.Run(ctx)
+		}()
+
+		return done
+	}
+
+	t.Run("drain in-flight jobs", func(t *testing.T) {
+		defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+		a, ms, bc := newAgent(t, []string{"1"}, time.Minute)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := run(ctx, a)
+
+		require.Equal(t, "1", <-bc.started)
+		cancel()
+
+		select {
+		case <-done:
+			t.Fatal("agent stopped before in-flight job finished")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		close(bc.finish)
+		require.NoError(t, <-done)
+		require.Empty(t, a.abandoned.numbers())
+
+		orders, err := ms.GetOrders(context.Background(), "user", models.ListFilter{})
+		require.NoError(t, err)
+		require.Equal(t, models.StatusInvalid, orders[0].Status)
+	})
+
+	t.Run("abandon after timeout", func(t *testing.T) {
+		defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+		a, ms, bc := newAgent(t, []string{"1", "2", "3"}, 50*time.Millisecond)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := run(ctx, a)
+
+		first := <-bc.started
+		cancel()
+
+		require.NoError(t, <-done)
+		require.ElementsMatch(t, []string{"1", "2", "3"}, a.abandoned.numbers())
+		require.Empty(t, a.inFlight.numbers())
+
+		due, err := ms.LeaseDueOrders(context.Background(), "another", 0, time.Minute)
+		require.NoError(t, err)
+		require.Len(t, due, 3)
+
+		for _, o := range due {
+			require.Zero(t, o.AttemptCount, first)
+		}
+	})
+}
+
+func TestAgent_handleCycle(t *testing.T) {
+	a := NewAgent(new(RepositoryMockedObject), new(ClientMockedObject), 0, 1, Backoff{}, 0, time.Second)
+
+	require.Equal(t, models.HealthOK, a.Health().Status)
+
+	require.NoError(t, a.handleCycle(fmt.Errorf("test error")))
+	require.NoError(t, a.handleCycle(fmt.Errorf("test error")))
+
+	h := a.Health()
+	require.Equal(t, models.HealthDegraded, h.Status)
+	require.Equal(t, 2, h.Failures)
+	require.Equal(t, "test error", h.LastError)
+	require.NotNil(t, h.RetryAt)
+	require.Equal(t, 2*cycleBackoffBase, a.nextCycleDelay())
+
+	require.NoError(t, a.handleCycle(nil))
+
+	h = a.Health()
+	require.Equal(t, models.HealthOK, h.Status)
+	require.Zero(t, h.Failures)
+	require.NotNil(t, h.LastSuccessAt)
+	require.Nil(t, h.RetryAt)
+	require.Zero(t, a.nextCycleDelay())
+
+	err := a.handleCycle(fmt.Errorf("get orders: %w", &pgconn.PgError{Code: pgerrcode.UndefinedTable}))
+	require.Error(t, err)
+	require.Equal(t, models.HealthDegraded, a.Health().Status)
+}
+
+func TestAgent_RunSurvivesTransientErrors(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cm := new(ClientMockedObject)
+	cm.On("ThrottleState").Return(client.ThrottleState{})
+	cm.On("BreakerState").Return(client.StateClosed)
+
+	rm := new(RepositoryMockedObject)
+	rm.On("ListenNewOrders", mock.Anything).Return(nil, fmt.Errorf("test error"))
+	rm.On("LeaseDueOrders", mock.Anything, mock.Anything, 10, defaultLeaseTTL).
+		Return(nil, &pgconn.PgError{Code: pgerrcode.AdminShutdown}).Twice()
+	rm.On("LeaseDueOrders", mock.Anything, mock.Anything, 10, defaultLeaseTTL).Return(nil, pgx.ErrNoRows)
+
+	a := NewAgent(rm, cm, 0, 1, Backoff{}, 0, time.Second)
+	a.cycleBackoff = Backoff{Base: time.Millisecond, Max: 10 * time.Millisecond}
+
+	done := make(chan error)
+	go func() {
+		done <- a.Run(ctx)
+	}()
+
+	require.Eventually(t, func() bool {
+		h := a.Health()
+		return h.Status == models.HealthOK && h.LastSuccessAt != nil && h.LastErrorAt != nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	require.NoError(t, <-done)
+}
+
+func TestAgent_RunWakesDoNotDelayRetry(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cm := new(ClientMockedObject)
+	cm.On("ThrottleState").Return(client.ThrottleState{})
+	cm.On("BreakerState").Return(client.StateClosed)
+
+	wake := make(chan struct{}, 1)
+	rm := new(RepositoryMockedObject)
+	rm.On("ListenNewOrders", mock.Anything).Return((<-chan struct{})(wake), nil)
+	rm.On("LeaseDueOrders", mock.Anything, mock.Anything, 10, defaultLeaseTTL).
+		Return(nil, &pgconn.PgError{Code: pgerrcode.AdminShutdown}).Once()
+	rm.On("LeaseDueOrders", mock.Anything, mock.Anything, 10, defaultLeaseTTL).Return(nil, pgx.ErrNoRows)
+
+	a := NewAgent(rm, cm, 0, 1, Backoff{}, 0, time.Second)
+	a.cycleBackoff = Backoff{Base: 300 * time.Millisecond, Max: 300 * time.Millisecond}
+
+	done := make(chan error)
+	go func() {
+		done <- a.Run(ctx)
+	}()
+
+	require.Eventually(t, func() bool {
+		return a.Health().RetryAt != nil
+	}, 5*time.Second, time.Millisecond)
+
+	retryAt := *a.Health().RetryAt
+
+	// Wakes keep coming faster than the backoff, the retry still runs on time.
+	require.Eventually(t, func() bool {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+
+		return a.Health().LastSuccessAt != nil
+	}, time.Second, 10*time.Millisecond)
+
+	h := a.Health()
+	require.Equal(t, models.HealthOK, h.Status)
+	require.False(t, h.LastSuccessAt.Before(retryAt))
+	require.Less(t, h.LastSuccessAt.Sub(retryAt), 200*time.Millisecond)
+
+	cancel()
+	require.NoError(t, <-done)
+}
+
+func TestAgent_RunStopsOnUnrecoverableError(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	cm := new(ClientMockedObject)
+	cm.On("ThrottleState").Return(client.ThrottleState{})
+	cm.On("BreakerState").Return(client.StateClosed)
+
+	rm := new(RepositoryMockedObject)
+	rm.On("ListenNewOrders", mock.Anything).Return(nil, fmt.Errorf("test error"))
+	rm.On("LeaseDueOrders", mock.Anything, mock.Anything, 10, defaultLeaseTTL).
+		Return(nil, &pgconn.PgError{Code: pgerrcode.InvalidPassword}).Once()
+
+	a := NewAgent(rm, cm, 0, 1, Backoff{}, 0, time.Second)
+
+	err := a.Run(context.Background())
+	require.Error(t, err)
+	require.Equal(t, models.HealthDegraded, a.Health().Status)
+	rm.AssertExpectations(t)
 }
@@ -0,0 +1,85 @@
+package agent
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Tomap-Tomap/go-loyalty-service/iternal/models"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// isUnrecoverable reports whether retrying the cycle cannot help: the database
+// rejects the credentials, does not exist or has a schema the agent does not
+// expect. Everything else is treated as transient.
+func isUnrecoverable(err error) bool {
+	var pgErr *pgconn.PgError
+
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+
+	return pgerrcode.IsInvalidAuthorizationSpecification(pgErr.Code) ||
+		pgerrcode.IsInvalidCatalogName(pgErr.Code) ||
+		pgerrcode.IsSyntaxErrororAccessRuleViolation(pgErr.Code)
+}
+
+type healthState struct {
+	mu            sync.Mutex
+	failures      int
+	lastError     string
+	lastErrorAt   time.Time
+	lastSuccessAt time.Time
+	retryAt       time.Time
+}
+
+func (hs *healthState) success(t time.Time) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	hs.failures = 0
+	hs.lastSuccessAt = t
+	hs.retryAt = time.Time{}
+}
+
+// failure records a failed cycle and when the next one is due.
+func (hs *healthState) failure(t time.Time, err error, retryAt time.Time) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	hs.failures++
+	hs.lastError = err.Error()
+	hs.lastErrorAt = t
+	hs.retryAt = retryAt
+}
+
+func (hs *healthState) consecutiveFailures() int {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	return hs.failures
+}
+
+func (hs *healthState) snapshot() models.ComponentHealth {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	h := models.ComponentHealth{Status: models.HealthOK, Failures: hs.failures, LastError: hs.lastError}
+
+	if hs.failures > 0 {
+		h.Status = models.HealthDegraded
+	}
+
+	for _, p := range []struct {
+		src time.Time
+		dst **time.Time
+	}{{hs.lastErrorAt, &h.LastErrorAt}, {hs.lastSuccessAt, &h.LastSuccessAt}, {hs.retryAt, &h.RetryAt}} {
+		if !p.src.IsZero() {
+			t := p.src
+			*p.dst = &t
+		}
+	}
+
+	return h
+}
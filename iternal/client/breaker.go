@@ -0,0 +1,196 @@
+package client
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Tomap-Tomap/go-loyalty-service/iternal/logger"
+	"go.uber.org/zap"
+)
+
+var ErrCircuitOpen error = fmt.Errorf("accrual system circuit is open")
+
+type BreakerState int
+
+const (
+	StateClosed BreakerState = iota
+	StateOpen
+	StateHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(s))
+	}
+}
+
+// BreakerConfig configures the circuit breaker. The circuit opens after
+// FailureThreshold consecutive failures, stays open for OpenTimeout and then
+// lets HalfOpenRequests probes through, closing once all of them succeed.
+type BreakerConfig struct {
+	FailureThreshold uint
+	OpenTimeout      time.Duration
+	HalfOpenRequests uint
+}
+
+var DefaultBreakerConfig = BreakerConfig{
+	FailureThreshold: 5,
+	OpenTimeout:      30 * time.Second,
+	HalfOpenRequests: 1,
+}
+
+// BreakerStats is a snapshot of the breaker state and the number of
+// transitions into every state.
+type BreakerStats struct {
+	State               BreakerState
+	ConsecutiveFailures uint
+	Opened              uint64
+	HalfOpened          uint64
+	Closed              uint64
+}
+
+type Breaker struct {
+	mu        sync.Mutex
+	cfg       BreakerConfig
+	state     BreakerState
+	failures  uint
+	openedAt  time.Time
+	probes    uint
+	successes uint
+	stats     BreakerStats
+	now       func() time.Time
+}
+
+func NewBreaker(cfg BreakerConfig) *Breaker {
+	if cfg.FailureThreshold == 0 {
+		cfg.FailureThreshold = DefaultBreakerConfig.FailureThreshold
+	}
+
+	if cfg.HalfOpenRequests == 0 {
+		cfg.HalfOpenRequests = DefaultBreakerConfig.HalfOpenRequests
+	}
+
+	return &Breaker{cfg: cfg, now: time.Now}
+}
+
+// Allow reports whether a request may be sent. Every allowed request must be
+// finished with Success, Failure or Release.
+func (b *Breaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.currentState() {
+	case StateOpen:
+		return ErrCircuitOpen
+	case StateHalfOpen:
+		if b.probes >= b.cfg.HalfOpenRequests {
+			return ErrCircuitOpen
+		}
+
+		b.probes++
+	}
+
+	return nil
+}
+
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.currentState() {
+	case StateClosed:
+		b.failures = 0
+	case StateHalfOpen:
+		b.successes++
+
+		if b.successes >= b.cfg.HalfOpenRequests {
+			b.setState(StateClosed)
+		}
+	}
+}
+
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.currentState() {
+	case StateClosed:
+		b.failures++
+
+		if b.failures >= b.cfg.FailureThreshold {
+			b.setState(StateOpen)
+		}
+	case StateHalfOpen:
+		b.failures++
+		b.setState(StateOpen)
+	}
+}
+
+// Release finishes a request whose outcome says nothing about the accrual
+// system, for example a cancelled one.
+func (b *Breaker) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.currentState() == StateHalfOpen && b.probes > 0 {
+		b.probes--
+	}
+}
+
+func (b *Breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.currentState()
+}
+
+func (b *Breaker) Stats() BreakerStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stats := b.stats
+	stats.State = b.currentState()
+	stats.ConsecutiveFailures = b.failures
+
+	return stats
+}
+
+func (b *Breaker) currentState() BreakerState {
+	if b.state == StateOpen && !b.now().Before(b.openedAt.Add(b.cfg.OpenTimeout)) {
+		b.setState(StateHalfOpen)
+	}
+
+	return b.state
+}
+
+func (b *Breaker) setState(s BreakerState) {
+	from := b.state
+	b.state = s
+	b.probes = 0
+	b.successes = 0
+
+	switch s {
+	case StateOpen:
+		b.openedAt = b.now()
+		b.stats.Opened++
+	case StateHalfOpen:
+		b.stats.HalfOpened++
+	case StateClosed:
+		b.failures = 0
+		b.stats.Closed++
+	}
+
+	logger.Log.Warn("Accrual circuit breaker state changed",
+		zap.Stringer("from", from),
+		zap.Stringer("to", s),
+		zap.Uint("consecutive_failures", b.failures),
+	)
+}
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Now()
+	b := NewBreaker(BreakerConfig{FailureThreshold: 3, OpenTimeout: time.Minute, HalfOpenRequests: 2})
+	b.now = func() time.Time { return now }
+
+	t.Run("closed", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			require.NoError(t, b.Allow())
+			b.Failure()
+		}
+
+		require.NoError(t, b.Allow())
+		b.Success()
+		require.Equal(t, StateClosed, b.State())
+		require.Zero(t, b.Stats().ConsecutiveFailures)
+	})
+
+	t.Run("open", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			require.NoError(t, b.Allow())
+			b.Failure()
+		}
+
+		require.Equal(t, StateOpen, b.State())
+		require.ErrorIs(t, b.Allow(), ErrCircuitOpen)
+
+		now = now.Add(30 * time.Second)
+		require.ErrorIs(t, b.Allow(), ErrCircuitOpen)
+	})
+
+	t.Run("half-open failure", func(t *testing.T) {
+		now = now.Add(30 * time.Second)
+		require.Equal(t, StateHalfOpen, b.State())
+
+		require.NoError(t, b.Allow())
+		require.NoError(t, b.Allow())
+		require.ErrorIs(t, b.Allow(), ErrCircuitOpen)
+
+		b.Failure()
+		require.Equal(t, StateOpen, b.State())
+	})
+
+	t.Run("half-open release", func(t *testing.T) {
+		now = now.Add(time.Minute)
+
+		require.NoError(t, b.Allow())
+		require.NoError(t, b.Allow())
+		b.Release()
+		require.NoError(t, b.Allow())
+		require.Equal(t, StateHalfOpen, b.State())
+	})
+
+	t.Run("half-open success", func(t *testing.T) {
+		b.Success()
+		require.Equal(t, StateHalfOpen, b.State())
+		b.Success()
+		require.Equal(t, StateClosed, b.State())
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		require.Equal(t, BreakerStats{State: StateClosed, Opened: 2, HalfOpened: 2, Closed: 1}, b.Stats())
+	})
+}
+
+func TestBreakerState_String(t *testing.T) {
+	require.Equal(t, "closed", StateClosed.String())
+	require.Equal(t, "open", StateOpen.String())
+	require.Equal(t, "half-open", StateHalfOpen.String())
+	require.Equal(t, "unknown(7)", BreakerState(7).String())
+}
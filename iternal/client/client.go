@@ -6,6 +6,8 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"regexp"
+	"strconv"
 	"syscall"
 	"time"
 
@@ -15,53 +17,209 @@ import (
 	"go.uber.org/zap"
 )
 
+const (
+	rateLimitRetries  = 3
+	defaultRetryAfter = time.Minute
+)
+
+var rateLimitBody = regexp.MustCompile(`No more than (\d+) requests per minute`)
+
+var ErrOrderNotRegistered error = fmt.Errorf("order is not registered in accrual system")
+var ErrRateLimited error = fmt.Errorf("accrual system rate limit exceeded")
+var ErrAccrualUnavailable error = fmt.Errorf("accrual system is unavailable")
+
+// RateLimitError is returned when the accrual system keeps answering 429,
+// RetryAfter is the pause it asked for.
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", ErrRateLimited, e.RetryAfter)
+}
+
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
 type Client struct {
 	addr        string
 	restyClient *resty.Client
+	limiter     *Limiter
+	breaker     *Breaker
 }
 
-func NewClient(addr string) *Client {
+// NewClient creates a client to the accrual system, requestsPerMinute limits
+// the requests of all workers, zero means no limit until the accrual system
+// reports one.
+func NewClient(addr string, requestsPerMinute uint, bc BreakerConfig) *Client {
 	client := resty.New().
 		AddRetryCondition(func(r *resty.Response, err error) bool {
-			if r.StatusCode() == http.StatusTooManyRequests {
-				retryAfterHeader := r.Header().Get("Retry-After")
-				if retryAfterHeader != "" {
-					retryAfter, err := time.ParseDuration(retryAfterHeader + "s")
-					if err != nil {
-						logger.Log.Warn("Parse Retry-After", zap.Error(err))
-						return false
-					}
-
-					time.Sleep(retryAfter)
-					return true
-				}
-			}
 			return errors.Is(err, syscall.ECONNREFUSED)
 		}).SetRetryCount(3)
-	return &Client{addr, client}
+	return &Client{addr, client, NewLimiter(requestsPerMinute), NewBreaker(bc)}
 }
 
 func (c *Client) GetOrder(ctx context.Context, number string) (*models.Order, error) {
-	req := c.restyClient.R().
-		SetHeader("Content-Encoding", "gzip").
-		SetContext(ctx)
-	resp, err := req.Get(c.addr + "/api/orders/" + number)
+	var (
+		resp       *resty.Response
+		retryAfter time.Duration
+	)
 
-	if err != nil {
-		return nil, fmt.Errorf("get order: %w", err)
+	for attempt := 0; ; attempt++ {
+		if err := c.limiter.Wait(ctx); err != nil {
+			return nil, fmt.Errorf("wait rate limiter: %w", err)
+		}
+
+		if err := c.breaker.Allow(); err != nil {
+			return nil, err
+		}
+
+		req := c.restyClient.R().
+			SetHeader("Content-Encoding", "gzip").
+			SetContext(ctx)
+		r, err := req.Get(c.addr + "/api/orders/" + number)
+
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			c.breaker.Release()
+			return nil, fmt.Errorf("get order: %w", err)
+		}
+
+		if err != nil {
+			c.breaker.Failure()
+			return nil, fmt.Errorf("get order: %w: %w", ErrAccrualUnavailable, err)
+		}
+
+		resp = r
+
+		if resp.StatusCode() >= http.StatusInternalServerError {
+			c.breaker.Failure()
+		} else {
+			c.breaker.Success()
+		}
+
+		if resp.StatusCode() != http.StatusTooManyRequests {
+			break
+		}
+
+		retryAfter = c.throttle(resp)
+
+		if attempt+1 >= rateLimitRetries {
+			break
+		}
 	}
 
-	if resp.StatusCode() != http.StatusOK {
-		return nil, fmt.Errorf("request return %d status code", resp.StatusCode())
+	switch code := resp.StatusCode(); {
+	case code == http.StatusOK:
+	case code == http.StatusNoContent:
+		return nil, ErrOrderNotRegistered
+	case code == http.StatusTooManyRequests:
+		return nil, &RateLimitError{RetryAfter: retryAfter}
+	case code >= http.StatusInternalServerError:
+		return nil, fmt.Errorf("%w: request return %d status code", ErrAccrualUnavailable, code)
+	default:
+		return nil, fmt.Errorf("request return %d status code", code)
 	}
 
 	var order models.Order
 
-	err = json.Unmarshal(resp.Body(), &order)
+	err := json.Unmarshal(resp.Body(), &order)
 
 	if err != nil {
 		return nil, fmt.Errorf("unmarsall body: %w", err)
 	}
 
+	normalizeStatus(&order)
+
 	return &order, nil
 }
+
+// normalizeStatus maps a status the service does not know to PROCESSING, so
+// the order is neither credited nor finalized and is polled again later.
+func normalizeStatus(o *models.Order) {
+	switch o.Status {
+	case models.StatusNew, models.StatusProcessing, models.StatusInvalid, models.StatusProcessed:
+		return
+	}
+
+	logger.Log.Warn("Unknown accrual status", zap.String("order", o.Number), zap.String("status", o.Status))
+	o.Status = models.StatusProcessing
+	o.Accrual = nil
+}
+
+// ThrottleState returns the current limits of the client.
+func (c *Client) ThrottleState() ThrottleState {
+	return c.limiter.State()
+}
+
+// BreakerState returns the state of the circuit breaker around the accrual
+// system.
+func (c *Client) BreakerState() BreakerState {
+	return c.breaker.State()
+}
+
+// BreakerStats returns the circuit breaker state and transition counters.
+func (c *Client) BreakerStats() BreakerStats {
+	return c.breaker.Stats()
+}
+
+// Health reports the circuit breaker around the accrual system, the client is
+// degraded while the circuit is not closed.
+func (c *Client) Health() models.ComponentHealth {
+	stats := c.BreakerStats()
+	ch := models.ComponentHealth{
+		Status:   models.HealthOK,
+		Failures: int(stats.ConsecutiveFailures),
+		Breaker: &models.BreakerHealth{
+			State:      stats.State.String(),
+			Opened:     stats.Opened,
+			HalfOpened: stats.HalfOpened,
+			Closed:     stats.Closed,
+		},
+	}
+
+	if stats.State != StateClosed {
+		ch.Status = models.HealthDegraded
+	}
+
+	return ch
+}
+
+// throttle pauses every request of the client for the Retry-After window and
+// adopts the rate the accrual system reports in the body.
+func (c *Client) throttle(resp *resty.Response) time.Duration {
+	retryAfter := parseRetryAfter(resp.Header().Get("Retry-After"))
+
+	if m := rateLimitBody.FindSubmatch(resp.Body()); m != nil {
+		perMinute, err := strconv.ParseUint(string(m[1]), 10, 32)
+
+		if err == nil {
+			c.limiter.SetRate(uint(perMinute))
+		}
+	}
+
+	c.limiter.Pause(retryAfter)
+	logger.Log.Warn("Accrual system throttles requests",
+		zap.Duration("retry_after", retryAfter),
+		zap.Uint("requests_per_minute", c.limiter.State().RequestsPerMinute),
+	)
+
+	return retryAfter
+}
+
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return defaultRetryAfter
+	}
+
+	if seconds, err := strconv.ParseUint(v, 10, 32); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+
+	logger.Log.Warn("Parse Retry-After", zap.String("value", v))
+	return defaultRetryAfter
+}
@@ -4,9 +4,13 @@ import (
 	"context"
 	"net/http"
 	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/Tomap-Tomap/go-loyalty-service/iternal/models"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -19,7 +23,7 @@ func TestClient_GetOrder(t *testing.T) {
 		ts := httptest.NewServer(http.HandlerFunc(handlerBadReques))
 		defer ts.Close()
 
-		c := NewClient(ts.URL)
+		c := NewClient(ts.URL, 0, DefaultBreakerConfig)
 		_, err := c.GetOrder(context.Background(), "error")
 
 		require.Error(t, err)
@@ -34,7 +38,7 @@ func TestClient_GetOrder(t *testing.T) {
 		ts := httptest.NewServer(http.HandlerFunc(handlerTooManyRequests))
 		defer ts.Close()
 
-		c := NewClient(ts.URL)
+		c := NewClient(ts.URL, 0, DefaultBreakerConfig)
 		_, err := c.GetOrder(context.Background(), "error")
 
 		require.Error(t, err)
@@ -48,7 +52,7 @@ func TestClient_GetOrder(t *testing.T) {
 		ts := httptest.NewServer(http.HandlerFunc(handlerErrorBody))
 		defer ts.Close()
 
-		c := NewClient(ts.URL)
+		c := NewClient(ts.URL, 0, DefaultBreakerConfig)
 		_, err := c.GetOrder(context.Background(), "error")
 
 		require.Error(t, err)
@@ -62,7 +66,7 @@ func TestClient_GetOrder(t *testing.T) {
 		}`))
 	}
 
-	accrual := float64(500)
+	accrual := models.Money(50000)
 	order := &models.Order{
 		Number:  "test",
 		Status:  "PROCESSED",
@@ -73,7 +77,7 @@ func TestClient_GetOrder(t *testing.T) {
 		ts := httptest.NewServer(http.HandlerFunc(handlerOK))
 		defer ts.Close()
 
-		c := NewClient(ts.URL)
+		c := NewClient(ts.URL, 0, DefaultBreakerConfig)
 		o, err := c.GetOrder(context.Background(), "test")
 
 		require.NoError(t, err)
@@ -81,9 +85,162 @@ func TestClient_GetOrder(t *testing.T) {
 	})
 
 	t.Run("test brocken server", func(t *testing.T) {
-		c := NewClient("test")
+		c := NewClient("test", 0, DefaultBreakerConfig)
 		_, err := c.GetOrder(context.Background(), "test")
 
 		require.Error(t, err)
 	})
+
+	t.Run("test rate limit from body", func(t *testing.T) {
+		var calls atomic.Int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if calls.Add(1) == 1 {
+				w.Header().Add("Retry-After", "0")
+				w.WriteHeader(http.StatusTooManyRequests)
+				w.Write([]byte("No more than 600 requests per minute allowed"))
+				return
+			}
+
+			handlerOK(w, r)
+		}))
+		defer ts.Close()
+
+		c := NewClient(ts.URL, 0, DefaultBreakerConfig)
+		o, err := c.GetOrder(context.Background(), "test")
+
+		require.NoError(t, err)
+		require.Equal(t, order, o)
+		require.Equal(t, int32(2), calls.Load())
+		require.Equal(t, uint(600), c.ThrottleState().RequestsPerMinute)
+	})
+
+	t.Run("test pause shared by workers", func(t *testing.T) {
+		var calls atomic.Int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if calls.Add(1) == 1 {
+				w.Header().Add("Retry-After", "1")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+
+			handlerOK(w, r)
+		}))
+		defer ts.Close()
+
+		c := NewClient(ts.URL, 0, DefaultBreakerConfig)
+		start := time.Now()
+		_, err := c.GetOrder(context.Background(), "test")
+		require.NoError(t, err)
+		require.True(t, c.ThrottleState().PausedUntil.After(start))
+
+		c.limiter.Pause(time.Second)
+		require.True(t, c.ThrottleState().Throttled(time.Now()))
+
+		var wg sync.WaitGroup
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := c.GetOrder(context.Background(), "test")
+				assert.NoError(t, err)
+			}()
+		}
+
+		time.Sleep(500 * time.Millisecond)
+		require.Equal(t, int32(2), calls.Load())
+
+		wg.Wait()
+		require.Equal(t, int32(5), calls.Load())
+	})
+
+	t.Run("test circuit breaker", func(t *testing.T) {
+		var calls atomic.Int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			http.Error(w, "test error", http.StatusInternalServerError)
+		}))
+		defer ts.Close()
+
+		c := NewClient(ts.URL, 0, BreakerConfig{FailureThreshold: 2, OpenTimeout: time.Hour})
+
+		for i := 0; i < 2; i++ {
+			_, err := c.GetOrder(context.Background(), "test")
+			require.Error(t, err)
+			require.NotErrorIs(t, err, ErrCircuitOpen)
+		}
+
+		require.Equal(t, StateOpen, c.BreakerState())
+
+		_, err := c.GetOrder(context.Background(), "test")
+		require.ErrorIs(t, err, ErrCircuitOpen)
+		require.Equal(t, int32(2), calls.Load())
+		require.Equal(t, uint64(1), c.BreakerStats().Opened)
+
+		ch := c.Health()
+		require.Equal(t, models.HealthDegraded, ch.Status)
+		require.Equal(t, &models.BreakerHealth{State: "open", Opened: 1}, ch.Breaker)
+	})
+
+	t.Run("test typed errors", func(t *testing.T) {
+		tests := []struct {
+			name    string
+			handler http.HandlerFunc
+			want    error
+		}{
+			{"not registered", func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			}, ErrOrderNotRegistered},
+			{"unavailable", func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}, ErrAccrualUnavailable},
+			{"rate limited", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("Retry-After", "0")
+				w.WriteHeader(http.StatusTooManyRequests)
+			}, ErrRateLimited},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				ts := httptest.NewServer(tt.handler)
+				defer ts.Close()
+
+				c := NewClient(ts.URL, 0, DefaultBreakerConfig)
+				_, err := c.GetOrder(context.Background(), "test")
+
+				require.ErrorIs(t, err, tt.want)
+			})
+		}
+
+		c := NewClient("http://127.0.0.1:1", 0, DefaultBreakerConfig)
+		_, err := c.GetOrder(context.Background(), "test")
+		require.ErrorIs(t, err, ErrAccrualUnavailable)
+	})
+
+	t.Run("test retry after in error", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}))
+		defer ts.Close()
+
+		c := NewClient(ts.URL, 0, DefaultBreakerConfig)
+		_, err := c.GetOrder(context.Background(), "test")
+
+		var rle *RateLimitError
+		require.ErrorAs(t, err, &rle)
+		require.Zero(t, rle.RetryAfter)
+	})
+
+	t.Run("test unknown status", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"order": "test", "status": "ON_HOLD", "accrual": 500}`))
+		}))
+		defer ts.Close()
+
+		c := NewClient(ts.URL, 0, DefaultBreakerConfig)
+		o, err := c.GetOrder(context.Background(), "test")
+
+		require.NoError(t, err)
+		require.Equal(t, &models.Order{Number: "test", Status: models.StatusProcessing}, o)
+	})
 }
@@ -0,0 +1,118 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ThrottleState describes how the client is currently limited by the
+// accrual system.
+type ThrottleState struct {
+	RequestsPerMinute uint
+	PausedUntil       time.Time
+}
+
+// Throttled reports whether requests are paused at the moment t.
+func (ts ThrottleState) Throttled(t time.Time) bool {
+	return t.Before(ts.PausedUntil)
+}
+
+// Limiter is a token bucket shared by all requests of the client. Besides
+// the steady rate it can be paused entirely for the Retry-After window.
+type Limiter struct {
+	mu          sync.Mutex
+	perMinute   uint
+	tokens      float64
+	last        time.Time
+	pausedUntil time.Time
+	now         func() time.Time
+}
+
+// NewLimiter creates a limiter allowing perMinute requests per minute, zero
+// means no limit until the accrual system reports one.
+func NewLimiter(perMinute uint) *Limiter {
+	l := &Limiter{now: time.Now}
+	l.SetRate(perMinute)
+
+	return l
+}
+
+// Wait blocks until a request is allowed or ctx is done.
+func (l *Limiter) Wait(ctx context.Context) error {
+	for {
+		wait := l.reserve()
+
+		if wait <= 0 {
+			return nil
+		}
+
+		timer := time.NewTimer(wait)
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+func (l *Limiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+
+	if now.Before(l.pausedUntil) {
+		return l.pausedUntil.Sub(now)
+	}
+
+	if l.perMinute == 0 {
+		return 0
+	}
+
+	rate := float64(l.perMinute) / float64(time.Minute)
+	l.tokens = min(1, l.tokens+float64(now.Sub(l.last))*rate)
+	l.last = now
+
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0
+	}
+
+	return time.Duration((1 - l.tokens) / rate)
+}
+
+// SetRate changes the allowed number of requests per minute.
+func (l *Limiter) SetRate(perMinute uint) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.perMinute == perMinute {
+		return
+	}
+
+	l.perMinute = perMinute
+	l.tokens = 1
+	l.last = l.now()
+}
+
+// Pause stops all requests for d, an earlier pause is never shortened.
+func (l *Limiter) Pause(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if until := l.now().Add(d); until.After(l.pausedUntil) {
+		l.pausedUntil = until
+		l.tokens = 0
+		l.last = until
+	}
+}
+
+func (l *Limiter) State() ThrottleState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return ThrottleState{RequestsPerMinute: l.perMinute, PausedUntil: l.pausedUntil}
+}
@@ -0,0 +1,55 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiter_reserve(t *testing.T) {
+	now := time.Now()
+	l := NewLimiter(60)
+	l.now = func() time.Time { return now }
+	l.SetRate(0)
+	l.SetRate(60)
+
+	require.Zero(t, l.reserve())
+	require.Equal(t, time.Second, l.reserve().Round(time.Millisecond))
+
+	now = now.Add(time.Second)
+	require.Zero(t, l.reserve())
+
+	l.Pause(5 * time.Second)
+	require.Equal(t, 5*time.Second, l.reserve())
+	require.Equal(t, ThrottleState{RequestsPerMinute: 60, PausedUntil: now.Add(5 * time.Second)}, l.State())
+	require.True(t, l.State().Throttled(now))
+
+	l.Pause(time.Second)
+	require.Equal(t, 5*time.Second, l.reserve())
+
+	now = now.Add(5 * time.Second)
+	require.Equal(t, time.Second, l.reserve().Round(time.Millisecond))
+	require.False(t, l.State().Throttled(now))
+}
+
+func TestLimiter_unlimited(t *testing.T) {
+	l := NewLimiter(0)
+
+	for i := 0; i < 100; i++ {
+		require.Zero(t, l.reserve())
+	}
+}
+
+func TestLimiter_Wait(t *testing.T) {
+	l := NewLimiter(0)
+	require.NoError(t, l.Wait(context.Background()))
+
+	l.Pause(time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	require.ErrorIs(t, l.Wait(ctx), context.DeadlineExceeded)
+}
@@ -4,29 +4,39 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
+	"time"
 
 	"github.com/Tomap-Tomap/go-loyalty-service/iternal/compresses"
+	"github.com/Tomap-Tomap/go-loyalty-service/iternal/hasher"
 	"github.com/Tomap-Tomap/go-loyalty-service/iternal/logger"
 	"github.com/Tomap-Tomap/go-loyalty-service/iternal/luhnalg"
 	"github.com/Tomap-Tomap/go-loyalty-service/iternal/models"
 	"github.com/Tomap-Tomap/go-loyalty-service/iternal/storage"
 	"github.com/Tomap-Tomap/go-loyalty-service/iternal/tokenworker"
-	"github.com/jackc/pgerrcode"
-	"github.com/jackc/pgx/v5"
-	"github.com/jackc/pgx/v5/pgconn"
+	"go.uber.org/zap"
 )
 
 type Repository interface {
 	CreateUser(ctx context.Context, u models.User) error
 	GetUser(ctx context.Context, login string) (*models.User, error)
+	UpdatePassword(ctx context.Context, login string, password string) error
 	AddOrder(ctx context.Context, order string, login string) error
-	GetOrders(ctx context.Context, login string) ([]models.Order, error)
+	GetOrders(ctx context.Context, login string, f models.ListFilter) ([]models.Order, error)
 	GetBalance(ctx context.Context, login string) (*models.UserBalance, error)
 	DoWithdrawal(ctx context.Context, login string, ob models.OrderBalance) error
-	GetWithdrawal(ctx context.Context, login string) ([]models.OrderBalance, error)
+	GetWithdrawal(ctx context.Context, login string, f models.ListFilter) ([]models.OrderBalance, error)
+	StartIdempotentRequest(ctx context.Context, login, key, fingerprint string) (*models.IdempotentResponse, error)
+	SaveIdempotentResponse(ctx context.Context, login, key string, resp models.IdempotentResponse) error
+	DeleteIdempotentRequest(ctx context.Context, login, key string) error
 }
 
+// verifyDummyPassword spends on an unknown login the time a password check
+// takes, so the answer does not tell which logins exist.
+var verifyDummyPassword = hasher.VerifyDummy
+
 type Handlers struct {
 	storage Repository
 	tw      tokenworker.TokenWorker
@@ -48,8 +58,7 @@ func (h *Handlers) register(w http.ResponseWriter, r *http.Request) {
 
 	err = h.storage.CreateUser(r.Context(), *u)
 
-	var tError *pgconn.PgError
-	if errors.As(err, &tError) && tError.Code == pgerrcode.UniqueViolation {
+	if errors.Is(err, storage.ErrLoginExist) {
 		http.Error(w, "this login is busy", http.StatusConflict)
 		return
 	}
@@ -59,14 +68,14 @@ func (h *Handlers) register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = h.tw.WriteTokenInCookie(w, u.Login)
+	pair, err := h.tw.IssueTokens(r.Context(), u.Login)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	h.writeTokens(w, pair)
 }
 
 func (h *Handlers) login(w http.ResponseWriter, r *http.Request) {
@@ -81,7 +90,8 @@ func (h *Handlers) login(w http.ResponseWriter, r *http.Request) {
 
 	uDB, err := h.storage.GetUser(r.Context(), u.Login)
 
-	if errors.Is(err, pgx.ErrNoRows) {
+	if errors.Is(err, storage.ErrUserNotFound) {
+		verifyDummyPassword(u.Password)
 		http.Error(w, "invalid login or password", http.StatusUnauthorized)
 		return
 	}
@@ -103,13 +113,154 @@ func (h *Handlers) login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = h.tw.WriteTokenInCookie(w, u.Login)
+	if uDB.NeedsRehash() {
+		if err := h.storage.UpdatePassword(r.Context(), u.Login, u.Password); err != nil {
+			logger.Log.Warn("Rehash password", zap.String("login", u.Login), zap.Error(err))
+		}
+	}
+
+	pair, err := h.tw.IssueTokens(r.Context(), u.Login)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.writeTokens(w, pair)
+}
+
+// writeTokens hands the pair to both kinds of clients: browsers get the
+// cookies, other clients the Authorization header and the JSON body.
+func (h *Handlers) writeTokens(w http.ResponseWriter, pair tokenworker.TokenPair) {
+	resp, err := json.MarshalIndent(pair, "", "    ")
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.tw.WriteTokensInCookie(w, pair)
+	h.tw.WriteTokenHeader(w, pair)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
+
+func (h *Handlers) logout(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+
+	id, ok := tokenworker.IdentityFromContext(r.Context())
+
+	if !ok {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	if err := h.tw.Revoke(r.Context(), id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if refresh, ok := h.refreshToken(r); ok {
+		if err := h.tw.RevokeSession(r.Context(), refresh); err != nil && !errors.Is(err, tokenworker.ErrRefreshDisabled) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	h.tw.ClearTokenCookie(w)
+	w.WriteHeader(http.StatusOK)
+}
+
+// refreshToken returns the refresh token from the cookie or, for the clients
+// that got it in the JSON body, from the refresh_token field of the body.
+func (h *Handlers) refreshToken(r *http.Request) (string, bool) {
+	if refresh, ok := h.tw.RefreshTokenFromRequest(r); ok {
+		return refresh, true
+	}
+
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.RefreshToken == "" {
+		return "", false
+	}
+
+	return body.RefreshToken, true
+}
+
+// tokenRefresh exchanges a refresh token, taken from the cookie or the JSON
+// body, for a new token pair.
+func (h *Handlers) tokenRefresh(w http.ResponseWriter, r *http.Request) {
+	refresh, ok := h.refreshToken(r)
+
+	if !ok {
+		w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+		http.Error(w, "refresh token is required", http.StatusBadRequest)
+		return
+	}
+
+	pair, err := h.tw.RefreshTokens(r.Context(), refresh)
+
+	if errors.Is(err, storage.ErrRefreshTokenReused) {
+		logger.Log.Warn("Refresh token reuse, token family revoked")
+	}
+
+	if errors.Is(err, storage.ErrRefreshTokenInvalid) || errors.Is(err, storage.ErrRefreshTokenReused) {
+		w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+		h.tw.ClearTokenCookie(w)
+		http.Error(w, "invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	if errors.Is(err, tokenworker.ErrRefreshDisabled) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.writeTokens(w, pair)
+}
+
+// jwks publishes the public keys tokens are signed with.
+func (h *Handlers) jwks(w http.ResponseWriter, r *http.Request) {
+	resp, err := json.MarshalIndent(h.tw.JWKS(), "", "    ")
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
+
+// logoutAll revokes every token issued to the user so far, logging them out
+// on all devices.
+func (h *Handlers) logoutAll(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+
+	login, ok := tokenworker.LoginFromContext(r.Context())
+
+	if !ok {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	if err := h.tw.RevokeAll(r.Context(), login, time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.tw.ClearTokenCookie(w)
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -128,7 +279,12 @@ func (h *Handlers) ordersPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	login := r.Header.Get("login")
+	login, ok := tokenworker.LoginFromContext(r.Context())
+
+	if !ok {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
 
 	err = h.storage.AddOrder(r.Context(), id, login)
 
@@ -154,9 +310,21 @@ func (h *Handlers) ordersPost(w http.ResponseWriter, r *http.Request) {
 func (h *Handlers) ordersGet(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Content-Type", "application/json; charset=utf-8")
 
-	login := r.Header.Get("login")
+	login, ok := tokenworker.LoginFromContext(r.Context())
+
+	if !ok {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	f, err := models.NewListFilterByQuery(r.URL.Query(), true)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	orders, err := h.storage.GetOrders(r.Context(), login)
+	orders, err := h.storage.GetOrders(r.Context(), login, pageQuery(f))
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -168,6 +336,12 @@ func (h *Handlers) ordersGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if f.Limit > 0 && len(orders) > f.Limit {
+		orders = orders[:f.Limit]
+		last := orders[len(orders)-1]
+		setNextPage(w, r, f, models.Cursor{Time: *last.UploadedAt, Key: last.Number})
+	}
+
 	resp, err := json.MarshalIndent(orders, "", "    ")
 
 	if err != nil {
@@ -182,7 +356,12 @@ func (h *Handlers) ordersGet(w http.ResponseWriter, r *http.Request) {
 func (h *Handlers) balancesGet(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Content-Type", "application/json; charset=utf-8")
 
-	login := r.Header.Get("login")
+	login, ok := tokenworker.LoginFromContext(r.Context())
+
+	if !ok {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
 
 	orders, err := h.storage.GetBalance(r.Context(), login)
 
@@ -219,7 +398,18 @@ func (h *Handlers) withdrawal(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	login := r.Header.Get("login")
+	if ob.Sum <= 0 {
+		http.Error(w, "sum must be positive", http.StatusUnprocessableEntity)
+		return
+	}
+
+	login, ok := tokenworker.LoginFromContext(r.Context())
+
+	if !ok {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
 	err = h.storage.DoWithdrawal(r.Context(), login, *ob)
 
 	if errors.Is(err, storage.ErrInsufficientFunds) {
@@ -227,6 +417,16 @@ func (h *Handlers) withdrawal(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if errors.Is(err, storage.ErrWithdrawalConflict) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	if errors.Is(err, storage.ErrWithdrawalExist) {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -238,8 +438,21 @@ func (h *Handlers) withdrawal(w http.ResponseWriter, r *http.Request) {
 func (h *Handlers) withdrawalGet(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Content-Type", "application/json; charset=utf-8")
 
-	login := r.Header.Get("login")
-	ob, err := h.storage.GetWithdrawal(r.Context(), login)
+	login, ok := tokenworker.LoginFromContext(r.Context())
+
+	if !ok {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	f, err := models.NewListFilterByQuery(r.URL.Query(), false)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ob, err := h.storage.GetWithdrawal(r.Context(), login, pageQuery(f))
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -251,6 +464,12 @@ func (h *Handlers) withdrawalGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if f.Limit > 0 && len(ob) > f.Limit {
+		ob = ob[:f.Limit]
+		last := ob[len(ob)-1]
+		setNextPage(w, r, f, models.Cursor{Time: *last.ProcessedAt, Key: last.Order})
+	}
+
 	resp, err := json.MarshalIndent(ob, "", "    ")
 
 	if err != nil {
@@ -262,6 +481,23 @@ func (h *Handlers) withdrawalGet(w http.ResponseWriter, r *http.Request) {
 	w.Write(resp)
 }
 
+// pageQuery asks the storage for one extra row to know whether a next page exists.
+func pageQuery(f models.ListFilter) models.ListFilter {
+	if f.Limit > 0 {
+		f.Limit++
+	}
+
+	return f
+}
+
+func setNextPage(w http.ResponseWriter, r *http.Request, f models.ListFilter, c models.Cursor) {
+	f.Cursor = &c
+	next := url.URL{Path: r.URL.Path, RawQuery: f.Query().Encode()}
+
+	w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, next.String()))
+	w.Header().Set("X-Next-Cursor", c.Encode())
+}
+
 type middleware func(http.Handler) http.Handler
 
 func chooseHandler(mm map[string]http.Handler) http.Handler {
@@ -300,12 +536,39 @@ func ServiceMux(h Handlers) *http.ServeMux {
 			compresses.CompressHandle,
 			logger.RequestLogger),
 	)
+	mux.Handle("/.well-known/jwks.json",
+		conveyor(
+			map[string]http.Handler{http.MethodGet: http.HandlerFunc(h.jwks)},
+			compresses.CompressHandle,
+			logger.RequestLogger),
+	)
+	mux.Handle("/api/user/token/refresh",
+		conveyor(
+			map[string]http.Handler{http.MethodPost: http.HandlerFunc(h.tokenRefresh)},
+			compresses.CompressHandle,
+			logger.RequestLogger),
+	)
+	mux.Handle("/api/user/logout",
+		conveyor(
+			map[string]http.Handler{http.MethodPost: http.HandlerFunc(h.logout)},
+			h.tw.RequestToken,
+			compresses.CompressHandle,
+			logger.RequestLogger),
+	)
+	mux.Handle("/api/user/logout/all",
+		conveyor(
+			map[string]http.Handler{http.MethodPost: http.HandlerFunc(h.logoutAll)},
+			h.tw.RequestToken,
+			compresses.CompressHandle,
+			logger.RequestLogger),
+	)
 	mux.Handle("/api/user/orders",
 		conveyor(
 			map[string]http.Handler{
 				http.MethodPost: http.HandlerFunc(h.ordersPost),
 				http.MethodGet:  http.HandlerFunc(h.ordersGet),
 			},
+			h.idempotent,
 			h.tw.RequestToken,
 			compresses.CompressHandle,
 			logger.RequestLogger),
@@ -326,6 +589,7 @@ func ServiceMux(h Handlers) *http.ServeMux {
 			map[string]http.Handler{
 				http.MethodPost: http.HandlerFunc(h.withdrawal),
 			},
+			h.idempotent,
 			h.tw.RequestToken,
 			compresses.CompressHandle,
 			logger.RequestLogger),
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -13,9 +14,6 @@ import (
 	"github.com/Tomap-Tomap/go-loyalty-service/iternal/storage"
 	"github.com/Tomap-Tomap/go-loyalty-service/iternal/tokenworker"
 	"github.com/go-resty/resty/v2"
-	"github.com/jackc/pgerrcode"
-	"github.com/jackc/pgx/v5"
-	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 )
@@ -39,14 +37,20 @@ func (rm *RepositoryMockedObject) GetUser(ctx context.Context, login string) (*m
 	return args.Get(0).(*models.User), args.Error(1)
 }
 
+func (rm *RepositoryMockedObject) UpdatePassword(ctx context.Context, login string, password string) error {
+	args := rm.Called(login, password)
+
+	return args.Error(0)
+}
+
 func (rm *RepositoryMockedObject) AddOrder(ctx context.Context, order string, login string) error {
 	args := rm.Called(order, login)
 
 	return args.Error(0)
 }
 
-func (rm *RepositoryMockedObject) GetOrders(ctx context.Context, login string) ([]models.Order, error) {
-	args := rm.Called(login)
+func (rm *RepositoryMockedObject) GetOrders(ctx context.Context, login string, f models.ListFilter) ([]models.Order, error) {
+	args := rm.Called(login, f)
 
 	if args.Get(0) == nil {
 		return nil, args.Error(1)
@@ -69,8 +73,8 @@ func (rm *RepositoryMockedObject) DoWithdrawal(ctx context.Context, login string
 	return args.Error(0)
 }
 
-func (rm *RepositoryMockedObject) GetWithdrawal(ctx context.Context, login string) ([]models.OrderBalance, error) {
-	args := rm.Called(login)
+func (rm *RepositoryMockedObject) GetWithdrawal(ctx context.Context, login string, f models.ListFilter) ([]models.OrderBalance, error) {
+	args := rm.Called(login, f)
 
 	if args.Get(0) == nil {
 		return nil, args.Error(1)
@@ -78,6 +82,27 @@ func (rm *RepositoryMockedObject) GetWithdrawal(ctx context.Context, login strin
 	return args.Get(0).([]models.OrderBalance), args.Error(1)
 }
 
+func (rm *RepositoryMockedObject) StartIdempotentRequest(ctx context.Context, login, key, fingerprint string) (*models.IdempotentResponse, error) {
+	args := rm.Called(login, key, fingerprint)
+
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*models.IdempotentResponse), args.Error(1)
+}
+
+func (rm *RepositoryMockedObject) SaveIdempotentResponse(ctx context.Context, login, key string, resp models.IdempotentResponse) error {
+	args := rm.Called(login, key, resp)
+
+	return args.Error(0)
+}
+
+func (rm *RepositoryMockedObject) DeleteIdempotentRequest(ctx context.Context, login, key string) error {
+	args := rm.Called(login, key)
+
+	return args.Error(0)
+}
+
 func testRequest(t *testing.T, srv *httptest.Server, method, url string, body string, token string) *resty.Response {
 	req := resty.New().R()
 	req.SetCookie(&http.Cookie{
@@ -98,10 +123,10 @@ func TestHandlers_register(t *testing.T) {
 	uniqErrUsr := models.User{Login: "uniqErr", Password: "uniqErr"}
 	errUsr := models.User{Login: "err", Password: "err"}
 	usr := models.User{Login: "usr", Password: "usr"}
-	rm.On("CreateUser", uniqErrUsr).Return(&pgconn.PgError{Code: pgerrcode.UniqueViolation})
+	rm.On("CreateUser", uniqErrUsr).Return(storage.ErrLoginExist)
 	rm.On("CreateUser", errUsr).Return(fmt.Errorf("test error"))
 	rm.On("CreateUser", usr).Return(nil)
-	h := NewHandlers(rm, *tokenworker.NewToken("secret", 3*time.Hour))
+	h := NewHandlers(rm, *tokenworker.NewToken(tokenworker.NewSecretKeyring("secret"), 3*time.Hour, nil, nil, nil))
 	mux := ServiceMux(h)
 
 	srv := httptest.NewServer(mux)
@@ -136,8 +161,13 @@ func TestHandlers_register(t *testing.T) {
 			"login": "usr",
 			"password": "usr"
 		} `, "")
-		require.Equal(t, "text/plain; charset=utf-8", res.Header().Get("Content-Type"))
+		require.Equal(t, "application/json; charset=utf-8", res.Header().Get("Content-Type"))
 		require.Equal(t, http.StatusOK, res.StatusCode())
+
+		var pair tokenworker.TokenPair
+		require.NoError(t, json.Unmarshal(res.Body(), &pair))
+		require.Equal(t, "Bearer", pair.TokenType)
+		require.Equal(t, "Bearer "+pair.AccessToken, res.Header().Get("Authorization"))
 	})
 
 	rm.AssertExpectations(t)
@@ -147,12 +177,17 @@ func TestHandlers_login(t *testing.T) {
 	sp, err := hasher.NewSaltPassword("pwd")
 	usr := &models.User{Login: "login", Password: sp.Password, Salt: sp.Salt}
 	require.NoError(t, err)
+	hash, err := hasher.Hash("pwd")
+	require.NoError(t, err)
+	modernUsr := &models.User{Login: "modern", Password: hash}
 
 	rm := new(RepositoryMockedObject)
-	rm.On("GetUser", "noRow").Return(nil, pgx.ErrNoRows)
+	rm.On("GetUser", "noRow").Return(nil, storage.ErrUserNotFound)
 	rm.On("GetUser", "internalErr").Return(nil, fmt.Errorf("test error"))
 	rm.On("GetUser", "login").Return(usr, nil)
-	h := NewHandlers(rm, *tokenworker.NewToken("secret", 3*time.Hour))
+	rm.On("GetUser", "modern").Return(modernUsr, nil)
+	rm.On("UpdatePassword", "login", "pwd").Return(nil).Once()
+	h := NewHandlers(rm, *tokenworker.NewToken(tokenworker.NewSecretKeyring("secret"), 3*time.Hour, nil, nil, nil))
 	mux := ServiceMux(h)
 
 	srv := httptest.NewServer(mux)
@@ -165,12 +200,20 @@ func TestHandlers_login(t *testing.T) {
 	})
 
 	t.Run("test 401", func(t *testing.T) {
+		var checked []string
+		defer func(f func(string)) { verifyDummyPassword = f }(verifyDummyPassword)
+		verifyDummyPassword = func(password string) {
+			checked = append(checked, password)
+			hasher.VerifyDummy(password)
+		}
+
 		res := testRequest(t, srv, http.MethodPost, "/api/user/login", `{
 			"login": "noRow",
-			"password": "noRow"
+			"password": "noRowPwd"
 		} `, "")
 		require.Equal(t, "text/plain; charset=utf-8", res.Header().Get("Content-Type"))
 		require.Equal(t, http.StatusUnauthorized, res.StatusCode())
+		require.Equal(t, []string{"noRowPwd"}, checked)
 	})
 
 	t.Run("test 500", func(t *testing.T) {
@@ -196,11 +239,29 @@ func TestHandlers_login(t *testing.T) {
 			"login": "login",
 			"password": "pwd"
 		} `, "")
-		require.Equal(t, "text/plain; charset=utf-8", res.Header().Get("Content-Type"))
+		require.Equal(t, "application/json; charset=utf-8", res.Header().Get("Content-Type"))
+		require.Equal(t, http.StatusOK, res.StatusCode())
+
+		var pair tokenworker.TokenPair
+		require.NoError(t, json.Unmarshal(res.Body(), &pair))
+		require.Equal(t, "Bearer "+pair.AccessToken, res.Header().Get("Authorization"))
+
+		login, ok := h.tw.GetSubFromToken(pair.AccessToken)
+		require.True(t, ok)
+		require.Equal(t, "login", login)
+	})
+
+	t.Run("test OK without rehash", func(t *testing.T) {
+		res := testRequest(t, srv, http.MethodPost, "/api/user/login", `{
+			"login": "modern",
+			"password": "pwd"
+		} `, "")
+		require.Equal(t, "application/json; charset=utf-8", res.Header().Get("Content-Type"))
 		require.Equal(t, http.StatusOK, res.StatusCode())
 	})
 
 	rm.AssertExpectations(t)
+	rm.AssertNotCalled(t, "UpdatePassword", "modern", "pwd")
 }
 
 func TestHandlers_ordersPost(t *testing.T) {
@@ -213,7 +274,7 @@ func TestHandlers_ordersPost(t *testing.T) {
 	rm.On("AddOrder", numberExistCU, "test").Return(storage.ErrIDExistForCurUsr)
 	rm.On("AddOrder", numberErr, "test").Return(fmt.Errorf("test"))
 	rm.On("AddOrder", numberOK, "test").Return(nil)
-	h := NewHandlers(rm, *tokenworker.NewToken("secret", 3*time.Hour))
+	h := NewHandlers(rm, *tokenworker.NewToken(tokenworker.NewSecretKeyring("secret"), 3*time.Hour, nil, nil, nil))
 	tokenString, err := h.tw.GetToken("test")
 	require.NoError(t, err)
 	mux := ServiceMux(h)
@@ -262,11 +323,11 @@ func TestHandlers_ordersPost(t *testing.T) {
 
 func TestHandlers_ordersGet(t *testing.T) {
 	rm := new(RepositoryMockedObject)
-	rm.On("GetOrders", "ISR").Return(nil, fmt.Errorf("test"))
-	rm.On("GetOrders", "NoContent").Return(make([]models.Order, 0), nil)
+	rm.On("GetOrders", "ISR", models.ListFilter{}).Return(nil, fmt.Errorf("test"))
+	rm.On("GetOrders", "NoContent", models.ListFilter{}).Return(make([]models.Order, 0), nil)
 	curTime := time.Now()
-	rm.On("GetOrders", "OK").Return([]models.Order{{Number: "1", Status: "OK", UploadedAt: &curTime}}, nil)
-	h := NewHandlers(rm, *tokenworker.NewToken("secret", 3*time.Hour))
+	rm.On("GetOrders", "OK", models.ListFilter{}).Return([]models.Order{{Number: "1", Status: "OK", UploadedAt: &curTime}}, nil)
+	h := NewHandlers(rm, *tokenworker.NewToken(tokenworker.NewSecretKeyring("secret"), 3*time.Hour, nil, nil, nil))
 	tokenISR, err := h.tw.GetToken("ISR")
 	require.NoError(t, err)
 	tokenNC, err := h.tw.GetToken("NoContent")
@@ -309,9 +370,9 @@ func TestHandlers_ordersGet(t *testing.T) {
 func TestHandlers_balancesGet(t *testing.T) {
 	rm := new(RepositoryMockedObject)
 	rm.On("GetBalance", "ISR").Return(nil, fmt.Errorf("test"))
-	wd := float64(-500)
-	rm.On("GetBalance", "OK").Return(&models.UserBalance{Current: 500, Withdrawn: &wd}, nil)
-	h := NewHandlers(rm, *tokenworker.NewToken("secret", 3*time.Hour))
+	wd := models.Money(-50000)
+	rm.On("GetBalance", "OK").Return(&models.UserBalance{Current: 50000, Withdrawn: &wd}, nil)
+	h := NewHandlers(rm, *tokenworker.NewToken(tokenworker.NewSecretKeyring("secret"), 3*time.Hour, nil, nil, nil))
 	tokenISR, err := h.tw.GetToken("ISR")
 	require.NoError(t, err)
 	tokenOK, err := h.tw.GetToken("OK")
@@ -344,11 +405,13 @@ func TestHandlers_balancesGet(t *testing.T) {
 
 func TestHandlers_withdrawal(t *testing.T) {
 	rm := new(RepositoryMockedObject)
-	rm.On("DoWithdrawal", "test", models.OrderBalance{Order: "2377225624", Sum: 123}).Return(storage.ErrInsufficientFunds)
-	rm.On("DoWithdrawal", "test", models.OrderBalance{Order: "2377225624", Sum: 0}).Return(fmt.Errorf("test"))
-	rm.On("DoWithdrawal", "test", models.OrderBalance{Order: "2377225624", Sum: 100}).Return(nil)
+	rm.On("DoWithdrawal", "test", models.OrderBalance{Order: "2377225624", Sum: 12300}).Return(storage.ErrInsufficientFunds)
+	rm.On("DoWithdrawal", "test", models.OrderBalance{Order: "2377225624", Sum: 40000}).Return(fmt.Errorf("test"))
+	rm.On("DoWithdrawal", "test", models.OrderBalance{Order: "2377225624", Sum: 10000}).Return(nil)
+	rm.On("DoWithdrawal", "test", models.OrderBalance{Order: "2377225624", Sum: 20000}).Return(storage.ErrWithdrawalConflict)
+	rm.On("DoWithdrawal", "test", models.OrderBalance{Order: "2377225624", Sum: 30000}).Return(storage.ErrWithdrawalExist)
 
-	h := NewHandlers(rm, *tokenworker.NewToken("secret", 3*time.Hour))
+	h := NewHandlers(rm, *tokenworker.NewToken(tokenworker.NewSecretKeyring("secret"), 3*time.Hour, nil, nil, nil))
 	tokenString, err := h.tw.GetToken("test")
 	require.NoError(t, err)
 	mux := ServiceMux(h)
@@ -369,27 +432,47 @@ func TestHandlers_withdrawal(t *testing.T) {
 	})
 
 	t.Run("test 500", func(t *testing.T) {
-		res := testRequest(t, srv, http.MethodPost, "/api/user/balance/withdraw", `{"order":"2377225624", "sum": 0}`, tokenString)
+		res := testRequest(t, srv, http.MethodPost, "/api/user/balance/withdraw", `{"order":"2377225624", "sum": 400}`, tokenString)
 		require.Equal(t, "text/plain; charset=utf-8", res.Header().Get("Content-Type"))
 		require.Equal(t, http.StatusInternalServerError, res.StatusCode())
 	})
 
+	t.Run("test 422 not positive sum", func(t *testing.T) {
+		for _, sum := range []string{"0", "-100"} {
+			res := testRequest(t, srv, http.MethodPost, "/api/user/balance/withdraw", `{"order":"2377225624", "sum": `+sum+`}`, tokenString)
+			require.Equal(t, "text/plain; charset=utf-8", res.Header().Get("Content-Type"))
+			require.Equal(t, http.StatusUnprocessableEntity, res.StatusCode())
+		}
+	})
+
 	t.Run("test 200", func(t *testing.T) {
 		res := testRequest(t, srv, http.MethodPost, "/api/user/balance/withdraw", `{"order":"2377225624", "sum": 100}`, tokenString)
 		require.Equal(t, "text/plain; charset=utf-8", res.Header().Get("Content-Type"))
 		require.Equal(t, http.StatusOK, res.StatusCode())
 	})
 
+	t.Run("test 409", func(t *testing.T) {
+		res := testRequest(t, srv, http.MethodPost, "/api/user/balance/withdraw", `{"order":"2377225624", "sum": 200}`, tokenString)
+		require.Equal(t, "text/plain; charset=utf-8", res.Header().Get("Content-Type"))
+		require.Equal(t, http.StatusConflict, res.StatusCode())
+	})
+
+	t.Run("test 200 replay", func(t *testing.T) {
+		res := testRequest(t, srv, http.MethodPost, "/api/user/balance/withdraw", `{"order":"2377225624", "sum": 300}`, tokenString)
+		require.Equal(t, "text/plain; charset=utf-8", res.Header().Get("Content-Type"))
+		require.Equal(t, http.StatusOK, res.StatusCode())
+	})
+
 	rm.AssertExpectations(t)
 }
 
 func TestHandlers_withdrawalGet(t *testing.T) {
 	rm := new(RepositoryMockedObject)
-	rm.On("GetWithdrawal", "ISR").Return(nil, fmt.Errorf("test"))
-	rm.On("GetWithdrawal", "NoContent").Return(make([]models.OrderBalance, 0), nil)
+	rm.On("GetWithdrawal", "ISR", models.ListFilter{}).Return(nil, fmt.Errorf("test"))
+	rm.On("GetWithdrawal", "NoContent", models.ListFilter{}).Return(make([]models.OrderBalance, 0), nil)
 	curTime := time.Now()
-	rm.On("GetWithdrawal", "OK").Return([]models.OrderBalance{{Order: "123", Sum: 500, ProcessedAt: &curTime}}, nil)
-	h := NewHandlers(rm, *tokenworker.NewToken("secret", 3*time.Hour))
+	rm.On("GetWithdrawal", "OK", models.ListFilter{}).Return([]models.OrderBalance{{Order: "123", Sum: 50000, ProcessedAt: &curTime}}, nil)
+	h := NewHandlers(rm, *tokenworker.NewToken(tokenworker.NewSecretKeyring("secret"), 3*time.Hour, nil, nil, nil))
 	tokenISR, err := h.tw.GetToken("ISR")
 	require.NoError(t, err)
 	tokenNC, err := h.tw.GetToken("NoContent")
@@ -428,3 +511,275 @@ func TestHandlers_withdrawalGet(t *testing.T) {
 
 	rm.AssertExpectations(t)
 }
+
+func TestHandlers_spoofedLoginHeader(t *testing.T) {
+	numberOK := "2377225624"
+	rm := new(RepositoryMockedObject)
+	rm.On("AddOrder", numberOK, "owner").Return(nil)
+	rm.On("GetBalance", "owner").Return(&models.UserBalance{Current: 100}, nil)
+	h := NewHandlers(rm, *tokenworker.NewToken(tokenworker.NewSecretKeyring("secret"), 3*time.Hour, nil, nil, nil))
+	tokenString, err := h.tw.GetToken("owner")
+	require.NoError(t, err)
+	mux := ServiceMux(h)
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	spoofedRequest := func(method, url, body, token string) *resty.Response {
+		req := resty.New().R()
+		req.SetCookie(&http.Cookie{Name: "token", Value: token})
+		req.SetHeader("login", "victim")
+		req.Method = method
+		req.URL = srv.URL + url
+		req.SetBody(body)
+		res, err := req.Send()
+		require.NoError(t, err)
+
+		return res
+	}
+
+	t.Run("header ignored for authenticated user", func(t *testing.T) {
+		res := spoofedRequest(http.MethodPost, "/api/user/orders", numberOK, tokenString)
+		require.Equal(t, http.StatusAccepted, res.StatusCode())
+
+		res = spoofedRequest(http.MethodGet, "/api/user/balance", "", tokenString)
+		require.Equal(t, http.StatusOK, res.StatusCode())
+	})
+
+	t.Run("header without token", func(t *testing.T) {
+		res := spoofedRequest(http.MethodGet, "/api/user/balance", "", "")
+		require.Equal(t, http.StatusUnauthorized, res.StatusCode())
+	})
+
+	rm.AssertExpectations(t)
+	rm.AssertNotCalled(t, "AddOrder", numberOK, "victim")
+	rm.AssertNotCalled(t, "GetBalance", "victim")
+}
+
+func TestHandlers_bearerToken(t *testing.T) {
+	rm := new(RepositoryMockedObject)
+	rm.On("GetBalance", "owner").Return(&models.UserBalance{Current: 100}, nil)
+	h := NewHandlers(rm, *tokenworker.NewToken(tokenworker.NewSecretKeyring("secret"), 3*time.Hour, nil, nil, nil))
+	tokenString, err := h.tw.GetToken("owner")
+	require.NoError(t, err)
+	mux := ServiceMux(h)
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	t.Run("authorization header", func(t *testing.T) {
+		res, err := resty.New().R().SetAuthToken(tokenString).Get(srv.URL + "/api/user/balance")
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode())
+	})
+
+	t.Run("invalid token", func(t *testing.T) {
+		res, err := resty.New().R().SetAuthToken(tokenString + "1").Get(srv.URL + "/api/user/balance")
+		require.NoError(t, err)
+		require.Equal(t, http.StatusUnauthorized, res.StatusCode())
+		require.Equal(t, `Bearer realm="gophermart", error="invalid_token", error_description="invalid token"`,
+			res.Header().Get("WWW-Authenticate"))
+	})
+
+	t.Run("no token", func(t *testing.T) {
+		res, err := resty.New().R().Get(srv.URL + "/api/user/balance")
+		require.NoError(t, err)
+		require.Equal(t, http.StatusUnauthorized, res.StatusCode())
+		require.Equal(t, `Bearer realm="gophermart"`, res.Header().Get("WWW-Authenticate"))
+	})
+
+	rm.AssertExpectations(t)
+}
+
+func TestHandlers_ordersGetPagination(t *testing.T) {
+	rm := new(RepositoryMockedObject)
+	firstTime := time.Now().Add(-time.Minute)
+	secondTime := time.Now()
+	rm.On("GetOrders", "OK", models.ListFilter{Limit: 2, Statuses: []string{models.StatusNew}}).Return([]models.Order{
+		{Number: "1", Status: models.StatusNew, UploadedAt: &firstTime},
+		{Number: "2", Status: models.StatusNew, UploadedAt: &secondTime},
+	}, nil)
+	h := NewHandlers(rm, *tokenworker.NewToken(tokenworker.NewSecretKeyring("secret"), 3*time.Hour, nil, nil, nil))
+	tokenOK, err := h.tw.GetToken("OK")
+	require.NoError(t, err)
+	mux := ServiceMux(h)
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	t.Run("test 400", func(t *testing.T) {
+		for _, q := range []string{"limit=0", "limit=abc", "cursor=abc", "status=UNKNOWN", "from=yesterday", "sort=up"} {
+			res := testRequest(t, srv, http.MethodGet, "/api/user/orders?"+q, "", tokenOK)
+			require.Equal(t, http.StatusBadRequest, res.StatusCode(), q)
+		}
+	})
+
+	t.Run("test next page", func(t *testing.T) {
+		res := testRequest(t, srv, http.MethodGet, "/api/user/orders?limit=1&status=new", "", tokenOK)
+		require.Equal(t, http.StatusOK, res.StatusCode())
+
+		exJSON := fmt.Sprintf(`[{
+			"number":"1",
+			"status":"NEW",
+			"uploaded_at": "%s"
+		}]`, firstTime.Format(time.RFC3339))
+		require.JSONEq(t, exJSON, string(res.Body()))
+
+		cursor := res.Header().Get("X-Next-Cursor")
+		c, err := models.DecodeCursor(cursor)
+		require.NoError(t, err)
+		require.Equal(t, "1", c.Key)
+		require.True(t, firstTime.Equal(c.Time))
+		require.Contains(t, res.Header().Get("Link"), "cursor="+cursor)
+		require.Contains(t, res.Header().Get("Link"), `rel="next"`)
+	})
+
+	t.Run("test status on withdrawals", func(t *testing.T) {
+		res := testRequest(t, srv, http.MethodGet, "/api/user/withdrawals?status=NEW", "", tokenOK)
+		require.Equal(t, http.StatusBadRequest, res.StatusCode())
+	})
+
+	rm.AssertExpectations(t)
+}
+
+func TestHandlers_logout(t *testing.T) {
+	ms := storage.NewMemoryStorage()
+	require.NoError(t, ms.CreateUser(context.Background(), models.User{Login: "test", Password: "test"}))
+	tw := tokenworker.NewToken(tokenworker.NewSecretKeyring("secret"), 3*time.Hour, tokenworker.NewRevocations(ms, time.Hour), nil, nil)
+	h := NewHandlers(ms, *tw)
+	mux := ServiceMux(h)
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	send := func(method, url, token string) *resty.Response {
+		req := resty.New().R()
+		req.SetCookie(&http.Cookie{Name: "token", Value: token})
+		req.Method = method
+		req.URL = srv.URL + url
+		res, err := req.Send()
+		require.NoError(t, err)
+
+		return res
+	}
+
+	first, err := tw.GetToken("test")
+	require.NoError(t, err)
+	second, err := tw.GetToken("test")
+	require.NoError(t, err)
+
+	t.Run("logout", func(t *testing.T) {
+		res := send(http.MethodPost, "/api/user/logout", first)
+		require.Equal(t, http.StatusOK, res.StatusCode())
+
+		var cleared bool
+		for _, c := range res.Cookies() {
+			cleared = cleared || (c.Name == "token" && c.MaxAge < 0)
+		}
+		require.True(t, cleared)
+
+		require.Equal(t, http.StatusUnauthorized, send(http.MethodGet, "/api/user/balance", first).StatusCode())
+		require.Equal(t, http.StatusOK, send(http.MethodGet, "/api/user/balance", second).StatusCode())
+	})
+
+	t.Run("logout everywhere", func(t *testing.T) {
+		res := send(http.MethodPost, "/api/user/logout/all", second)
+		require.Equal(t, http.StatusOK, res.StatusCode())
+
+		require.Equal(t, http.StatusUnauthorized, send(http.MethodGet, "/api/user/balance", second).StatusCode())
+		require.Equal(t, http.StatusUnauthorized, send(http.MethodPost, "/api/user/logout", second).StatusCode())
+
+		// The next login usually falls within the same second.
+		relogin, err := tw.GetToken("test")
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, send(http.MethodGet, "/api/user/balance", relogin).StatusCode())
+	})
+}
+
+func TestHandlers_tokenRefresh(t *testing.T) {
+	ctx := context.Background()
+	ms := storage.NewMemoryStorage()
+	require.NoError(t, ms.CreateUser(ctx, models.User{Login: "test", Password: "test"}))
+	tw := tokenworker.NewToken(tokenworker.NewSecretKeyring("secret"), time.Minute, tokenworker.NewRevocations(ms, time.Hour),
+		tokenworker.NewSessions(ms, time.Hour), nil)
+	h := NewHandlers(ms, *tw)
+
+	srv := httptest.NewServer(ServiceMux(h))
+	defer srv.Close()
+
+	pair, err := tw.IssueTokens(ctx, "test")
+	require.NoError(t, err)
+
+	refresh := func(req *resty.Request) (*resty.Response, tokenworker.TokenPair) {
+		var got tokenworker.TokenPair
+		res, err := req.SetResult(&got).Post(srv.URL + "/api/user/token/refresh")
+		require.NoError(t, err)
+
+		return res, got
+	}
+
+	t.Run("cookie", func(t *testing.T) {
+		res, got := refresh(resty.New().R().SetCookie(&http.Cookie{Name: "refresh_token", Value: pair.RefreshToken}))
+		require.Equal(t, http.StatusOK, res.StatusCode())
+		require.Equal(t, "Bearer", got.TokenType)
+		require.NotEqual(t, pair.RefreshToken, got.RefreshToken)
+
+		login, ok := tw.GetSubFromToken(got.AccessToken)
+		require.True(t, ok)
+		require.Equal(t, "test", login)
+
+		var cookies []string
+		for _, c := range res.Cookies() {
+			cookies = append(cookies, c.Name)
+		}
+		require.ElementsMatch(t, []string{"token", "refresh_token"}, cookies)
+
+		pair = got
+	})
+
+	t.Run("body", func(t *testing.T) {
+		res, got := refresh(resty.New().R().SetBody(fmt.Sprintf(`{"refresh_token":%q}`, pair.RefreshToken)))
+		require.Equal(t, http.StatusOK, res.StatusCode())
+		require.NotEmpty(t, got.AccessToken)
+	})
+
+	t.Run("reuse", func(t *testing.T) {
+		res, _ := refresh(resty.New().R().SetBody(fmt.Sprintf(`{"refresh_token":%q}`, pair.RefreshToken)))
+		require.Equal(t, http.StatusUnauthorized, res.StatusCode())
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		res, _ := refresh(resty.New().R())
+		require.Equal(t, http.StatusBadRequest, res.StatusCode())
+	})
+
+	t.Run("logout with body", func(t *testing.T) {
+		pair, err := tw.IssueTokens(ctx, "test")
+		require.NoError(t, err)
+
+		res, err := resty.New().R().
+			SetAuthToken(pair.AccessToken).
+			SetBody(fmt.Sprintf(`{"refresh_token":%q}`, pair.RefreshToken)).
+			Post(srv.URL + "/api/user/logout")
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode())
+
+		res, _ = refresh(resty.New().R().SetBody(fmt.Sprintf(`{"refresh_token":%q}`, pair.RefreshToken)))
+		require.Equal(t, http.StatusUnauthorized, res.StatusCode())
+	})
+}
+
+func TestHandlers_jwks(t *testing.T) {
+	h := NewHandlers(new(RepositoryMockedObject), *tokenworker.NewToken(tokenworker.NewSecretKeyring("secret"), time.Hour, nil, nil, nil))
+
+	srv := httptest.NewServer(ServiceMux(h))
+	defer srv.Close()
+
+	var got tokenworker.JWKS
+	res, err := resty.New().R().SetResult(&got).Get(srv.URL + "/.well-known/jwks.json")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode())
+	require.Equal(t, "public, max-age=300", res.Header().Get("Cache-Control"))
+	require.NotNil(t, got.Keys)
+	require.Empty(t, got.Keys, "hmac secrets are never published")
+}
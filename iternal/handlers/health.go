@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/Tomap-Tomap/go-loyalty-service/iternal/logger"
+	"github.com/Tomap-Tomap/go-loyalty-service/iternal/models"
+)
+
+type HealthReporter interface {
+	Health() models.ComponentHealth
+}
+
+type healthResponse struct {
+	Status     string                            `json:"status"`
+	Components map[string]models.ComponentHealth `json:"components"`
+}
+
+// HandleHealth registers the health endpoint reporting the state of the
+// background components. The API keeps serving while a component is degraded,
+// so the endpoint answers 200 and tells the states apart by the status field.
+func HandleHealth(mux *http.ServeMux, components map[string]HealthReporter) {
+	logFn := func(w http.ResponseWriter, r *http.Request) {
+		hr := healthResponse{Status: models.HealthOK, Components: make(map[string]models.ComponentHealth, len(components))}
+
+		for name, c := range components {
+			ch := c.Health()
+
+			if ch.Status != models.HealthOK {
+				hr.Status = models.HealthDegraded
+			}
+
+			hr.Components[name] = ch
+		}
+
+		resp, err := json.MarshalIndent(hr, "", "    ")
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write(resp)
+	}
+
+	mux.Handle("/api/health",
+		conveyor(
+			map[string]http.Handler{http.MethodGet: http.HandlerFunc(logFn)},
+			logger.RequestLogger),
+	)
+}
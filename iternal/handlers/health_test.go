@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Tomap-Tomap/go-loyalty-service/iternal/models"
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/require"
+)
+
+type staticHealth models.ComponentHealth
+
+func (sh staticHealth) Health() models.ComponentHealth {
+	return models.ComponentHealth(sh)
+}
+
+func TestHandleHealth(t *testing.T) {
+	tests := []struct {
+		name   string
+		agent  staticHealth
+		status string
+	}{
+		{name: "ok", agent: staticHealth{Status: models.HealthOK}, status: models.HealthOK},
+		{name: "degraded", agent: staticHealth{Status: models.HealthDegraded, Failures: 2, LastError: "test error"}, status: models.HealthDegraded},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			HandleHealth(mux, map[string]HealthReporter{"agent": tt.agent})
+
+			srv := httptest.NewServer(mux)
+			defer srv.Close()
+
+			res, err := resty.New().R().Get(srv.URL + "/api/health")
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, res.StatusCode())
+
+			var hr healthResponse
+			require.NoError(t, json.Unmarshal(res.Body(), &hr))
+			require.Equal(t, tt.status, hr.Status)
+			require.Equal(t, models.ComponentHealth(tt.agent), hr.Components["agent"])
+
+			res, err = resty.New().R().Post(srv.URL + "/api/health")
+			require.NoError(t, err)
+			require.Equal(t, http.StatusMethodNotAllowed, res.StatusCode())
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/Tomap-Tomap/go-loyalty-service/iternal/logger"
+	"github.com/Tomap-Tomap/go-loyalty-service/iternal/models"
+	"github.com/Tomap-Tomap/go-loyalty-service/iternal/storage"
+	"github.com/Tomap-Tomap/go-loyalty-service/iternal/tokenworker"
+	"go.uber.org/zap"
+)
+
+const maxIdempotencyKeyLen = 255
+
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	code int
+	body bytes.Buffer
+}
+
+func (r *recordingResponseWriter) Write(b []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *recordingResponseWriter) WriteHeader(statusCode int) {
+	if r.code == 0 {
+		r.code = statusCode
+	}
+
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+// idempotent replays the stored response of a mutating request repeated with
+// the same Idempotency-Key header by the same user.
+func (h *Handlers) idempotent(next http.Handler) http.Handler {
+	logFn := func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+
+		if key == "" || r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(key) > maxIdempotencyKeyLen {
+			http.Error(w, "idempotency key is too long", http.StatusBadRequest)
+			return
+		}
+
+		login, ok := tokenworker.LoginFromContext(r.Context())
+
+		if !ok {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		var buf bytes.Buffer
+		if _, err := buf.ReadFrom(r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		r.Body = io.NopCloser(&buf)
+
+		hash := sha256.New()
+		hash.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+		hash.Write(buf.Bytes())
+		fingerprint := hex.EncodeToString(hash.Sum(nil))
+
+		stored, err := h.storage.StartIdempotentRequest(r.Context(), login, key, fingerprint)
+
+		if errors.Is(err, storage.ErrIdempotencyInProgress) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		if errors.Is(err, storage.ErrIdempotencyMismatch) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if stored != nil {
+			if stored.ContentType != "" {
+				w.Header().Set("Content-Type", stored.ContentType)
+			}
+
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(stored.StatusCode)
+			w.Write(stored.Body)
+			return
+		}
+
+		rw := &recordingResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(rw, r)
+
+		if rw.code == 0 {
+			rw.code = http.StatusOK
+		}
+
+		ctx := context.WithoutCancel(r.Context())
+
+		if rw.code >= http.StatusInternalServerError {
+			if err := h.storage.DeleteIdempotentRequest(ctx, login, key); err != nil {
+				logger.Log.Warn("Delete idempotency key", zap.String("key", key), zap.Error(err))
+			}
+
+			return
+		}
+
+		resp := models.IdempotentResponse{
+			StatusCode:  rw.code,
+			ContentType: rw.Header().Get("Content-Type"),
+			Body:        rw.body.Bytes(),
+		}
+
+		if err := h.storage.SaveIdempotentResponse(ctx, login, key, resp); err != nil {
+			logger.Log.Warn("Save idempotent response", zap.String("key", key), zap.Error(err))
+		}
+	}
+
+	return http.HandlerFunc(logFn)
+}
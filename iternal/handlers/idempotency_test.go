@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Tomap-Tomap/go-loyalty-service/iternal/models"
+	"github.com/Tomap-Tomap/go-loyalty-service/iternal/storage"
+	"github.com/Tomap-Tomap/go-loyalty-service/iternal/tokenworker"
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandlers_idempotent(t *testing.T) {
+	ms := storage.NewMemoryStorage()
+	require.NoError(t, ms.CreateUser(context.Background(), models.User{Login: "test", Password: "test"}))
+	h := NewHandlers(ms, *tokenworker.NewToken(tokenworker.NewSecretKeyring("secret"), 3*time.Hour, nil, nil, nil))
+	tokenString, err := h.tw.GetToken("test")
+	require.NoError(t, err)
+	mux := ServiceMux(h)
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	idempotentRequest := func(url, body, key string) *resty.Response {
+		req := resty.New().R()
+		req.SetCookie(&http.Cookie{Name: "token", Value: tokenString})
+		req.SetHeader("Idempotency-Key", key)
+		req.Method = http.MethodPost
+		req.URL = srv.URL + url
+		req.SetBody(body)
+		res, err := req.Send()
+		require.NoError(t, err)
+
+		return res
+	}
+
+	t.Run("test replay", func(t *testing.T) {
+		res := idempotentRequest("/api/user/orders", "2377225624", "first")
+		require.Equal(t, http.StatusAccepted, res.StatusCode())
+		require.Empty(t, res.Header().Get("Idempotent-Replayed"))
+
+		res = idempotentRequest("/api/user/orders", "2377225624", "first")
+		require.Equal(t, http.StatusAccepted, res.StatusCode())
+		require.Equal(t, "true", res.Header().Get("Idempotent-Replayed"))
+		require.Equal(t, "text/plain; charset=utf-8", res.Header().Get("Content-Type"))
+	})
+
+	t.Run("test another key", func(t *testing.T) {
+		res := idempotentRequest("/api/user/orders", "2377225624", "second")
+		require.Equal(t, http.StatusOK, res.StatusCode())
+		require.Empty(t, res.Header().Get("Idempotent-Replayed"))
+	})
+
+	t.Run("test 422 on another body", func(t *testing.T) {
+		res := idempotentRequest("/api/user/orders", "12345678903", "first")
+		require.Equal(t, http.StatusUnprocessableEntity, res.StatusCode())
+	})
+
+	t.Run("test replay of error response", func(t *testing.T) {
+		body := `{"order":"2377225624", "sum": 100}`
+		res := idempotentRequest("/api/user/balance/withdraw", body, "third")
+		require.Equal(t, http.StatusPaymentRequired, res.StatusCode())
+
+		res = idempotentRequest("/api/user/balance/withdraw", body, "third")
+		require.Equal(t, http.StatusPaymentRequired, res.StatusCode())
+		require.Equal(t, "true", res.Header().Get("Idempotent-Replayed"))
+	})
+
+	t.Run("test too long key", func(t *testing.T) {
+		key := make([]byte, maxIdempotencyKeyLen+1)
+		for i := range key {
+			key[i] = 'a'
+		}
+
+		res := idempotentRequest("/api/user/orders", "2377225624", string(key))
+		require.Equal(t, http.StatusBadRequest, res.StatusCode())
+	})
+}
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Tomap-Tomap/go-loyalty-service/iternal/logger"
+	"github.com/Tomap-Tomap/go-loyalty-service/iternal/models"
+	"go.uber.org/zap"
+)
+
+const (
+	webhookTimestampHeader = "X-Accrual-Timestamp"
+	webhookSignatureHeader = "X-Accrual-Signature"
+	webhookSignaturePrefix = "sha256="
+	maxWebhookBody         = 1 << 20
+)
+
+type OrderUpdater interface {
+	UpdateOrder(ctx context.Context, o models.Order) error
+}
+
+// SignWebhook returns the signature of the webhook body sent at timestamp:
+// the hex encoded HMAC-SHA256 of "<timestamp>.<body>" with the sha256= prefix.
+func SignWebhook(secret []byte, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+
+	return webhookSignaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// HandleAccrualWebhook registers the endpoint the accrual system pushes order
+// updates to. Requests are signed with the shared secret, see SignWebhook, and
+// rejected once their timestamp is more than tolerance away from now, so a
+// captured request cannot be replayed later. The update goes through
+// UpdateOrder and follows the same transition rules as the polled ones:
+// statuses only move forward, so a request replayed within the tolerance
+// cannot take an order back.
+func HandleAccrualWebhook(mux *http.ServeMux, s OrderUpdater, secret []byte, tolerance time.Duration) {
+	logFn := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBody))
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ts, err := strconv.ParseInt(r.Header.Get(webhookTimestampHeader), 10, 64)
+
+		if err != nil {
+			http.Error(w, "invalid timestamp", http.StatusUnauthorized)
+			return
+		}
+
+		if d := time.Since(time.Unix(ts, 0)); d > tolerance || d < -tolerance {
+			http.Error(w, "timestamp is out of tolerance", http.StatusUnauthorized)
+			return
+		}
+
+		signature := r.Header.Get(webhookSignatureHeader)
+
+		if !strings.HasPrefix(signature, webhookSignaturePrefix) ||
+			!hmac.Equal([]byte(signature), []byte(SignWebhook(secret, ts, body))) {
+			http.Error(w, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+
+		var o models.Order
+		if err := json.Unmarshal(body, &o); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		switch o.Status {
+		case models.StatusNew, models.StatusProcessing, models.StatusInvalid, models.StatusProcessed:
+		default:
+			http.Error(w, "unknown status", http.StatusBadRequest)
+			return
+		}
+
+		if o.Number == "" || (o.Accrual != nil && *o.Accrual < 0) {
+			http.Error(w, "invalid order", http.StatusBadRequest)
+			return
+		}
+
+		if err := s.UpdateOrder(r.Context(), o); err != nil {
+			logger.Log.Warn("Update order from webhook", zap.String("order", o.Number), zap.Error(err))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+
+	mux.Handle("/api/internal/accruals",
+		conveyor(
+			map[string]http.Handler{http.MethodPost: http.HandlerFunc(logFn)},
+			logger.RequestLogger),
+	)
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Tomap-Tomap/go-loyalty-service/iternal/models"
+	"github.com/Tomap-Tomap/go-loyalty-service/iternal/storage"
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleAccrualWebhook(t *testing.T) {
+	ctx := context.Background()
+	secret := []byte("webhook secret")
+
+	ms := storage.NewMemoryStorage()
+	require.NoError(t, ms.CreateUser(ctx, models.User{Login: "test", Password: "test"}))
+	require.NoError(t, ms.AddOrder(ctx, "12345678903", "test"))
+
+	mux := http.NewServeMux()
+	HandleAccrualWebhook(mux, ms, secret, time.Minute)
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	send := func(body string, ts int64, signature string) int {
+		req := resty.New().R()
+		req.SetHeader(webhookTimestampHeader, strconv.FormatInt(ts, 10))
+		req.SetHeader(webhookSignatureHeader, signature)
+		req.SetBody(body)
+		res, err := req.Post(srv.URL + "/api/internal/accruals")
+		require.NoError(t, err)
+
+		return res.StatusCode()
+	}
+
+	processed := `{"order":"12345678903","status":"PROCESSED","accrual":500}`
+
+	tests := []struct {
+		name      string
+		body      string
+		ts        int64
+		signature func(ts int64, body string) string
+		want      int
+	}{
+		{
+			name:      "missing signature",
+			body:      processed,
+			ts:        time.Now().Unix(),
+			signature: func(int64, string) string { return "" },
+			want:      http.StatusUnauthorized,
+		},
+		{
+			name: "wrong secret",
+			body: processed,
+			ts:   time.Now().Unix(),
+			signature: func(ts int64, body string) string {
+				return SignWebhook([]byte("other"), ts, []byte(body))
+			},
+			want: http.StatusUnauthorized,
+		},
+		{
+			name: "stale timestamp",
+			body: processed,
+			ts:   time.Now().Add(-time.Hour).Unix(),
+			signature: func(ts int64, body string) string {
+				return SignWebhook(secret, ts, []byte(body))
+			},
+			want: http.StatusUnauthorized,
+		},
+		{
+			name: "unknown status",
+			body: `{"order":"12345678903","status":"UNKNOWN"}`,
+			ts:   time.Now().Unix(),
+			signature: func(ts int64, body string) string {
+				return SignWebhook(secret, ts, []byte(body))
+			},
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "processed",
+			body: processed,
+			ts:   time.Now().Unix(),
+			signature: func(ts int64, body string) string {
+				return SignWebhook(secret, ts, []byte(body))
+			},
+			want: http.StatusOK,
+		},
+		{
+			name: "repeated after final status",
+			body: `{"order":"12345678903","status":"PROCESSING"}`,
+			ts:   time.Now().Unix(),
+			signature: func(ts int64, body string) string {
+				return SignWebhook(secret, ts, []byte(body))
+			},
+			want: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, send(tt.body, tt.ts, tt.signature(tt.ts, tt.body)))
+		})
+	}
+
+	orders, err := ms.GetOrders(ctx, "test", models.ListFilter{})
+	require.NoError(t, err)
+	require.Len(t, orders, 1)
+	require.Equal(t, models.StatusProcessed, orders[0].Status)
+
+	b, err := ms.GetBalance(ctx, "test")
+	require.NoError(t, err)
+	require.Equal(t, models.Money(50000), b.Current)
+}
+
+func TestHandleAccrualWebhook_replay(t *testing.T) {
+	ctx := context.Background()
+	secret := []byte("webhook secret")
+
+	ms := storage.NewMemoryStorage()
+	require.NoError(t, ms.CreateUser(ctx, models.User{Login: "test", Password: "test"}))
+	require.NoError(t, ms.AddOrder(ctx, "12345678903", "test"))
+
+	mux := http.NewServeMux()
+	HandleAccrualWebhook(mux, ms, secret, time.Minute)
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	send := func(body string, ts int64) {
+		req := resty.New().R()
+		req.SetHeader(webhookTimestampHeader, strconv.FormatInt(ts, 10))
+		req.SetHeader(webhookSignatureHeader, SignWebhook(secret, ts, []byte(body)))
+		req.SetBody(body)
+		res, err := req.Post(srv.URL + "/api/internal/accruals")
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode())
+	}
+
+	registered := `{"order":"12345678903","status":"REGISTERED"}`
+	capturedAt := time.Now().Unix()
+
+	send(registered, capturedAt)
+	send(`{"order":"12345678903","status":"PROCESSING"}`, time.Now().Unix())
+	send(registered, capturedAt)
+
+	orders, err := ms.GetOrders(ctx, "test", models.ListFilter{})
+	require.NoError(t, err)
+	require.Len(t, orders, 1)
+	require.Equal(t, models.StatusProcessing, orders[0].Status)
+}
@@ -3,10 +3,172 @@ package hasher
 import (
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/hex"
 	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const argon2idPrefix = "$argon2id$"
+
+var ErrInvalidHash error = fmt.Errorf("invalid password hash")
+
+type Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+var DefaultParams = Params{
+	Memory:      19 * 1024,
+	Iterations:  2,
+	Parallelism: 1,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+var (
+	mu     sync.RWMutex
+	params = DefaultParams
+	dummy  string
 )
 
+func Initialize(p Params) error {
+	if p.Memory < 8*uint32(p.Parallelism) {
+		return fmt.Errorf("memory %d must be at least 8*parallelism", p.Memory)
+	}
+
+	if p.Iterations == 0 || p.Parallelism == 0 || p.SaltLength == 0 || p.KeyLength == 0 {
+		return fmt.Errorf("hash params must be positive: %+v", p)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	params = p
+	dummy = ""
+
+	return nil
+}
+
+func currentParams() Params {
+	mu.RLock()
+	defer mu.RUnlock()
+	return params
+}
+
+func Hash(password string) (string, error) {
+	p := currentParams()
+	salt := make([]byte, p.SaltLength)
+
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("generate random value: %w", err)
+	}
+
+	return encode(p, password, salt), nil
+}
+
+func encode(p Params, password string, salt []byte) string {
+	key := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix, argon2.Version, p.Memory, p.Iterations, p.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	)
+}
+
+func Verify(password, encoded string) (bool, error) {
+	p, salt, key, err := decode(encoded)
+
+	if err != nil {
+		return false, err
+	}
+
+	other := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+// VerifyDummy checks the password against a fixed hash made with the current
+// params. A login for an unknown user calls it so the answer takes as long as
+// for a wrong password.
+func VerifyDummy(password string) {
+	_, _ = Verify(password, dummyHash())
+}
+
+func dummyHash() string {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if dummy == "" {
+		dummy = encode(params, "dummy", make([]byte, params.SaltLength))
+	}
+
+	return dummy
+}
+
+func NeedsRehash(encoded string) bool {
+	p, _, _, err := decode(encoded)
+
+	if err != nil {
+		return true
+	}
+
+	cur := currentParams()
+
+	return p.Memory != cur.Memory ||
+		p.Iterations != cur.Iterations ||
+		p.Parallelism != cur.Parallelism ||
+		p.SaltLength != cur.SaltLength ||
+		p.KeyLength != cur.KeyLength
+}
+
+func decode(encoded string) (p Params, salt, key []byte, err error) {
+	if !strings.HasPrefix(encoded, argon2idPrefix) {
+		return p, nil, nil, ErrInvalidHash
+	}
+
+	parts := strings.Split(encoded, "$")
+
+	if len(parts) != 6 {
+		return p, nil, nil, ErrInvalidHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, ErrInvalidHash
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism); err != nil {
+		return p, nil, nil, ErrInvalidHash
+	}
+
+	salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+
+	if err != nil {
+		return p, nil, nil, ErrInvalidHash
+	}
+
+	key, err = base64.RawStdEncoding.DecodeString(parts[5])
+
+	if err != nil {
+		return p, nil, nil, ErrInvalidHash
+	}
+
+	p.SaltLength = uint32(len(salt))
+	p.KeyLength = uint32(len(key))
+
+	return p, salt, key, nil
+}
+
+// SaltPassword is the legacy salted SHA-256 hash, kept to verify users
+// created before argon2id hashing.
 type SaltPassword struct {
 	Password string
 	Salt     string
@@ -0,0 +1,82 @@
+package hasher
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashVerify(t *testing.T) {
+	t.Run("positive test", func(t *testing.T) {
+		hash, err := Hash("pwd")
+		require.NoError(t, err)
+		require.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=19456,t=2,p=1$"))
+
+		ok, err := Verify("pwd", hash)
+		require.NoError(t, err)
+		require.True(t, ok)
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		hash, err := Hash("pwd")
+		require.NoError(t, err)
+
+		ok, err := Verify("other", hash)
+		require.NoError(t, err)
+		require.False(t, ok)
+	})
+
+	t.Run("unique salt", func(t *testing.T) {
+		first, err := Hash("pwd")
+		require.NoError(t, err)
+		second, err := Hash("pwd")
+		require.NoError(t, err)
+		require.NotEqual(t, first, second)
+	})
+
+	t.Run("invalid hash", func(t *testing.T) {
+		for _, h := range []string{
+			"",
+			"abc",
+			"$argon2id$v=19$m=19456,t=2,p=1$salt",
+			"$argon2id$v=18$m=19456,t=2,p=1$c2FsdA$a2V5",
+			"$argon2id$v=19$m=x,t=2,p=1$c2FsdA$a2V5",
+			"$argon2id$v=19$m=19456,t=2,p=1$!!$a2V5",
+		} {
+			_, err := Verify("pwd", h)
+			require.ErrorIs(t, err, ErrInvalidHash, h)
+		}
+	})
+}
+
+func TestNeedsRehash(t *testing.T) {
+	hash, err := Hash("pwd")
+	require.NoError(t, err)
+	require.False(t, NeedsRehash(hash))
+	require.True(t, NeedsRehash("legacy"))
+
+	require.NoError(t, Initialize(Params{Memory: 8 * 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}))
+	defer Initialize(DefaultParams)
+
+	require.True(t, NeedsRehash(hash))
+
+	ok, err := Verify("pwd", hash)
+	require.NoError(t, err)
+	require.True(t, ok)
+}
+
+func TestInitialize(t *testing.T) {
+	require.Error(t, Initialize(Params{}))
+	require.Error(t, Initialize(Params{Memory: 1, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}))
+}
+
+func TestVerifyDummy(t *testing.T) {
+	require.False(t, NeedsRehash(dummyHash()))
+	VerifyDummy("pwd")
+
+	require.NoError(t, Initialize(Params{Memory: 8 * 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}))
+	defer Initialize(DefaultParams)
+
+	require.False(t, NeedsRehash(dummyHash()))
+}
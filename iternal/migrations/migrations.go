@@ -0,0 +1,293 @@
+package migrations
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+//go:embed sql/*.sql
+var embedded embed.FS
+
+// lockKey is the pg_advisory_lock key that serializes migrations between instances.
+const lockKey int64 = 7243591
+
+var fileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+var ErrNoMigrations error = fmt.Errorf("no applied migrations")
+
+type Migration struct {
+	Version uint64
+	Name    string
+	Up      string
+	Down    string
+}
+
+type Status struct {
+	Version   uint64
+	Name      string
+	AppliedAt *time.Time
+}
+
+func Load(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+
+	if err != nil {
+		return nil, fmt.Errorf("read migrations dir: %w", err)
+	}
+
+	byVersion := make(map[uint64]*Migration)
+
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+
+		parts := fileName.FindStringSubmatch(e.Name())
+
+		if parts == nil {
+			return nil, fmt.Errorf("invalid migration file name %s", e.Name())
+		}
+
+		version, err := strconv.ParseUint(parts[1], 10, 64)
+
+		if err != nil {
+			return nil, fmt.Errorf("parse version of %s: %w", e.Name(), err)
+		}
+
+		data, err := fs.ReadFile(fsys, path.Join(dir, e.Name()))
+
+		if err != nil {
+			return nil, fmt.Errorf("read migration %s: %w", e.Name(), err)
+		}
+
+		m, ok := byVersion[version]
+
+		if !ok {
+			m = &Migration{Version: version, Name: parts[2]}
+			byVersion[version] = m
+		}
+
+		if m.Name != parts[2] {
+			return nil, fmt.Errorf("migration %d has different names %s and %s", version, m.Name, parts[2])
+		}
+
+		if parts[3] == "up" {
+			m.Up = string(data)
+		} else {
+			m.Down = string(data)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s must have up and down files", m.Version, m.Name)
+		}
+
+		migrations = append(migrations, *m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+type Migrator struct {
+	pool       *pgxpool.Pool
+	migrations []Migration
+}
+
+func NewMigrator(pool *pgxpool.Pool) (*Migrator, error) {
+	migrations, err := Load(embedded, "sql")
+
+	if err != nil {
+		return nil, fmt.Errorf("load embedded migrations: %w", err)
+	}
+
+	return &Migrator{pool: pool, migrations: migrations}, nil
+}
+
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		applied, err := appliedVersions(ctx, conn)
+
+		if err != nil {
+			return err
+		}
+
+		for _, mg := range m.migrations {
+			if _, ok := applied[mg.Version]; ok {
+				continue
+			}
+
+			err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+				if _, err := tx.Exec(ctx, mg.Up); err != nil {
+					return err
+				}
+
+				_, err := tx.Exec(ctx,
+					"INSERT INTO schema_migrations (Version, Name) VALUES ($1, $2)",
+					mg.Version, mg.Name)
+				return err
+			})
+
+			if err != nil {
+				return fmt.Errorf("apply migration %d_%s: %w", mg.Version, mg.Name, err)
+			}
+		}
+
+		return nil
+	})
+}
+
+func (m *Migrator) Down(ctx context.Context) error {
+	return m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		var version *int64
+		err := conn.QueryRow(ctx, "SELECT MAX(Version) FROM schema_migrations").Scan(&version)
+
+		if err != nil {
+			return fmt.Errorf("get last migration: %w", err)
+		}
+
+		if version == nil {
+			return ErrNoMigrations
+		}
+
+		var mg *Migration
+
+		for i := range m.migrations {
+			if m.migrations[i].Version == uint64(*version) {
+				mg = &m.migrations[i]
+			}
+		}
+
+		if mg == nil {
+			return fmt.Errorf("unknown applied migration %d", *version)
+		}
+
+		err = pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+			if _, err := tx.Exec(ctx, mg.Down); err != nil {
+				return err
+			}
+
+			_, err := tx.Exec(ctx, "DELETE FROM schema_migrations WHERE Version = $1", mg.Version)
+			return err
+		})
+
+		if err != nil {
+			return fmt.Errorf("revert migration %d_%s: %w", mg.Version, mg.Name, err)
+		}
+
+		return nil
+	})
+}
+
+// Status reads the applied migrations without taking the lock, so it neither
+// waits for a running migration nor creates schema_migrations.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	conn, err := m.pool.Acquire(ctx)
+
+	if err != nil {
+		return nil, fmt.Errorf("acquire connection: %w", err)
+	}
+	defer conn.Release()
+
+	applied, err := appliedVersions(ctx, conn)
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UndefinedTable {
+		applied, err = nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]Status, 0, len(m.migrations))
+
+	for _, mg := range m.migrations {
+		s := Status{Version: mg.Version, Name: mg.Name}
+
+		if at, ok := applied[mg.Version]; ok {
+			s.AppliedAt = &at
+		}
+
+		statuses = append(statuses, s)
+	}
+
+	return statuses, nil
+}
+
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *pgxpool.Conn) error) error {
+	conn, err := m.pool.Acquire(ctx)
+
+	if err != nil {
+		return fmt.Errorf("acquire connection: %w", err)
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1)", lockKey); err != nil {
+		return fmt.Errorf("lock migrations: %w", err)
+	}
+	defer conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", lockKey)
+
+	query := `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			Version BIGINT PRIMARY KEY,
+			Name VARCHAR(150),
+			AppliedAt TIMESTAMP WITH TIME ZONE DEFAULT current_timestamp
+		);
+	`
+
+	if _, err := conn.Exec(ctx, query); err != nil {
+		return fmt.Errorf("create schema_migrations table: %w", err)
+	}
+
+	return fn(conn)
+}
+
+func appliedVersions(ctx context.Context, conn *pgxpool.Conn) (map[uint64]time.Time, error) {
+	rows, err := conn.Query(ctx, "SELECT Version, AppliedAt FROM schema_migrations")
+
+	if err != nil {
+		return nil, fmt.Errorf("get applied migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[uint64]time.Time)
+
+	for rows.Next() {
+		var (
+			v  int64
+			at time.Time
+		)
+
+		if err := rows.Scan(&v, &at); err != nil {
+			return nil, fmt.Errorf("scan applied migration: %w", err)
+		}
+
+		applied[uint64(v)] = at
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("get applied migrations: %w", err)
+	}
+
+	return applied, nil
+}
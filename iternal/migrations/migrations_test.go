@@ -0,0 +1,74 @@
+package migrations
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad(t *testing.T) {
+	t.Run("embedded migrations", func(t *testing.T) {
+		ms, err := Load(embedded, "sql")
+		require.NoError(t, err)
+		require.NotEmpty(t, ms)
+
+		for i := range ms {
+			require.NotEmpty(t, ms[i].Up)
+			require.NotEmpty(t, ms[i].Down)
+
+			if i > 0 {
+				require.Less(t, ms[i-1].Version, ms[i].Version)
+			}
+		}
+	})
+
+	t.Run("sorted by version", func(t *testing.T) {
+		fsys := fstest.MapFS{
+			"sql/0010_second.up.sql":   {Data: []byte("up2")},
+			"sql/0010_second.down.sql": {Data: []byte("down2")},
+			"sql/0002_first.up.sql":    {Data: []byte("up1")},
+			"sql/0002_first.down.sql":  {Data: []byte("down1")},
+		}
+
+		ms, err := Load(fsys, "sql")
+		require.NoError(t, err)
+		require.Equal(t, []Migration{
+			{Version: 2, Name: "first", Up: "up1", Down: "down1"},
+			{Version: 10, Name: "second", Up: "up2", Down: "down2"},
+		}, ms)
+	})
+
+	t.Run("missing down", func(t *testing.T) {
+		fsys := fstest.MapFS{
+			"sql/0001_first.up.sql": {Data: []byte("up")},
+		}
+
+		_, err := Load(fsys, "sql")
+		require.Error(t, err)
+	})
+
+	t.Run("invalid name", func(t *testing.T) {
+		fsys := fstest.MapFS{
+			"sql/first.sql": {Data: []byte("up")},
+		}
+
+		_, err := Load(fsys, "sql")
+		require.Error(t, err)
+	})
+
+	t.Run("different names for version", func(t *testing.T) {
+		fsys := fstest.MapFS{
+			"sql/0001_first.up.sql":   {Data: []byte("up")},
+			"sql/0001_other.down.sql": {Data: []byte("down")},
+		}
+
+		_, err := Load(fsys, "sql")
+		require.Error(t, err)
+	})
+
+	t.Run("no dir", func(t *testing.T) {
+		_, err := Load(fstest.MapFS{}, "sql")
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS balances;
+DROP FUNCTION IF EXISTS balances_stamp();
+DROP TABLE IF EXISTS orders;
+DROP FUNCTION IF EXISTS orders_stamp();
+DROP TABLE IF EXISTS statuses;
+DROP TABLE IF EXISTS users;
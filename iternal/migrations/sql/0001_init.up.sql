@@ -0,0 +1,52 @@
+CREATE TABLE IF NOT EXISTS users (
+	Login VARCHAR(150) PRIMARY KEY,
+	Password CHAR(64),
+	Salt VARCHAR(150)
+);
+
+CREATE TABLE IF NOT EXISTS statuses (
+	Name VARCHAR(50) PRIMARY KEY
+);
+INSERT INTO statuses VALUES ('NEW'), ('PROCESSING'), ('INVALID'), ('PROCESSED')
+	ON CONFLICT (Name) DO NOTHING;
+
+CREATE TABLE IF NOT EXISTS orders (
+	Number VARCHAR(150) PRIMARY KEY,
+	Login VARCHAR(150) REFERENCES users(Login),
+	Status VARCHAR(50) REFERENCES statuses(Name),
+	UploadedAt TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX IF NOT EXISTS uploaded_at_idx ON orders (UploadedAt);
+CREATE OR REPLACE FUNCTION orders_stamp() RETURNS trigger AS $orders_stamp$
+	BEGIN
+		NEW.UploadedAt := current_timestamp;
+		RETURN NEW;
+	END;
+$orders_stamp$ LANGUAGE plpgsql;
+CREATE OR REPLACE TRIGGER orders_stamp BEFORE INSERT OR UPDATE ON orders
+	FOR EACH ROW EXECUTE PROCEDURE orders_stamp();
+
+CREATE TABLE IF NOT EXISTS balances (
+	Login VARCHAR(150) REFERENCES users(Login),
+	Order_number VARCHAR(150),
+	ProcessedAt TIMESTAMP WITH TIME ZONE,
+	Sum DOUBLE PRECISION
+);
+CREATE INDEX IF NOT EXISTS processed_at_idx ON balances (ProcessedAt);
+CREATE INDEX IF NOT EXISTS order_number_idx ON balances (Order_number);
+CREATE OR REPLACE FUNCTION balances_stamp() RETURNS trigger AS $balances_stamp$
+	DECLARE
+		total_balance DOUBLE PRECISION;
+	BEGIN
+		SELECT Sum INTO total_balance FROM balances WHERE Login = NEW.Login FOR UPDATE;
+
+		IF (total_balance IS NULL AND NEW.SUM < 0) OR (SELECT SUM(Sum) FROM balances WHERE Login = NEW.Login) + NEW.SUM < 0 THEN
+			RAISE EXCEPTION 'insufficient funds';
+		END IF;
+
+		NEW.ProcessedAt := current_timestamp;
+		RETURN NEW;
+	END;
+$balances_stamp$ LANGUAGE plpgsql;
+CREATE OR REPLACE TRIGGER balances_stamp BEFORE INSERT OR UPDATE ON balances
+	FOR EACH ROW EXECUTE PROCEDURE balances_stamp();
@@ -0,0 +1,16 @@
+ALTER TABLE balances ALTER COLUMN Sum TYPE BIGINT USING round(Sum * 100)::BIGINT;
+
+CREATE OR REPLACE FUNCTION balances_stamp() RETURNS trigger AS $balances_stamp$
+	DECLARE
+		total_balance BIGINT;
+	BEGIN
+		SELECT Sum INTO total_balance FROM balances WHERE Login = NEW.Login FOR UPDATE;
+
+		IF (total_balance IS NULL AND NEW.SUM < 0) OR (SELECT SUM(Sum) FROM balances WHERE Login = NEW.Login) + NEW.SUM < 0 THEN
+			RAISE EXCEPTION 'insufficient funds';
+		END IF;
+
+		NEW.ProcessedAt := current_timestamp;
+		RETURN NEW;
+	END;
+$balances_stamp$ LANGUAGE plpgsql;
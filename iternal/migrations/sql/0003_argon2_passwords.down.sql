@@ -0,0 +1,9 @@
+DO $$
+BEGIN
+	IF EXISTS (SELECT 1 FROM users WHERE length(Password) > 64) THEN
+		RAISE EXCEPTION 'migration 0003 is irreversible: argon2id password hashes do not fit CHAR(64)';
+	END IF;
+END
+$$;
+
+ALTER TABLE users ALTER COLUMN Password TYPE CHAR(64);
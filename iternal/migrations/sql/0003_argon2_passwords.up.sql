@@ -0,0 +1 @@
+ALTER TABLE users ALTER COLUMN Password TYPE VARCHAR(255) USING trim(Password);
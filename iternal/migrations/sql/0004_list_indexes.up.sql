@@ -0,0 +1,2 @@
+CREATE INDEX IF NOT EXISTS orders_login_uploaded_at_idx ON orders (Login, UploadedAt, Number);
+CREATE INDEX IF NOT EXISTS balances_login_processed_at_idx ON balances (Login, ProcessedAt, Order_number);
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS balances_withdrawal_order_idx;
@@ -0,0 +1,20 @@
+DROP INDEX IF EXISTS balances_withdrawal_order_idx;
+
+DO $$
+DECLARE
+	conflicts TEXT;
+BEGIN
+	SELECT string_agg(format('order %s login %s sum %s at %s', Order_number, Login, Sum, ProcessedAt), '; ' ORDER BY Order_number, ProcessedAt)
+		INTO conflicts
+		FROM balances
+		WHERE Sum < 0 AND Order_number IN (
+			SELECT Order_number FROM balances WHERE Sum < 0 GROUP BY Order_number HAVING count(*) > 1
+		);
+
+	IF conflicts IS NOT NULL THEN
+		RAISE EXCEPTION 'migration 0005 found orders withdrawn more than once, resolve them by hand: %', conflicts;
+	END IF;
+END
+$$;
+
+CREATE UNIQUE INDEX IF NOT EXISTS balances_withdrawal_order_idx ON balances (Order_number) WHERE Sum < 0;
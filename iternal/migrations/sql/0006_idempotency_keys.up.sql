@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+	Login VARCHAR(150) REFERENCES users(Login),
+	Key VARCHAR(255),
+	Fingerprint CHAR(64),
+	StatusCode INTEGER,
+	ContentType VARCHAR(150),
+	Body BYTEA,
+	CreatedAt TIMESTAMP WITH TIME ZONE DEFAULT current_timestamp,
+	PRIMARY KEY (Login, Key)
+);
+CREATE INDEX IF NOT EXISTS idempotency_keys_created_at_idx ON idempotency_keys (CreatedAt);
@@ -0,0 +1,10 @@
+DROP TRIGGER IF EXISTS orders_stamp ON orders;
+CREATE TRIGGER orders_stamp BEFORE INSERT OR UPDATE ON orders
+	FOR EACH ROW EXECUTE PROCEDURE orders_stamp();
+
+DROP INDEX IF EXISTS orders_due_idx;
+ALTER TABLE orders
+	DROP COLUMN IF EXISTS ParkedAt,
+	DROP COLUMN IF EXISTS LastError,
+	DROP COLUMN IF EXISTS AttemptCount,
+	DROP COLUMN IF EXISTS NextAttemptAt;
@@ -0,0 +1,11 @@
+ALTER TABLE orders
+	ADD COLUMN IF NOT EXISTS NextAttemptAt TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT current_timestamp,
+	ADD COLUMN IF NOT EXISTS AttemptCount INTEGER NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS LastError TEXT,
+	ADD COLUMN IF NOT EXISTS ParkedAt TIMESTAMP WITH TIME ZONE;
+CREATE INDEX IF NOT EXISTS orders_due_idx ON orders (NextAttemptAt)
+	WHERE ParkedAt IS NULL AND Status NOT IN ('INVALID', 'PROCESSED');
+
+DROP TRIGGER IF EXISTS orders_stamp ON orders;
+CREATE TRIGGER orders_stamp BEFORE INSERT OR UPDATE OF Status ON orders
+	FOR EACH ROW EXECUTE PROCEDURE orders_stamp();
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS balances_credit_order_idx;
+
+DROP TRIGGER IF EXISTS order_status_history_stamp ON orders;
+DROP FUNCTION IF EXISTS order_status_history_stamp();
+DROP TABLE IF EXISTS order_status_history;
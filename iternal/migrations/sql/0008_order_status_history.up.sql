@@ -0,0 +1,26 @@
+CREATE TABLE IF NOT EXISTS order_status_history (
+	Id BIGSERIAL PRIMARY KEY,
+	Order_number VARCHAR(150) REFERENCES orders(Number) ON DELETE CASCADE,
+	Status VARCHAR(50) REFERENCES statuses(Name),
+	ChangedAt TIMESTAMP WITH TIME ZONE DEFAULT current_timestamp
+);
+CREATE INDEX IF NOT EXISTS order_status_history_order_idx ON order_status_history (Order_number, ChangedAt);
+INSERT INTO order_status_history (Order_number, Status, ChangedAt)
+	SELECT Number, Status, UploadedAt FROM orders;
+
+CREATE OR REPLACE FUNCTION order_status_history_stamp() RETURNS trigger AS $order_status_history_stamp$
+	BEGIN
+		IF TG_OP = 'INSERT' OR NEW.Status IS DISTINCT FROM OLD.Status THEN
+			INSERT INTO order_status_history (Order_number, Status) VALUES (NEW.Number, NEW.Status);
+		END IF;
+
+		RETURN NULL;
+	END;
+$order_status_history_stamp$ LANGUAGE plpgsql;
+CREATE OR REPLACE TRIGGER order_status_history_stamp AFTER INSERT OR UPDATE OF Status ON orders
+	FOR EACH ROW EXECUTE PROCEDURE order_status_history_stamp();
+
+DELETE FROM balances WHERE Sum IS NULL OR Sum = 0;
+DELETE FROM balances AS b USING balances AS d
+	WHERE b.Order_number = d.Order_number AND b.Sum > 0 AND d.Sum > 0 AND b.ctid > d.ctid;
+CREATE UNIQUE INDEX IF NOT EXISTS balances_credit_order_idx ON balances (Order_number) WHERE Sum > 0;
@@ -0,0 +1,3 @@
+ALTER TABLE orders
+	DROP COLUMN IF EXISTS LeaseExpiresAt,
+	DROP COLUMN IF EXISTS LeaseOwner;
@@ -0,0 +1,3 @@
+ALTER TABLE orders
+	ADD COLUMN IF NOT EXISTS LeaseOwner VARCHAR(150),
+	ADD COLUMN IF NOT EXISTS LeaseExpiresAt TIMESTAMP WITH TIME ZONE;
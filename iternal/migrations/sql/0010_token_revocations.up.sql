@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+	Jti VARCHAR(64) PRIMARY KEY,
+	Login VARCHAR(150) REFERENCES users(Login),
+	ExpiresAt TIMESTAMP WITH TIME ZONE NOT NULL
+);
+CREATE INDEX IF NOT EXISTS revoked_tokens_expires_at_idx ON revoked_tokens (ExpiresAt);
+
+CREATE TABLE IF NOT EXISTS login_revocations (
+	Login VARCHAR(150) PRIMARY KEY REFERENCES users(Login),
+	RevokedBefore TIMESTAMP WITH TIME ZONE NOT NULL
+);
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+	TokenHash CHAR(64) PRIMARY KEY,
+	FamilyID VARCHAR(64) NOT NULL,
+	Login VARCHAR(150) REFERENCES users(Login),
+	ExpiresAt TIMESTAMP WITH TIME ZONE NOT NULL,
+	UsedAt TIMESTAMP WITH TIME ZONE,
+	RevokedAt TIMESTAMP WITH TIME ZONE,
+	CreatedAt TIMESTAMP WITH TIME ZONE DEFAULT current_timestamp
+);
+CREATE INDEX IF NOT EXISTS refresh_tokens_family_idx ON refresh_tokens (FamilyID);
+CREATE INDEX IF NOT EXISTS refresh_tokens_login_idx ON refresh_tokens (Login);
+CREATE INDEX IF NOT EXISTS refresh_tokens_expires_at_idx ON refresh_tokens (ExpiresAt);
@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS orders_stamp ON orders;
+CREATE TRIGGER orders_stamp BEFORE INSERT ON orders
+	FOR EACH ROW EXECUTE PROCEDURE orders_stamp();
@@ -0,0 +1,193 @@
+package models
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const MaxListLimit = 1000
+
+var ErrInvalidCursor error = fmt.Errorf("invalid cursor")
+
+type Cursor struct {
+	Time time.Time `json:"t"`
+	Key  string    `json:"k"`
+}
+
+func (c Cursor) Encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func DecodeCursor(s string) (*Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var c Cursor
+	if err := json.Unmarshal(data, &c); err != nil || c.Time.IsZero() {
+		return nil, ErrInvalidCursor
+	}
+
+	return &c, nil
+}
+
+type ListFilter struct {
+	Limit    int
+	Cursor   *Cursor
+	Statuses []string
+	From     *time.Time
+	To       *time.Time
+	Desc     bool
+}
+
+func NewListFilterByQuery(q url.Values, withStatus bool) (ListFilter, error) {
+	var f ListFilter
+
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+
+		if err != nil || limit < 1 || limit > MaxListLimit {
+			return f, fmt.Errorf("limit must be between 1 and %d", MaxListLimit)
+		}
+
+		f.Limit = limit
+	}
+
+	if v := q.Get("cursor"); v != "" {
+		c, err := DecodeCursor(v)
+
+		if err != nil {
+			return f, err
+		}
+
+		f.Cursor = c
+	}
+
+	if v := q.Get("status"); v != "" {
+		if !withStatus {
+			return f, fmt.Errorf("status filter is not supported")
+		}
+
+		for _, s := range strings.Split(v, ",") {
+			s = strings.ToUpper(strings.TrimSpace(s))
+
+			switch s {
+			case StatusNew, StatusProcessing, StatusInvalid, StatusProcessed:
+				f.Statuses = append(f.Statuses, s)
+			default:
+				return f, fmt.Errorf("unknown status %s", s)
+			}
+		}
+	}
+
+	for _, p := range []struct {
+		name string
+		dst  **time.Time
+	}{{"from", &f.From}, {"to", &f.To}} {
+		v := q.Get(p.name)
+
+		if v == "" {
+			continue
+		}
+
+		t, err := time.Parse(time.RFC3339, v)
+
+		if err != nil {
+			return f, fmt.Errorf("parse %s: %w", p.name, err)
+		}
+
+		*p.dst = &t
+	}
+
+	if f.From != nil && f.To != nil && f.To.Before(*f.From) {
+		return f, fmt.Errorf("to is before from")
+	}
+
+	switch strings.ToLower(q.Get("sort")) {
+	case "", "asc":
+	case "desc":
+		f.Desc = true
+	default:
+		return f, fmt.Errorf("sort must be asc or desc")
+	}
+
+	return f, nil
+}
+
+// Query returns the query parameters that reproduce the filter, used to
+// build the next page link.
+func (f ListFilter) Query() url.Values {
+	q := url.Values{}
+
+	if f.Limit > 0 {
+		q.Set("limit", strconv.Itoa(f.Limit))
+	}
+
+	if f.Cursor != nil {
+		q.Set("cursor", f.Cursor.Encode())
+	}
+
+	if len(f.Statuses) > 0 {
+		q.Set("status", strings.Join(f.Statuses, ","))
+	}
+
+	if f.From != nil {
+		q.Set("from", f.From.Format(time.RFC3339))
+	}
+
+	if f.To != nil {
+		q.Set("to", f.To.Format(time.RFC3339))
+	}
+
+	if f.Desc {
+		q.Set("sort", "desc")
+	}
+
+	return q
+}
+
+// Match reports whether a row with the given sort time, key and status
+// passes the filter, cursor included.
+func (f ListFilter) Match(t time.Time, key string, status string) bool {
+	if len(f.Statuses) > 0 {
+		found := false
+
+		for _, s := range f.Statuses {
+			if s == status {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	if f.From != nil && t.Before(*f.From) {
+		return false
+	}
+
+	if f.To != nil && t.After(*f.To) {
+		return false
+	}
+
+	if f.Cursor != nil {
+		after := t.After(f.Cursor.Time) || (t.Equal(f.Cursor.Time) && key > f.Cursor.Key)
+		before := t.Before(f.Cursor.Time) || (t.Equal(f.Cursor.Time) && key < f.Cursor.Key)
+
+		if (f.Desc && !before) || (!f.Desc && !after) {
+			return false
+		}
+	}
+
+	return true
+}
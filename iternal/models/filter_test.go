@@ -0,0 +1,99 @@
+package models
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCursor_EncodeDecode(t *testing.T) {
+	c := Cursor{Time: time.Date(2024, 3, 1, 10, 0, 0, 123456000, time.UTC), Key: "2377225624"}
+
+	got, err := DecodeCursor(c.Encode())
+	require.NoError(t, err)
+	require.True(t, c.Time.Equal(got.Time))
+	require.Equal(t, c.Key, got.Key)
+
+	_, err = DecodeCursor("!!")
+	require.ErrorIs(t, err, ErrInvalidCursor)
+
+	_, err = DecodeCursor("e30")
+	require.ErrorIs(t, err, ErrInvalidCursor)
+}
+
+func TestNewListFilterByQuery(t *testing.T) {
+	t.Run("empty query", func(t *testing.T) {
+		f, err := NewListFilterByQuery(url.Values{}, true)
+		require.NoError(t, err)
+		require.Equal(t, ListFilter{}, f)
+	})
+
+	t.Run("full query", func(t *testing.T) {
+		c := Cursor{Time: time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC), Key: "1"}
+		q := url.Values{
+			"limit":  {"10"},
+			"cursor": {c.Encode()},
+			"status": {"new, processed"},
+			"from":   {"2024-01-01T00:00:00Z"},
+			"to":     {"2024-12-31T00:00:00Z"},
+			"sort":   {"DESC"},
+		}
+
+		f, err := NewListFilterByQuery(q, true)
+		require.NoError(t, err)
+		require.Equal(t, 10, f.Limit)
+		require.Equal(t, "1", f.Cursor.Key)
+		require.Equal(t, []string{StatusNew, StatusProcessed}, f.Statuses)
+		require.Equal(t, 2024, f.From.Year())
+		require.Equal(t, time.December, f.To.Month())
+		require.True(t, f.Desc)
+
+		back, err := NewListFilterByQuery(f.Query(), true)
+		require.NoError(t, err)
+		require.Equal(t, f.Limit, back.Limit)
+		require.Equal(t, f.Statuses, back.Statuses)
+		require.True(t, f.From.Equal(*back.From))
+		require.True(t, f.To.Equal(*back.To))
+		require.Equal(t, f.Desc, back.Desc)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, q := range []url.Values{
+			{"limit": {"0"}},
+			{"limit": {"1001"}},
+			{"cursor": {"abc"}},
+			{"status": {"DONE"}},
+			{"from": {"2024-01-01"}},
+			{"from": {"2024-02-01T00:00:00Z"}, "to": {"2024-01-01T00:00:00Z"}},
+			{"sort": {"random"}},
+		} {
+			_, err := NewListFilterByQuery(q, true)
+			require.Error(t, err, q)
+		}
+
+		_, err := NewListFilterByQuery(url.Values{"status": {"NEW"}}, false)
+		require.Error(t, err)
+	})
+}
+
+func TestListFilter_Match(t *testing.T) {
+	now := time.Now()
+	before := now.Add(-time.Minute)
+	after := now.Add(time.Minute)
+
+	require.True(t, ListFilter{}.Match(now, "1", StatusNew))
+	require.False(t, ListFilter{Statuses: []string{StatusProcessed}}.Match(now, "1", StatusNew))
+	require.False(t, ListFilter{From: &after}.Match(now, "1", StatusNew))
+	require.False(t, ListFilter{To: &before}.Match(now, "1", StatusNew))
+
+	c := &Cursor{Time: now, Key: "2"}
+	require.True(t, ListFilter{Cursor: c}.Match(after, "1", StatusNew))
+	require.True(t, ListFilter{Cursor: c}.Match(now, "3", StatusNew))
+	require.False(t, ListFilter{Cursor: c}.Match(now, "2", StatusNew))
+	require.False(t, ListFilter{Cursor: c}.Match(before, "3", StatusNew))
+	require.True(t, ListFilter{Cursor: c, Desc: true}.Match(before, "3", StatusNew))
+	require.True(t, ListFilter{Cursor: c, Desc: true}.Match(now, "1", StatusNew))
+	require.False(t, ListFilter{Cursor: c, Desc: true}.Match(after, "1", StatusNew))
+}
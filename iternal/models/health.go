@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+const (
+	HealthOK       = "ok"
+	HealthDegraded = "degraded"
+)
+
+// ComponentHealth is the state of a background component reported by the
+// health endpoint.
+type ComponentHealth struct {
+	Status        string         `json:"status"`
+	Failures      int            `json:"consecutive_failures"`
+	LastError     string         `json:"last_error,omitempty"`
+	LastErrorAt   *time.Time     `json:"last_error_at,omitempty"`
+	LastSuccessAt *time.Time     `json:"last_success_at,omitempty"`
+	RetryAt       *time.Time     `json:"retry_at,omitempty"`
+	Breaker       *BreakerHealth `json:"breaker,omitempty"`
+}
+
+// BreakerHealth is the state of a circuit breaker and the number of times it
+// moved into every state since start.
+type BreakerHealth struct {
+	State      string `json:"state"`
+	Opened     uint64 `json:"opened"`
+	HalfOpened uint64 `json:"half_opened"`
+	Closed     uint64 `json:"closed"`
+}
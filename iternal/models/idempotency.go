@@ -0,0 +1,7 @@
+package models
+
+type IdempotentResponse struct {
+	StatusCode  int
+	ContentType string
+	Body        []byte
+}
@@ -0,0 +1,122 @@
+package models
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"fmt"
+	"math/big"
+)
+
+const moneyScale = 100
+
+var ErrMoneyPrecision error = fmt.Errorf("money has more than two fractional digits")
+
+// Money is an amount of loyalty points in minor units (hundredths of a point).
+type Money int64
+
+func NewMoneyFromString(s string) (Money, error) {
+	r, err := parseMinorUnits(s)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if !r.IsInt() {
+		return 0, ErrMoneyPrecision
+	}
+
+	return moneyFromInt(s, r.Num())
+}
+
+// RoundMoneyFromString parses an amount rounding it half to even to minor
+// units. It is for the amounts the service does not choose, like accruals,
+// where refusing a precise value would lose the credit.
+func RoundMoneyFromString(s string) (Money, error) {
+	r, err := parseMinorUnits(s)
+
+	if err != nil {
+		return 0, err
+	}
+
+	num, den := new(big.Int).Abs(r.Num()), r.Denom()
+	q, rem := new(big.Int).QuoRem(num, den, new(big.Int))
+
+	switch rem.Lsh(rem, 1).Cmp(den) {
+	case 1:
+		q.Add(q, big.NewInt(1))
+	case 0:
+		if q.Bit(0) == 1 {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+
+	if r.Sign() < 0 {
+		q.Neg(q)
+	}
+
+	return moneyFromInt(s, q)
+}
+
+func parseMinorUnits(s string) (*big.Rat, error) {
+	r, ok := new(big.Rat).SetString(s)
+
+	if !ok {
+		return nil, fmt.Errorf("parse money %s", s)
+	}
+
+	return r.Mul(r, big.NewRat(moneyScale, 1)), nil
+}
+
+func moneyFromInt(s string, v *big.Int) (Money, error) {
+	if !v.IsInt64() {
+		return 0, fmt.Errorf("money %s out of range", s)
+	}
+
+	return Money(v.Int64()), nil
+}
+
+func (m Money) String() string {
+	sign := ""
+	v := int64(m)
+
+	if v < 0 {
+		sign = "-"
+		v = -v
+	}
+
+	units, cents := v/moneyScale, v%moneyScale
+
+	switch {
+	case cents == 0:
+		return fmt.Sprintf("%s%d", sign, units)
+	case cents%10 == 0:
+		return fmt.Sprintf("%s%d.%d", sign, units, cents/10)
+	default:
+		return fmt.Sprintf("%s%d.%02d", sign, units, cents)
+	}
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+func (m *Money) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+
+	v, err := NewMoneyFromString(string(data))
+
+	if err != nil {
+		return err
+	}
+
+	*m = v
+	return nil
+}
+
+func (m Money) Value() (driver.Value, error) {
+	return int64(m), nil
+}
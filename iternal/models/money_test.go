@@ -0,0 +1,111 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewMoneyFromString(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    Money
+		wantErr bool
+	}{
+		{name: "integer", s: "500", want: 50000},
+		{name: "two digits", s: "729.98", want: 72998},
+		{name: "one digit", s: "0.5", want: 50},
+		{name: "trailing zeros", s: "1.500", want: 150},
+		{name: "exponent", s: "1.5e2", want: 15000},
+		{name: "negative", s: "-12.34", want: -1234},
+		{name: "too precise", s: "0.001", wantErr: true},
+		{name: "not a number", s: "abc", wantErr: true},
+		{name: "out of range", s: "1e30", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewMoneyFromString(tt.s)
+
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestRoundMoneyFromString(t *testing.T) {
+	tests := []struct {
+		s    string
+		want Money
+	}{
+		{s: "500", want: 50000},
+		{s: "729.98", want: 72998},
+		{s: "500.005", want: 50000},
+		{s: "500.015", want: 50002},
+		{s: "500.0051", want: 50001},
+		{s: "500.0049", want: 50000},
+		{s: "-0.015", want: -2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := RoundMoneyFromString(tt.s)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+
+	_, err := RoundMoneyFromString("abc")
+	require.Error(t, err)
+}
+
+func TestMoney_String(t *testing.T) {
+	tests := []struct {
+		m    Money
+		want string
+	}{
+		{m: 0, want: "0"},
+		{m: 50000, want: "500"},
+		{m: 72998, want: "729.98"},
+		{m: 50, want: "0.5"},
+		{m: 5, want: "0.05"},
+		{m: -1234, want: "-12.34"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			require.Equal(t, tt.want, tt.m.String())
+		})
+	}
+}
+
+func TestMoney_UnMarshalMarshalJSON(t *testing.T) {
+	t.Run("round trip", func(t *testing.T) {
+		var ub UserBalance
+		err := json.Unmarshal([]byte(`{"current": 729.98, "withdrawn": 0.1}`), &ub)
+		require.NoError(t, err)
+		require.Equal(t, Money(72998), ub.Current)
+		require.Equal(t, Money(10), *ub.Withdrawn)
+
+		r, err := json.Marshal(ub)
+		require.NoError(t, err)
+		require.JSONEq(t, `{"current": 729.98, "withdrawn": 0.1}`, string(r))
+	})
+
+	t.Run("sum of floats is exact", func(t *testing.T) {
+		var a, b Money
+		require.NoError(t, json.Unmarshal([]byte("0.1"), &a))
+		require.NoError(t, json.Unmarshal([]byte("0.2"), &b))
+		require.Equal(t, "0.3", (a + b).String())
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		var m Money
+		require.Error(t, json.Unmarshal([]byte(`"abc"`), &m))
+		require.Error(t, json.Unmarshal([]byte(`0.001`), &m))
+	})
+}
@@ -14,7 +14,7 @@ import (
 type Order struct {
 	Number     string     `json:"number"`
 	Status     string     `json:"status"`
-	Accrual    *float64   `json:"accrual,omitempty"`
+	Accrual    *Money     `json:"accrual,omitempty"`
 	UploadedAt *time.Time `json:"uploaded_at"`
 }
 
@@ -34,7 +34,7 @@ func (o *Order) ScanRow(rows pgx.Rows) error {
 			acc := values[i]
 
 			if acc != nil {
-				acc := acc.(float64)
+				acc := Money(acc.(int64))
 				o.Accrual = &acc
 			}
 		case "uploadedat":
@@ -63,11 +63,33 @@ func (o Order) MarshalJSON() ([]byte, error) {
 	return json.Marshal(aliasOrder)
 }
 
+// accrualMoney is an amount from the accrual system. It is rounded to minor
+// units, since an order the service refuses to credit would be retried until
+// it is parked.
+type accrualMoney Money
+
+func (m *accrualMoney) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+
+	v, err := RoundMoneyFromString(string(data))
+
+	if err != nil {
+		return err
+	}
+
+	*m = accrualMoney(v)
+	return nil
+}
+
 func (o *Order) UnmarshalJSON(data []byte) (err error) {
 	type OrderFromService struct {
-		Order   string   `json:"order"`
-		Status  string   `json:"status"`
-		Accrual *float64 `json:"accrual,omitempty"`
+		Order   string        `json:"order"`
+		Status  string        `json:"status"`
+		Accrual *accrualMoney `json:"accrual,omitempty"`
 	}
 
 	ofs := &OrderFromService{}
@@ -87,14 +109,20 @@ func (o *Order) UnmarshalJSON(data []byte) (err error) {
 		o.Status = StatusNew
 	}
 
-	o.Accrual = ofs.Accrual
+	o.Accrual = (*Money)(ofs.Accrual)
 
 	return
 }
 
+// OrderStatusChange is a single entry of the order status history.
+type OrderStatusChange struct {
+	Status    string
+	ChangedAt time.Time
+}
+
 type OrderBalance struct {
 	Order       string     `json:"order"`
-	Sum         float64    `json:"sum"`
+	Sum         Money      `json:"sum"`
 	ProcessedAt *time.Time `json:"processed_at"`
 }
 
@@ -127,7 +155,7 @@ func (ob *OrderBalance) ScanRow(rows pgx.Rows) error {
 		case "order":
 			ob.Order = values[i].(string)
 		case "sum":
-			ob.Sum = values[i].(float64)
+			ob.Sum = Money(values[i].(int64))
 		case "processedat":
 			pa := values[i].(time.Time)
 			ob.ProcessedAt = &pa
@@ -163,3 +191,42 @@ func (ob *OrderBalance) writeFieldsByJSON(j []byte) error {
 
 	return nil
 }
+
+// OrderSchedule is the polling state of an order that is not final yet.
+// A parked order exceeded the attempt cap and is left for manual review.
+type OrderSchedule struct {
+	Number        string
+	AttemptCount  int
+	NextAttemptAt time.Time
+	LastError     string
+	Parked        bool
+	UploadedAt    time.Time
+}
+
+func (s *OrderSchedule) ScanRow(rows pgx.Rows) error {
+	values, err := rows.Values()
+	if err != nil {
+		return err
+	}
+
+	for i := range values {
+		switch strings.ToLower(rows.FieldDescriptions()[i].Name) {
+		case "number":
+			s.Number = values[i].(string)
+		case "attemptcount":
+			s.AttemptCount = int(values[i].(int32))
+		case "nextattemptat":
+			s.NextAttemptAt = values[i].(time.Time)
+		case "lasterror":
+			if le := values[i]; le != nil {
+				s.LastError = le.(string)
+			}
+		case "parked":
+			s.Parked = values[i].(bool)
+		case "uploadedat":
+			s.UploadedAt = values[i].(time.Time)
+		}
+	}
+
+	return nil
+}
@@ -42,8 +42,8 @@ func TestOrder_ScanRow(t *testing.T) {
 	t.Run("full fields", func(t *testing.T) {
 		ro := new(RowsMockedObject)
 		curTime := time.Now()
-		accrual := float64(65)
-		ro.On("Values").Return([]any{"test", "test", accrual, curTime}, nil)
+		accrual := Money(6500)
+		ro.On("Values").Return([]any{"test", "test", int64(accrual), curTime}, nil)
 		ro.On("FieldDescriptions").Return([]pgconn.FieldDescription{
 			{Name: "number"},
 			{Name: "status"},
@@ -72,8 +72,8 @@ func TestOrderBalance_ScanRow(t *testing.T) {
 	t.Run("full fields", func(t *testing.T) {
 		ro := new(RowsMockedObject)
 		curTime := time.Now()
-		sum := float64(65)
-		ro.On("Values").Return([]any{"test", sum, curTime}, nil)
+		sum := Money(6500)
+		ro.On("Values").Return([]any{"test", int64(sum), curTime}, nil)
 		ro.On("FieldDescriptions").Return([]pgconn.FieldDescription{
 			{Name: "order"},
 			{Name: "sum"},
@@ -89,6 +89,59 @@ func TestOrderBalance_ScanRow(t *testing.T) {
 	})
 }
 
+func TestOrderSchedule_ScanRow(t *testing.T) {
+	t.Run("test error", func(t *testing.T) {
+		ro := new(RowsMockedObject)
+		ro.On("Values").Return(nil, fmt.Errorf("test"))
+		os := new(OrderSchedule)
+		err := os.ScanRow(ro)
+		require.Error(t, err)
+		ro.AssertExpectations(t)
+	})
+
+	t.Run("full fields", func(t *testing.T) {
+		ro := new(RowsMockedObject)
+		curTime := time.Now()
+		ro.On("Values").Return([]any{"test", int32(3), curTime, "timeout", false, curTime}, nil)
+		ro.On("FieldDescriptions").Return([]pgconn.FieldDescription{
+			{Name: "number"},
+			{Name: "attemptcount"},
+			{Name: "nextattemptat"},
+			{Name: "lasterror"},
+			{Name: "parked"},
+			{Name: "uploadedat"},
+		}, nil)
+		os := new(OrderSchedule)
+		err := os.ScanRow(ro)
+		require.NoError(t, err)
+		require.Equal(t, OrderSchedule{
+			Number:        "test",
+			AttemptCount:  3,
+			NextAttemptAt: curTime,
+			LastError:     "timeout",
+			UploadedAt:    curTime,
+		}, *os)
+		ro.AssertExpectations(t)
+	})
+
+	t.Run("null last error", func(t *testing.T) {
+		ro := new(RowsMockedObject)
+		curTime := time.Now()
+		ro.On("Values").Return([]any{"test", int32(0), curTime, nil}, nil)
+		ro.On("FieldDescriptions").Return([]pgconn.FieldDescription{
+			{Name: "number"},
+			{Name: "attemptcount"},
+			{Name: "nextattemptat"},
+			{Name: "lasterror"},
+		}, nil)
+		os := new(OrderSchedule)
+		err := os.ScanRow(ro)
+		require.NoError(t, err)
+		require.Equal(t, OrderSchedule{Number: "test", NextAttemptAt: curTime}, *os)
+		ro.AssertExpectations(t)
+	})
+}
+
 func TestOrder_UnMarshalMarshalJSON(t *testing.T) {
 	t.Run("test unmarshal marshall with number", func(t *testing.T) {
 		curTime := time.Now()
@@ -137,6 +190,13 @@ func TestOrder_UnMarshalMarshalJSON(t *testing.T) {
 		require.JSONEq(t, jsEx, string(r))
 
 	})
+
+	t.Run("test accrual rounded to minor units", func(t *testing.T) {
+		var o Order
+		err := json.Unmarshal([]byte(`{"order": "test", "status": "PROCESSED", "accrual": 500.015}`), &o)
+		require.NoError(t, err)
+		require.Equal(t, Money(50002), *o.Accrual)
+	})
 }
 
 func TestNewOrderBalanceByRequestBody(t *testing.T) {
@@ -149,7 +209,7 @@ func TestNewOrderBalanceByRequestBody(t *testing.T) {
 		ob, err := NewOrderBalanceByRequestBody(body)
 
 		require.NoError(t, err)
-		require.Equal(t, OrderBalance{Order: "2377225624", Sum: 751}, *ob)
+		require.Equal(t, OrderBalance{Order: "2377225624", Sum: 75100}, *ob)
 	})
 
 	t.Run("body json error", func(t *testing.T) {
@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// RefreshToken is a stored refresh token. Only the hash of the token is kept,
+// tokens rotated from the same login share the family.
+type RefreshToken struct {
+	Hash      string
+	Family    string
+	Login     string
+	ExpiresAt time.Time
+}
@@ -6,3 +6,25 @@ const (
 	StatusInvalid    = "INVALID"
 	StatusProcessed  = "PROCESSED"
 )
+
+// IsFinalStatus reports whether the accrual system will not change the order
+// status anymore.
+func IsFinalStatus(status string) bool {
+	return status == StatusInvalid || status == StatusProcessed
+}
+
+// statusRank orders the statuses an order goes through. Keep in sync with the
+// rank in Storage.UpdateOrder.
+var statusRank = map[string]int{
+	StatusNew:        0,
+	StatusProcessing: 1,
+	StatusInvalid:    2,
+	StatusProcessed:  2,
+}
+
+// CanChangeStatus reports whether an order may move from one status to the
+// other. Statuses only move forward, so a late or replayed update never takes
+// an order back and a final status never changes.
+func CanChangeStatus(from, to string) bool {
+	return statusRank[to] > statusRank[from]
+}
@@ -2,6 +2,7 @@ package models
 
 import (
 	"bytes"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -58,7 +59,9 @@ func (u *User) ScanRow(rows pgx.Rows) error {
 		case "password":
 			u.Password = values[i].(string)
 		case "salt":
-			u.Salt = values[i].(string)
+			if salt, ok := values[i].(string); ok {
+				u.Salt = salt
+			}
 		}
 	}
 
@@ -76,22 +79,44 @@ func (u *User) writeFieldsByJSON(j []byte) error {
 }
 
 func (u *User) CheckPassword(password string) error {
-	hashedPwd, err := hasher.GetPasswordHash(password, u.Salt)
+	if u.isLegacyPassword() {
+		hashedPwd, err := hasher.GetPasswordHash(password, u.Salt)
+
+		if err != nil {
+			return err
+		}
+
+		if subtle.ConstantTimeCompare([]byte(hashedPwd), []byte(u.Password)) != 1 {
+			return ErrPWDNotEqual
+		}
+
+		return nil
+	}
+
+	ok, err := hasher.Verify(password, u.Password)
 
 	if err != nil {
 		return err
 	}
 
-	if hashedPwd != u.Password {
+	if !ok {
 		return ErrPWDNotEqual
 	}
 
 	return nil
 }
 
+func (u *User) NeedsRehash() bool {
+	return u.isLegacyPassword() || hasher.NeedsRehash(u.Password)
+}
+
+func (u *User) isLegacyPassword() bool {
+	return u.Salt != ""
+}
+
 type UserBalance struct {
-	Current   float64  `json:"current"`
-	Withdrawn *float64 `json:"withdrawn,omitempty"`
+	Current   Money  `json:"current"`
+	Withdrawn *Money `json:"withdrawn,omitempty"`
 }
 
 func (ub *UserBalance) ScanRow(rows pgx.Rows) error {
@@ -103,11 +128,11 @@ func (ub *UserBalance) ScanRow(rows pgx.Rows) error {
 	for i := range values {
 		switch strings.ToLower(rows.FieldDescriptions()[i].Name) {
 		case "current":
-			ub.Current = values[i].(float64)
+			ub.Current = Money(values[i].(int64))
 		case "withdrawn":
 			wd := values[i]
 			if wd != nil {
-				wd := wd.(float64)
+				wd := Money(wd.(int64))
 				ub.Withdrawn = &wd
 			}
 		}
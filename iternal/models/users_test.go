@@ -104,6 +104,30 @@ func TestUser_CheckPassword(t *testing.T) {
 		u := User{"test", sp.Password, sp.Salt}
 		err = u.CheckPassword("test")
 		require.NoError(t, err)
+		require.True(t, u.NeedsRehash())
+	})
+
+	t.Run("argon2id pwd not equal", func(t *testing.T) {
+		hash, err := hasher.Hash("test")
+		require.NoError(t, err)
+		u := User{Login: "test", Password: hash}
+		err = u.CheckPassword("123")
+		require.Equal(t, ErrPWDNotEqual, err)
+	})
+
+	t.Run("argon2id positive test", func(t *testing.T) {
+		hash, err := hasher.Hash("test")
+		require.NoError(t, err)
+		u := User{Login: "test", Password: hash}
+		err = u.CheckPassword("test")
+		require.NoError(t, err)
+		require.False(t, u.NeedsRehash())
+	})
+
+	t.Run("argon2id broken hash", func(t *testing.T) {
+		u := User{Login: "test", Password: "$argon2id$broken"}
+		err := u.CheckPassword("test")
+		require.Error(t, err)
 	})
 }
 
@@ -119,7 +143,7 @@ func TestUserBalance_ScanRow(t *testing.T) {
 
 	t.Run("positive test no withdrawn", func(t *testing.T) {
 		ro := new(RowsMockedObject)
-		ro.On("Values").Return([]any{float64(1), "test"}, nil)
+		ro.On("Values").Return([]any{int64(100), "test"}, nil)
 		ro.On("FieldDescriptions").Return([]pgconn.FieldDescription{
 			{Name: "current"},
 			{Name: "test"},
@@ -127,14 +151,14 @@ func TestUserBalance_ScanRow(t *testing.T) {
 		ub := new(UserBalance)
 		err := ub.ScanRow(ro)
 		require.NoError(t, err)
-		require.Equal(t, UserBalance{Current: float64(1)}, *ub)
+		require.Equal(t, UserBalance{Current: Money(100)}, *ub)
 		ro.AssertExpectations(t)
 	})
 
 	t.Run("positive test", func(t *testing.T) {
 		ro := new(RowsMockedObject)
-		w := float64(2)
-		ro.On("Values").Return([]any{float64(1), w, "test"}, nil)
+		w := Money(200)
+		ro.On("Values").Return([]any{int64(100), int64(w), "test"}, nil)
 		ro.On("FieldDescriptions").Return([]pgconn.FieldDescription{
 			{Name: "current"},
 			{Name: "withdrawn"},
@@ -143,7 +167,7 @@ func TestUserBalance_ScanRow(t *testing.T) {
 		ub := new(UserBalance)
 		err := ub.ScanRow(ro)
 		require.NoError(t, err)
-		require.Equal(t, UserBalance{Current: float64(1), Withdrawn: &w}, *ub)
+		require.Equal(t, UserBalance{Current: Money(100), Withdrawn: &w}, *ub)
 		ro.AssertExpectations(t)
 	})
 }
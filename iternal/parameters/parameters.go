@@ -2,6 +2,8 @@ package parameters
 
 import (
 	"flag"
+	"fmt"
+	"math"
 	"os"
 	"strconv"
 	"time"
@@ -12,9 +14,35 @@ type Parameters struct {
 	DataBaseURI       string
 	AccrualSystemAddr string
 	SecretKey         string
+	SecretKeys        string
+	SecretKeyActive   string
+	SecretKeyringFile string
 	SecetKeyLife      time.Duration
+	AccessTokenLife   time.Duration
+	RefreshTokenLife  time.Duration
+	TokenSources      string
 	GetInterval       uint
 	WorkerLimit       uint
+	DBMaxConns        uint
+	DBMinConns        uint
+	DBMaxConnIdleTime time.Duration
+	DBHealthCheck     time.Duration
+	Storage           string
+	HashMemory        uint
+	HashIterations    uint
+	HashParallelism   uint
+	RetryBackoffBase  time.Duration
+	RetryBackoffMax   time.Duration
+	RetryMaxAttempts  uint
+	AccrualRateLimit  uint
+	BreakerFailures   uint
+	BreakerTimeout    time.Duration
+	BreakerHalfOpen   uint
+	UnregisteredTTL   time.Duration
+	ShutdownTimeout   time.Duration
+	WebhookSecret     string
+	WebhookTolerance  time.Duration
+	RevocationTTL     time.Duration
 }
 
 func ParseFlags() (p Parameters) {
@@ -26,15 +54,70 @@ func ParseFlags() (p Parameters) {
 		"connection string to database")
 	f.StringVar(&p.AccrualSystemAddr, "r", "http://localhost:8080", "address and port to accrual system")
 	f.StringVar(&p.SecretKey, "k", "secret", "secret key for jwt")
+	f.StringVar(&p.SecretKeys, "ks", "", "jwt keyring as kid:secret,kid:@private.pem, overrides -k")
+	f.StringVar(&p.SecretKeyActive, "ka", "", "kid of the jwt key to sign with, the first one by default")
+	f.StringVar(&p.SecretKeyringFile, "kf", "", "path to jwt keyring file, overrides -k and -ks")
 
 	var skLife uint
-	f.UintVar(&skLife, "kl", 3, "secret key life in hours")
+	f.UintVar(&skLife, "kl", 0, "deprecated, access token life in hours, overrides -atl when set")
+
+	var atLife uint
+	f.UintVar(&atLife, "atl", 15, "access token life in minutes")
+
+	var rtLife uint
+	f.UintVar(&rtLife, "rtl", 720, "refresh token life in hours, the time a login lasts")
+	f.StringVar(&p.TokenSources, "ts", "header,cookie", "where requests carry the access token in order of precedence: header, cookie")
 
 	f.UintVar(&p.GetInterval, "gi", 5, "interval for communicate to accrual system")
 	f.UintVar(&p.WorkerLimit, "wl", 5, "worker limit for communicate to accrual system")
+	f.UintVar(&p.DBMaxConns, "dmax", 0, "max connections in database pool, 0 keeps the database uri value")
+	f.UintVar(&p.DBMinConns, "dmin", 0, "min connections in database pool, 0 keeps the database uri value")
+
+	var dbIdle, dbHealth uint
+	f.UintVar(&dbIdle, "didle", 0, "max idle time of database connection in seconds, 0 keeps the database uri value")
+	f.UintVar(&dbHealth, "dhc", 0, "health check period of database pool in seconds, 0 keeps the database uri value")
+	f.StringVar(&p.Storage, "storage", "postgres", "storage type: postgres or memory")
+	f.UintVar(&p.HashMemory, "hm", 19456, "argon2id memory cost in KiB")
+	f.UintVar(&p.HashIterations, "hi", 2, "argon2id iterations")
+	f.UintVar(&p.HashParallelism, "hp", 1, "argon2id parallelism")
+
+	var rbBase, rbMax uint
+	f.UintVar(&rbBase, "rbb", 5, "base delay between polls of the same order in seconds")
+	f.UintVar(&rbMax, "rbm", 3600, "max delay between polls of the same order in seconds")
+	f.UintVar(&p.RetryMaxAttempts, "rma", 50, "failed polls in a row before an order is parked, 0 is unlimited")
+	f.UintVar(&p.AccrualRateLimit, "rl", 0, "requests per minute to accrual system, 0 means unlimited until it reports a limit")
+	f.UintVar(&p.BreakerFailures, "cbf", 5, "consecutive accrual system failures that open the circuit")
+
+	var cbTimeout uint
+	f.UintVar(&cbTimeout, "cbt", 30, "time the accrual system circuit stays open in seconds")
+	f.UintVar(&p.BreakerHalfOpen, "cbh", 1, "probe requests to accrual system while the circuit is half-open")
+
+	var unregTTL uint
+	f.UintVar(&unregTTL, "ut", 24, "hours after upload an order unknown to accrual system becomes invalid, 0 is never")
+
+	var shutdown uint
+	f.UintVar(&shutdown, "ast", 10, "time to wait for in-flight accrual jobs on shutdown in seconds")
+	f.StringVar(&p.WebhookSecret, "whs", "", "secret signing accrual system webhooks, empty disables the webhook")
+
+	var whTolerance uint
+	f.UintVar(&whTolerance, "wht", 300, "max age of an accrual system webhook in seconds")
+
+	var revocationTTL uint
+	f.UintVar(&revocationTTL, "rct", 5, "time a token is trusted without asking the revocation store in seconds")
 	f.Parse(os.Args[1:])
 
 	p.SecetKeyLife = time.Hour * time.Duration(skLife)
+	p.AccessTokenLife = time.Minute * time.Duration(atLife)
+	p.RefreshTokenLife = time.Hour * time.Duration(rtLife)
+	p.DBMaxConnIdleTime = time.Second * time.Duration(dbIdle)
+	p.DBHealthCheck = time.Second * time.Duration(dbHealth)
+	p.RetryBackoffBase = time.Second * time.Duration(rbBase)
+	p.RetryBackoffMax = time.Second * time.Duration(rbMax)
+	p.BreakerTimeout = time.Second * time.Duration(cbTimeout)
+	p.UnregisteredTTL = time.Hour * time.Duration(unregTTL)
+	p.ShutdownTimeout = time.Second * time.Duration(shutdown)
+	p.WebhookTolerance = time.Second * time.Duration(whTolerance)
+	p.RevocationTTL = time.Second * time.Duration(revocationTTL)
 
 	if envAddr := os.Getenv("RUN_ADDRESS"); envAddr != "" {
 		p.RunAddr = envAddr
@@ -52,6 +135,18 @@ func ParseFlags() (p Parameters) {
 		p.SecretKey = envSK
 	}
 
+	if envSKS := os.Getenv("SECRET_KEYS"); envSKS != "" {
+		p.SecretKeys = envSKS
+	}
+
+	if envSKA := os.Getenv("SECRET_KEY_ACTIVE"); envSKA != "" {
+		p.SecretKeyActive = envSKA
+	}
+
+	if envSKF := os.Getenv("SECRET_KEYRING_FILE"); envSKF != "" {
+		p.SecretKeyringFile = envSKF
+	}
+
 	if envSKL := os.Getenv("SECRET_KEY_LIFE"); envSKL != "" {
 		intSKL, err := strconv.ParseUint(envSKL, 10, 32)
 
@@ -60,6 +155,26 @@ func ParseFlags() (p Parameters) {
 		}
 	}
 
+	if envATL := os.Getenv("ACCESS_TOKEN_LIFE"); envATL != "" {
+		intATL, err := strconv.ParseUint(envATL, 10, 32)
+
+		if err == nil {
+			p.AccessTokenLife = time.Minute * time.Duration(intATL)
+		}
+	}
+
+	if envRTL := os.Getenv("REFRESH_TOKEN_LIFE"); envRTL != "" {
+		intRTL, err := strconv.ParseUint(envRTL, 10, 32)
+
+		if err == nil {
+			p.RefreshTokenLife = time.Hour * time.Duration(intRTL)
+		}
+	}
+
+	if envTS := os.Getenv("TOKEN_SOURCES"); envTS != "" {
+		p.TokenSources = envTS
+	}
+
 	if envGI := os.Getenv("GET_INTERVAL"); envGI != "" {
 		intGI, err := strconv.ParseUint(envGI, 10, 32)
 
@@ -76,5 +191,174 @@ func ParseFlags() (p Parameters) {
 		}
 	}
 
+	if envDMax := os.Getenv("DATABASE_MAX_CONNS"); envDMax != "" {
+		intDMax, err := strconv.ParseUint(envDMax, 10, 32)
+
+		if err == nil {
+			p.DBMaxConns = uint(intDMax)
+		}
+	}
+
+	if envDMin := os.Getenv("DATABASE_MIN_CONNS"); envDMin != "" {
+		intDMin, err := strconv.ParseUint(envDMin, 10, 32)
+
+		if err == nil {
+			p.DBMinConns = uint(intDMin)
+		}
+	}
+
+	if envDIdle := os.Getenv("DATABASE_MAX_CONN_IDLE_TIME"); envDIdle != "" {
+		intDIdle, err := strconv.ParseUint(envDIdle, 10, 32)
+
+		if err == nil {
+			p.DBMaxConnIdleTime = time.Second * time.Duration(intDIdle)
+		}
+	}
+
+	if envDHC := os.Getenv("DATABASE_HEALTH_CHECK"); envDHC != "" {
+		intDHC, err := strconv.ParseUint(envDHC, 10, 32)
+
+		if err == nil {
+			p.DBHealthCheck = time.Second * time.Duration(intDHC)
+		}
+	}
+
+	if envStorage := os.Getenv("STORAGE"); envStorage != "" {
+		p.Storage = envStorage
+	}
+
+	if envHM := os.Getenv("HASH_MEMORY"); envHM != "" {
+		intHM, err := strconv.ParseUint(envHM, 10, 32)
+
+		if err == nil {
+			p.HashMemory = uint(intHM)
+		}
+	}
+
+	if envHI := os.Getenv("HASH_ITERATIONS"); envHI != "" {
+		intHI, err := strconv.ParseUint(envHI, 10, 32)
+
+		if err == nil {
+			p.HashIterations = uint(intHI)
+		}
+	}
+
+	if envHP := os.Getenv("HASH_PARALLELISM"); envHP != "" {
+		intHP, err := strconv.ParseUint(envHP, 10, 8)
+
+		if err == nil {
+			p.HashParallelism = uint(intHP)
+		}
+	}
+
+	if envRBB := os.Getenv("RETRY_BACKOFF_BASE"); envRBB != "" {
+		intRBB, err := strconv.ParseUint(envRBB, 10, 32)
+
+		if err == nil {
+			p.RetryBackoffBase = time.Second * time.Duration(intRBB)
+		}
+	}
+
+	if envRBM := os.Getenv("RETRY_BACKOFF_MAX"); envRBM != "" {
+		intRBM, err := strconv.ParseUint(envRBM, 10, 32)
+
+		if err == nil {
+			p.RetryBackoffMax = time.Second * time.Duration(intRBM)
+		}
+	}
+
+	if envRMA := os.Getenv("RETRY_MAX_ATTEMPTS"); envRMA != "" {
+		intRMA, err := strconv.ParseUint(envRMA, 10, 32)
+
+		if err == nil {
+			p.RetryMaxAttempts = uint(intRMA)
+		}
+	}
+
+	if envRL := os.Getenv("ACCRUAL_RATE_LIMIT"); envRL != "" {
+		intRL, err := strconv.ParseUint(envRL, 10, 32)
+
+		if err == nil {
+			p.AccrualRateLimit = uint(intRL)
+		}
+	}
+
+	if envCBF := os.Getenv("CIRCUIT_BREAKER_FAILURES"); envCBF != "" {
+		intCBF, err := strconv.ParseUint(envCBF, 10, 32)
+
+		if err == nil {
+			p.BreakerFailures = uint(intCBF)
+		}
+	}
+
+	if envCBT := os.Getenv("CIRCUIT_BREAKER_TIMEOUT"); envCBT != "" {
+		intCBT, err := strconv.ParseUint(envCBT, 10, 32)
+
+		if err == nil {
+			p.BreakerTimeout = time.Second * time.Duration(intCBT)
+		}
+	}
+
+	if envCBH := os.Getenv("CIRCUIT_BREAKER_HALF_OPEN"); envCBH != "" {
+		intCBH, err := strconv.ParseUint(envCBH, 10, 32)
+
+		if err == nil {
+			p.BreakerHalfOpen = uint(intCBH)
+		}
+	}
+
+	if envUT := os.Getenv("UNREGISTERED_ORDER_TTL"); envUT != "" {
+		intUT, err := strconv.ParseUint(envUT, 10, 32)
+
+		if err == nil {
+			p.UnregisteredTTL = time.Hour * time.Duration(intUT)
+		}
+	}
+
+	if envAST := os.Getenv("AGENT_SHUTDOWN_TIMEOUT"); envAST != "" {
+		intAST, err := strconv.ParseUint(envAST, 10, 32)
+
+		if err == nil {
+			p.ShutdownTimeout = time.Second * time.Duration(intAST)
+		}
+	}
+
+	if envWHS := os.Getenv("ACCRUAL_WEBHOOK_SECRET"); envWHS != "" {
+		p.WebhookSecret = envWHS
+	}
+
+	if envWHT := os.Getenv("ACCRUAL_WEBHOOK_TOLERANCE"); envWHT != "" {
+		intWHT, err := strconv.ParseUint(envWHT, 10, 32)
+
+		if err == nil {
+			p.WebhookTolerance = time.Second * time.Duration(intWHT)
+		}
+	}
+
+	if envRCT := os.Getenv("TOKEN_REVOCATION_CACHE_TTL"); envRCT != "" {
+		intRCT, err := strconv.ParseUint(envRCT, 10, 32)
+
+		if err == nil {
+			p.RevocationTTL = time.Second * time.Duration(intRCT)
+		}
+	}
+
 	return
 }
+
+// Validate rejects values that do not fit the types they are passed on as.
+func (p Parameters) Validate() error {
+	if p.HashMemory == 0 || p.HashMemory > math.MaxUint32 {
+		return fmt.Errorf("hash memory %d must be in 1..%d", p.HashMemory, uint32(math.MaxUint32))
+	}
+
+	if p.HashIterations == 0 || p.HashIterations > math.MaxUint32 {
+		return fmt.Errorf("hash iterations %d must be in 1..%d", p.HashIterations, uint32(math.MaxUint32))
+	}
+
+	if p.HashParallelism == 0 || p.HashParallelism > math.MaxUint8 {
+		return fmt.Errorf("hash parallelism %d must be in 1..%d", p.HashParallelism, math.MaxUint8)
+	}
+
+	return nil
+}
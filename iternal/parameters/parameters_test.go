@@ -1,6 +1,7 @@
 package parameters
 
 import (
+	"math"
 	"os"
 	"testing"
 	"time"
@@ -17,9 +18,25 @@ func TestParseFlags(t *testing.T) {
 			DataBaseURI:       "host=localhost user=test password=test dbname=loyaltyservice sslmode=disable",
 			AccrualSystemAddr: "http://localhost:8080",
 			SecretKey:         "secret",
-			SecetKeyLife:      time.Hour * 3,
+			AccessTokenLife:   time.Minute * 15,
+			RefreshTokenLife:  time.Hour * 720,
+			TokenSources:      "header,cookie",
 			GetInterval:       5,
 			WorkerLimit:       5,
+			Storage:           "postgres",
+			HashMemory:        19456,
+			HashIterations:    2,
+			HashParallelism:   1,
+			RetryBackoffBase:  time.Second * 5,
+			RetryBackoffMax:   time.Hour,
+			RetryMaxAttempts:  50,
+			BreakerFailures:   5,
+			BreakerTimeout:    time.Second * 30,
+			BreakerHalfOpen:   1,
+			UnregisteredTTL:   time.Hour * 24,
+			ShutdownTimeout:   time.Second * 10,
+			WebhookTolerance:  time.Minute * 5,
+			RevocationTTL:     time.Second * 5,
 		}
 
 		require.Equal(t, dp, p)
@@ -27,7 +44,12 @@ func TestParseFlags(t *testing.T) {
 
 	t.Run("test flags", func(t *testing.T) {
 		os.Args = []string{"test", "-a=testA", "-d=testD",
-			"-r=testR", "-k=testK", "-kl=5", "-gi=1", "-wl=1"}
+			"-r=testR", "-k=testK", "-ks=testKS", "-ka=testKA", "-kf=testKF",
+			"-kl=5", "-atl=7", "-rtl=6", "-ts=cookie", "-gi=1", "-wl=1",
+			"-dmax=3", "-dmin=1", "-didle=10", "-dhc=20", "-storage=memory",
+			"-hm=1024", "-hi=3", "-hp=2", "-rbb=1", "-rbm=60", "-rma=4", "-rl=120",
+			"-cbf=2", "-cbt=10", "-cbh=3", "-ut=48", "-ast=3",
+			"-whs=testWHS", "-wht=60", "-rct=2"}
 		p := ParseFlags()
 
 		dp := Parameters{
@@ -35,9 +57,35 @@ func TestParseFlags(t *testing.T) {
 			DataBaseURI:       "testD",
 			AccrualSystemAddr: "testR",
 			SecretKey:         "testK",
+			SecretKeys:        "testKS",
+			SecretKeyActive:   "testKA",
+			SecretKeyringFile: "testKF",
 			SecetKeyLife:      time.Hour * 5,
+			AccessTokenLife:   time.Minute * 7,
+			RefreshTokenLife:  time.Hour * 6,
+			TokenSources:      "cookie",
 			GetInterval:       1,
 			WorkerLimit:       1,
+			DBMaxConns:        3,
+			DBMinConns:        1,
+			DBMaxConnIdleTime: time.Second * 10,
+			DBHealthCheck:     time.Second * 20,
+			Storage:           "memory",
+			HashMemory:        1024,
+			HashIterations:    3,
+			HashParallelism:   2,
+			RetryBackoffBase:  time.Second,
+			RetryBackoffMax:   time.Minute,
+			RetryMaxAttempts:  4,
+			AccrualRateLimit:  120,
+			BreakerFailures:   2,
+			BreakerTimeout:    time.Second * 10,
+			BreakerHalfOpen:   3,
+			UnregisteredTTL:   time.Hour * 48,
+			ShutdownTimeout:   time.Second * 3,
+			WebhookSecret:     "testWHS",
+			WebhookTolerance:  time.Minute,
+			RevocationTTL:     time.Second * 2,
 		}
 
 		require.Equal(t, dp, p)
@@ -49,9 +97,35 @@ func TestParseFlags(t *testing.T) {
 		os.Setenv("DATABASE_URI", "testD")
 		os.Setenv("ACCRUAL_SYSTEM_ADDRESS", "testR")
 		os.Setenv("SECRET_KEY", "testK")
+		os.Setenv("SECRET_KEYS", "testKS")
+		os.Setenv("SECRET_KEY_ACTIVE", "testKA")
+		os.Setenv("SECRET_KEYRING_FILE", "testKF")
 		os.Setenv("SECRET_KEY_LIFE", "5")
+		os.Setenv("ACCESS_TOKEN_LIFE", "7")
+		os.Setenv("REFRESH_TOKEN_LIFE", "6")
+		os.Setenv("TOKEN_SOURCES", "cookie")
 		os.Setenv("GET_INTERVAL", "1")
 		os.Setenv("WORKER_LIMIT", "1")
+		os.Setenv("DATABASE_MAX_CONNS", "3")
+		os.Setenv("DATABASE_MIN_CONNS", "1")
+		os.Setenv("DATABASE_MAX_CONN_IDLE_TIME", "10")
+		os.Setenv("DATABASE_HEALTH_CHECK", "20")
+		os.Setenv("STORAGE", "memory")
+		os.Setenv("HASH_MEMORY", "1024")
+		os.Setenv("HASH_ITERATIONS", "3")
+		os.Setenv("HASH_PARALLELISM", "2")
+		os.Setenv("RETRY_BACKOFF_BASE", "1")
+		os.Setenv("RETRY_BACKOFF_MAX", "60")
+		os.Setenv("RETRY_MAX_ATTEMPTS", "4")
+		os.Setenv("ACCRUAL_RATE_LIMIT", "120")
+		os.Setenv("CIRCUIT_BREAKER_FAILURES", "2")
+		os.Setenv("CIRCUIT_BREAKER_TIMEOUT", "10")
+		os.Setenv("CIRCUIT_BREAKER_HALF_OPEN", "3")
+		os.Setenv("UNREGISTERED_ORDER_TTL", "48")
+		os.Setenv("AGENT_SHUTDOWN_TIMEOUT", "3")
+		os.Setenv("ACCRUAL_WEBHOOK_SECRET", "testWHS")
+		os.Setenv("ACCRUAL_WEBHOOK_TOLERANCE", "60")
+		os.Setenv("TOKEN_REVOCATION_CACHE_TTL", "2")
 
 		p := ParseFlags()
 
@@ -60,12 +134,54 @@ func TestParseFlags(t *testing.T) {
 			DataBaseURI:       "testD",
 			AccrualSystemAddr: "testR",
 			SecretKey:         "testK",
+			SecretKeys:        "testKS",
+			SecretKeyActive:   "testKA",
+			SecretKeyringFile: "testKF",
 			SecetKeyLife:      time.Hour * 5,
+			AccessTokenLife:   time.Minute * 7,
+			RefreshTokenLife:  time.Hour * 6,
+			TokenSources:      "cookie",
 			GetInterval:       1,
 			WorkerLimit:       1,
+			DBMaxConns:        3,
+			DBMinConns:        1,
+			DBMaxConnIdleTime: time.Second * 10,
+			DBHealthCheck:     time.Second * 20,
+			Storage:           "memory",
+			HashMemory:        1024,
+			HashIterations:    3,
+			HashParallelism:   2,
+			RetryBackoffBase:  time.Second,
+			RetryBackoffMax:   time.Minute,
+			RetryMaxAttempts:  4,
+			AccrualRateLimit:  120,
+			BreakerFailures:   2,
+			BreakerTimeout:    time.Second * 10,
+			BreakerHalfOpen:   3,
+			UnregisteredTTL:   time.Hour * 48,
+			ShutdownTimeout:   time.Second * 3,
+			WebhookSecret:     "testWHS",
+			WebhookTolerance:  time.Minute,
+			RevocationTTL:     time.Second * 2,
 		}
 
 		require.Equal(t, dp, p)
 		os.Clearenv()
 	})
 }
+
+func TestParameters_Validate(t *testing.T) {
+	p := Parameters{HashMemory: 19456, HashIterations: 2, HashParallelism: 1}
+	require.NoError(t, p.Validate())
+
+	for _, bad := range []Parameters{
+		{HashMemory: 0, HashIterations: 2, HashParallelism: 1},
+		{HashMemory: math.MaxUint32 + 1, HashIterations: 2, HashParallelism: 1},
+		{HashMemory: 19456, HashIterations: 0, HashParallelism: 1},
+		{HashMemory: 19456, HashIterations: math.MaxUint32 + 1, HashParallelism: 1},
+		{HashMemory: 19456, HashIterations: 2, HashParallelism: 0},
+		{HashMemory: 19456, HashIterations: 2, HashParallelism: 256},
+	} {
+		require.Error(t, bad.Validate(), "%+v", bad)
+	}
+}
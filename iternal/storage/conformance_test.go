@@ -0,0 +1,748 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Tomap-Tomap/go-loyalty-service/iternal/migrations"
+	"github.com/Tomap-Tomap/go-loyalty-service/iternal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type repository interface {
+	CreateUser(ctx context.Context, u models.User) error
+	GetUser(ctx context.Context, login string) (*models.User, error)
+	UpdatePassword(ctx context.Context, login string, password string) error
+	AddOrder(ctx context.Context, order string, login string) error
+	GetOrders(ctx context.Context, login string, f models.ListFilter) ([]models.Order, error)
+	GetBalance(ctx context.Context, login string) (*models.UserBalance, error)
+	DoWithdrawal(ctx context.Context, login string, ob models.OrderBalance) error
+	GetWithdrawal(ctx context.Context, login string, f models.ListFilter) ([]models.OrderBalance, error)
+	LeaseDueOrders(ctx context.Context, owner string, limit int, ttl time.Duration) ([]models.OrderSchedule, error)
+	ExtendLeases(ctx context.Context, owner string, numbers []string, ttl time.Duration) error
+	ReleaseOrder(ctx context.Context, owner string, number string) error
+	ListenNewOrders(ctx context.Context) (<-chan struct{}, error)
+	ScheduleOrder(ctx context.Context, os models.OrderSchedule) error
+	UpdateOrder(ctx context.Context, o models.Order) error
+	GetOrderHistory(ctx context.Context, number string) ([]models.OrderStatusChange, error)
+	StartIdempotentRequest(ctx context.Context, login, key, fingerprint string) (*models.IdempotentResponse, error)
+	SaveIdempotentResponse(ctx context.Context, login, key string, resp models.IdempotentResponse) error
+	DeleteIdempotentRequest(ctx context.Context, login, key string) error
+	RevokeToken(ctx context.Context, jti, login string, expiresAt time.Time) error
+	RevokeLoginTokens(ctx context.Context, login string, before time.Time) error
+	IsTokenRevoked(ctx context.Context, jti, login string, issuedAt time.Time) (bool, error)
+	CreateRefreshToken(ctx context.Context, rt models.RefreshToken) error
+	RotateRefreshToken(ctx context.Context, hash string, next models.RefreshToken) (*models.RefreshToken, error)
+	RevokeRefreshTokenFamily(ctx context.Context, hash string) error
+	RevokeLoginRefreshTokens(ctx context.Context, login string) error
+}
+
+func TestMemoryStorage_Conformance(t *testing.T) {
+	testRepository(t, func(t *testing.T) repository {
+		return NewMemoryStorage()
+	})
+}
+
+func TestStorage_Conformance(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_URI")
+
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URI is not set")
+	}
+
+	testRepository(t, func(t *testing.T) repository {
+		ctx := context.Background()
+		pool, err := NewPool(ctx, dsn, PoolConfig{MaxConns: 10})
+		require.NoError(t, err)
+		t.Cleanup(pool.Close)
+
+		m, err := migrations.NewMigrator(pool)
+		require.NoError(t, err)
+		require.NoError(t, m.Up(ctx))
+
+		_, err = pool.Exec(ctx, "TRUNCATE refresh_tokens, revoked_tokens, login_revocations, idempotency_keys, order_status_history, balances, orders, users")
+		require.NoError(t, err)
+
+		return NewStorage(pool)
+	})
+}
+
+func testRepository(t *testing.T, newRepo func(t *testing.T) repository) {
+	ctx := context.Background()
+
+	t.Run("users", func(t *testing.T) {
+		r := newRepo(t)
+
+		require.NoError(t, r.CreateUser(ctx, models.User{Login: "user", Password: "pwd"}))
+		require.ErrorIs(t, r.CreateUser(ctx, models.User{Login: "user", Password: "other"}), ErrLoginExist)
+
+		u, err := r.GetUser(ctx, "user")
+		require.NoError(t, err)
+		require.Equal(t, "user", u.Login)
+		require.NoError(t, u.CheckPassword("pwd"))
+		require.ErrorIs(t, u.CheckPassword("other"), models.ErrPWDNotEqual)
+
+		require.False(t, u.NeedsRehash())
+
+		require.NoError(t, r.UpdatePassword(ctx, "user", "new"))
+		u, err = r.GetUser(ctx, "user")
+		require.NoError(t, err)
+		require.NoError(t, u.CheckPassword("new"))
+		require.ErrorIs(t, u.CheckPassword("pwd"), models.ErrPWDNotEqual)
+
+		_, err = r.GetUser(ctx, "unknown")
+		require.ErrorIs(t, err, ErrUserNotFound)
+		require.ErrorIs(t, r.UpdatePassword(ctx, "unknown", "pwd"), ErrUserNotFound)
+		require.ErrorIs(t, r.DoWithdrawal(ctx, "unknown", models.OrderBalance{Order: "2377225624", Sum: 100}), ErrUserNotFound)
+	})
+
+	t.Run("orders", func(t *testing.T) {
+		r := newRepo(t)
+		require.NoError(t, r.CreateUser(ctx, models.User{Login: "first", Password: "pwd"}))
+		require.NoError(t, r.CreateUser(ctx, models.User{Login: "second", Password: "pwd"}))
+
+		require.NoError(t, r.AddOrder(ctx, "12345678903", "first"))
+		require.NoError(t, r.AddOrder(ctx, "2377225624", "first"))
+		require.NoError(t, r.AddOrder(ctx, "9278923470", "first"))
+		require.ErrorIs(t, r.AddOrder(ctx, "12345678903", "first"), ErrIDExistForCurUsr)
+		require.ErrorIs(t, r.AddOrder(ctx, "12345678903", "second"), ErrIDExistForAnotherUsr)
+
+		orders, err := r.GetOrders(ctx, "first", models.ListFilter{})
+		require.NoError(t, err)
+		require.Len(t, orders, 3)
+		require.Equal(t, "12345678903", orders[0].Number)
+		require.Equal(t, models.StatusNew, orders[0].Status)
+		require.Nil(t, orders[0].Accrual)
+		require.NotNil(t, orders[0].UploadedAt)
+
+		orders, err = r.GetOrders(ctx, "second", models.ListFilter{})
+		require.NoError(t, err)
+		require.Empty(t, orders)
+
+		due := leaseAll(t, r)
+		require.ElementsMatch(t, []string{"12345678903", "2377225624", "9278923470"}, dueNumbers(due))
+		require.Zero(t, due[0].AttemptCount)
+
+		accrual := models.Money(72998)
+		require.NoError(t, r.UpdateOrder(ctx, models.Order{Number: "12345678903", Status: models.StatusProcessing}))
+		require.NoError(t, r.UpdateOrder(ctx, models.Order{Number: "2377225624", Status: models.StatusProcessed, Accrual: &accrual}))
+		require.NoError(t, r.UpdateOrder(ctx, models.Order{Number: "9278923470", Status: models.StatusInvalid}))
+
+		due = leaseAll(t, r)
+		require.Equal(t, []string{"12345678903"}, dueNumbers(due))
+
+		orders, err = r.GetOrders(ctx, "first", models.ListFilter{})
+		require.NoError(t, err)
+
+		statuses := make(map[string]models.Order)
+		for _, o := range orders {
+			statuses[o.Number] = o
+		}
+
+		require.Equal(t, models.StatusProcessing, statuses["12345678903"].Status)
+		require.Equal(t, models.StatusProcessed, statuses["2377225624"].Status)
+		require.Equal(t, accrual, *statuses["2377225624"].Accrual)
+		require.Equal(t, models.StatusInvalid, statuses["9278923470"].Status)
+	})
+
+	t.Run("schedule", func(t *testing.T) {
+		r := newRepo(t)
+		require.NoError(t, r.CreateUser(ctx, models.User{Login: "user", Password: "pwd"}))
+		require.NoError(t, r.AddOrder(ctx, "12345678903", "user"))
+		require.NoError(t, r.AddOrder(ctx, "2377225624", "user"))
+		require.NoError(t, r.AddOrder(ctx, "9278923470", "user"))
+
+		orders, err := r.GetOrders(ctx, "user", models.ListFilter{})
+		require.NoError(t, err)
+
+		require.NoError(t, r.ScheduleOrder(ctx, models.OrderSchedule{
+			Number:        "12345678903",
+			AttemptCount:  1,
+			NextAttemptAt: time.Now().Add(time.Hour),
+			LastError:     "timeout",
+		}))
+		require.NoError(t, r.ScheduleOrder(ctx, models.OrderSchedule{
+			Number:        "2377225624",
+			AttemptCount:  10,
+			NextAttemptAt: time.Now().Add(-time.Hour),
+			LastError:     "timeout",
+			Parked:        true,
+		}))
+		require.NoError(t, r.ScheduleOrder(ctx, models.OrderSchedule{
+			Number:        "9278923470",
+			AttemptCount:  2,
+			NextAttemptAt: time.Now().Add(-time.Minute),
+		}))
+
+		due := leaseAll(t, r)
+		require.Len(t, due, 1)
+		require.Equal(t, "9278923470", due[0].Number)
+		require.Equal(t, 2, due[0].AttemptCount)
+		require.False(t, due[0].UploadedAt.IsZero())
+		require.Empty(t, due[0].LastError)
+
+		after, err := r.GetOrders(ctx, "user", models.ListFilter{})
+		require.NoError(t, err)
+		require.Equal(t, orders, after)
+	})
+
+	t.Run("leases", func(t *testing.T) {
+		r := newRepo(t)
+		require.NoError(t, r.CreateUser(ctx, models.User{Login: "user", Password: "pwd"}))
+		require.NoError(t, r.AddOrder(ctx, "12345678903", "user"))
+		require.NoError(t, r.AddOrder(ctx, "2377225624", "user"))
+		require.NoError(t, r.AddOrder(ctx, "9278923470", "user"))
+
+		first, err := r.LeaseDueOrders(ctx, "first", 2, time.Minute)
+		require.NoError(t, err)
+		require.Len(t, first, 2)
+
+		second, err := r.LeaseDueOrders(ctx, "second", 0, time.Minute)
+		require.NoError(t, err)
+		require.Len(t, second, 1)
+		require.NotContains(t, dueNumbers(first), second[0].Number)
+
+		empty, err := r.LeaseDueOrders(ctx, "second", 0, time.Minute)
+		require.NoError(t, err)
+		require.Empty(t, empty)
+
+		require.NoError(t, r.ReleaseOrder(ctx, "second", first[0].Number))
+		empty, err = r.LeaseDueOrders(ctx, "second", 0, time.Minute)
+		require.NoError(t, err)
+		require.Empty(t, empty)
+
+		require.NoError(t, r.ReleaseOrder(ctx, "first", first[0].Number))
+		released, err := r.LeaseDueOrders(ctx, "second", 0, time.Minute)
+		require.NoError(t, err)
+		require.Equal(t, []string{first[0].Number}, dueNumbers(released))
+
+		short, err := r.LeaseDueOrders(ctx, "first", 0, time.Minute)
+		require.NoError(t, err)
+		require.Empty(t, short)
+
+		require.NoError(t, r.ExtendLeases(ctx, "first", []string{first[1].Number}, time.Millisecond))
+		require.NoError(t, r.ExtendLeases(ctx, "second", []string{first[1].Number}, time.Hour))
+		time.Sleep(50 * time.Millisecond)
+
+		expired, err := r.LeaseDueOrders(ctx, "second", 0, time.Minute)
+		require.NoError(t, err)
+		require.Equal(t, []string{first[1].Number}, dueNumbers(expired))
+	})
+
+	t.Run("concurrent leases", func(t *testing.T) {
+		r := newRepo(t)
+		require.NoError(t, r.CreateUser(ctx, models.User{Login: "user", Password: "pwd"}))
+
+		orders := make([]string, 0, 50)
+		for i := 0; i < 50; i++ {
+			order := strconv.Itoa(i)
+			require.NoError(t, r.AddOrder(ctx, order, "user"))
+			orders = append(orders, order)
+		}
+
+		var (
+			mu     sync.Mutex
+			wg     sync.WaitGroup
+			leased = make(map[string]string)
+		)
+
+		for i := 0; i < 10; i++ {
+			owner := "agent" + strconv.Itoa(i)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				for {
+					due, err := r.LeaseDueOrders(ctx, owner, 3, time.Minute)
+
+					if !assert.NoError(t, err) || len(due) == 0 {
+						return
+					}
+
+					mu.Lock()
+					for _, os := range due {
+						if prev, ok := leased[os.Number]; ok {
+							t.Errorf("order %s leased by %s and %s", os.Number, prev, owner)
+						}
+
+						leased[os.Number] = owner
+					}
+					mu.Unlock()
+				}
+			}()
+		}
+
+		wg.Wait()
+		require.ElementsMatch(t, orders, keys(leased))
+	})
+
+	t.Run("new order notifications", func(t *testing.T) {
+		r := newRepo(t)
+		require.NoError(t, r.CreateUser(ctx, models.User{Login: "user", Password: "pwd"}))
+
+		lctx, cancel := context.WithCancel(ctx)
+		wake, err := r.ListenNewOrders(lctx)
+		require.NoError(t, err)
+
+		require.NoError(t, r.AddOrder(ctx, "12345678903", "user"))
+
+		select {
+		case <-wake:
+		case <-time.After(5 * time.Second):
+			t.Fatal("no notification about new order")
+		}
+
+		require.ErrorIs(t, r.AddOrder(ctx, "12345678903", "user"), ErrIDExistForCurUsr)
+
+		cancel()
+		require.Eventually(t, func() bool {
+			select {
+			case _, ok := <-wake:
+				return !ok
+			default:
+				return false
+			}
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("status history", func(t *testing.T) {
+		r := newRepo(t)
+		require.NoError(t, r.CreateUser(ctx, models.User{Login: "user", Password: "pwd"}))
+		require.NoError(t, r.AddOrder(ctx, "12345678903", "user"))
+
+		accrual := models.Money(50000)
+		require.NoError(t, r.UpdateOrder(ctx, models.Order{Number: "12345678903", Status: models.StatusNew}))
+		for i := 0; i < 3; i++ {
+			require.NoError(t, r.UpdateOrder(ctx, models.Order{Number: "12345678903", Status: models.StatusProcessing}))
+		}
+		require.NoError(t, r.UpdateOrder(ctx, models.Order{Number: "12345678903", Status: models.StatusNew}))
+
+		b, err := r.GetBalance(ctx, "user")
+		require.NoError(t, err)
+		require.Equal(t, models.Money(0), b.Current)
+
+		require.NoError(t, r.UpdateOrder(ctx, models.Order{Number: "12345678903", Status: models.StatusProcessed, Accrual: &accrual}))
+		require.NoError(t, r.UpdateOrder(ctx, models.Order{Number: "12345678903", Status: models.StatusProcessed, Accrual: &accrual}))
+		require.NoError(t, r.UpdateOrder(ctx, models.Order{Number: "12345678903", Status: models.StatusInvalid}))
+
+		b, err = r.GetBalance(ctx, "user")
+		require.NoError(t, err)
+		require.Equal(t, accrual, b.Current)
+
+		orders, err := r.GetOrders(ctx, "user", models.ListFilter{})
+		require.NoError(t, err)
+		require.Len(t, orders, 1)
+		require.Equal(t, models.StatusProcessed, orders[0].Status)
+		require.Equal(t, accrual, *orders[0].Accrual)
+
+		history, err := r.GetOrderHistory(ctx, "12345678903")
+		require.NoError(t, err)
+
+		statuses := make([]string, 0, len(history))
+		for _, c := range history {
+			statuses = append(statuses, c.Status)
+			require.False(t, c.ChangedAt.IsZero())
+		}
+
+		require.Equal(t, []string{models.StatusNew, models.StatusProcessing, models.StatusProcessed}, statuses)
+
+		require.NoError(t, r.AddOrder(ctx, "2377225624", "user"))
+		zero := models.Money(0)
+		require.NoError(t, r.UpdateOrder(ctx, models.Order{Number: "2377225624", Status: models.StatusProcessed, Accrual: &zero}))
+
+		orders, err = r.GetOrders(ctx, "user", models.ListFilter{})
+		require.NoError(t, err)
+		require.Len(t, orders, 2)
+	})
+
+	t.Run("balance", func(t *testing.T) {
+		r := newRepo(t)
+		require.NoError(t, r.CreateUser(ctx, models.User{Login: "user", Password: "pwd"}))
+
+		b, err := r.GetBalance(ctx, "user")
+		require.NoError(t, err)
+		require.Equal(t, models.UserBalance{}, *b)
+
+		err = r.DoWithdrawal(ctx, "user", models.OrderBalance{Order: "2377225624", Sum: 100})
+		require.ErrorIs(t, err, ErrInsufficientFunds)
+
+		accrual := models.Money(72998)
+		require.NoError(t, r.AddOrder(ctx, "12345678903", "user"))
+		require.NoError(t, r.UpdateOrder(ctx, models.Order{Number: "12345678903", Status: models.StatusProcessed, Accrual: &accrual}))
+
+		err = r.DoWithdrawal(ctx, "user", models.OrderBalance{Order: "2377225624", Sum: 80000})
+		require.ErrorIs(t, err, ErrInsufficientFunds)
+		require.NoError(t, r.DoWithdrawal(ctx, "user", models.OrderBalance{Order: "2377225624", Sum: 10001}))
+
+		b, err = r.GetBalance(ctx, "user")
+		require.NoError(t, err)
+		require.Equal(t, models.Money(62997), b.Current)
+		require.Equal(t, models.Money(10001), *b.Withdrawn)
+
+		err = r.DoWithdrawal(ctx, "user", models.OrderBalance{Order: "2377225624", Sum: 10001})
+		require.ErrorIs(t, err, ErrWithdrawalExist)
+		err = r.DoWithdrawal(ctx, "user", models.OrderBalance{Order: "2377225624", Sum: 100})
+		require.ErrorIs(t, err, ErrWithdrawalConflict)
+
+		require.NoError(t, r.CreateUser(ctx, models.User{Login: "other", Password: "pwd"}))
+		err = r.DoWithdrawal(ctx, "other", models.OrderBalance{Order: "2377225624", Sum: 10001})
+		require.ErrorIs(t, err, ErrWithdrawalConflict)
+
+		wd, err := r.GetWithdrawal(ctx, "user", models.ListFilter{})
+		require.NoError(t, err)
+		require.Len(t, wd, 1)
+		require.Equal(t, "2377225624", wd[0].Order)
+		require.Equal(t, models.Money(10001), wd[0].Sum)
+		require.NotNil(t, wd[0].ProcessedAt)
+	})
+
+	t.Run("pagination", func(t *testing.T) {
+		r := newRepo(t)
+		require.NoError(t, r.CreateUser(ctx, models.User{Login: "user", Password: "pwd"}))
+
+		numbers := []string{"12345678903", "2377225624", "9278923470", "4561261212345467", "79927398713"}
+		for _, n := range numbers {
+			require.NoError(t, r.AddOrder(ctx, n, "user"))
+		}
+
+		accrual := models.Money(10000)
+		require.NoError(t, r.UpdateOrder(ctx, models.Order{Number: "79927398713", Status: models.StatusProcessed, Accrual: &accrual}))
+
+		all, err := r.GetOrders(ctx, "user", models.ListFilter{})
+		require.NoError(t, err)
+		require.Len(t, all, len(numbers))
+
+		collect := func(f models.ListFilter) []string {
+			got := make([]string, 0)
+
+			for {
+				page, err := r.GetOrders(ctx, "user", f)
+				require.NoError(t, err)
+				require.LessOrEqual(t, len(page), f.Limit)
+
+				for _, o := range page {
+					got = append(got, o.Number)
+				}
+
+				if len(page) < f.Limit {
+					return got
+				}
+
+				last := page[len(page)-1]
+				f.Cursor = &models.Cursor{Time: *last.UploadedAt, Key: last.Number}
+			}
+		}
+
+		asc := make([]string, 0, len(all))
+		for _, o := range all {
+			asc = append(asc, o.Number)
+		}
+
+		desc := slices.Clone(asc)
+		slices.Reverse(desc)
+
+		require.Equal(t, asc, collect(models.ListFilter{Limit: 2}))
+		require.Equal(t, desc, collect(models.ListFilter{Limit: 2, Desc: true}))
+
+		processed, err := r.GetOrders(ctx, "user", models.ListFilter{Statuses: []string{models.StatusProcessed}})
+		require.NoError(t, err)
+		require.Len(t, processed, 1)
+		require.Equal(t, "79927398713", processed[0].Number)
+
+		past := time.Now().Add(-time.Hour)
+		old, err := r.GetOrders(ctx, "user", models.ListFilter{To: &past})
+		require.NoError(t, err)
+		require.Empty(t, old)
+
+		recent, err := r.GetOrders(ctx, "user", models.ListFilter{From: &past})
+		require.NoError(t, err)
+		require.Len(t, recent, len(numbers))
+
+		require.NoError(t, r.DoWithdrawal(ctx, "user", models.OrderBalance{Order: "2377225624", Sum: 100}))
+		require.NoError(t, r.DoWithdrawal(ctx, "user", models.OrderBalance{Order: "12345678903", Sum: 100}))
+		require.NoError(t, r.DoWithdrawal(ctx, "user", models.OrderBalance{Order: "9278923470", Sum: 100}))
+
+		first, err := r.GetWithdrawal(ctx, "user", models.ListFilter{Limit: 2})
+		require.NoError(t, err)
+		require.Len(t, first, 2)
+
+		last := first[len(first)-1]
+		second, err := r.GetWithdrawal(ctx, "user", models.ListFilter{
+			Limit:  2,
+			Cursor: &models.Cursor{Time: *last.ProcessedAt, Key: last.Order},
+		})
+		require.NoError(t, err)
+		require.Len(t, second, 1)
+		require.NotContains(t, []string{first[0].Order, first[1].Order}, second[0].Order)
+	})
+
+	t.Run("pagination with status changes", func(t *testing.T) {
+		r := newRepo(t)
+		require.NoError(t, r.CreateUser(ctx, models.User{Login: "user", Password: "pwd"}))
+
+		for _, n := range []string{"12345678903", "2377225624", "9278923470", "4561261212345467", "79927398713"} {
+			require.NoError(t, r.AddOrder(ctx, n, "user"))
+		}
+
+		all, err := r.GetOrders(ctx, "user", models.ListFilter{})
+		require.NoError(t, err)
+
+		for i, status := range []string{models.StatusProcessing, models.StatusInvalid} {
+			desc := i == 1
+			want := make([]string, 0, len(all))
+			for _, o := range all {
+				want = append(want, o.Number)
+			}
+
+			if desc {
+				slices.Reverse(want)
+			}
+
+			f := models.ListFilter{Limit: 2, Desc: desc}
+			first, err := r.GetOrders(ctx, "user", f)
+			require.NoError(t, err)
+			require.Len(t, first, 2)
+
+			// One order already seen and one not fetched yet change status
+			// between the pages.
+			require.NoError(t, r.UpdateOrder(ctx, models.Order{Number: want[0], Status: status}))
+			require.NoError(t, r.UpdateOrder(ctx, models.Order{Number: want[len(want)-1], Status: status}))
+
+			got := []string{first[0].Number, first[1].Number}
+			last := first[1]
+
+			for {
+				f.Cursor = &models.Cursor{Time: *last.UploadedAt, Key: last.Number}
+				page, err := r.GetOrders(ctx, "user", f)
+				require.NoError(t, err)
+
+				for _, o := range page {
+					got = append(got, o.Number)
+				}
+
+				if len(page) < f.Limit {
+					break
+				}
+
+				last = page[len(page)-1]
+			}
+
+			require.Equal(t, want, got)
+		}
+
+		after, err := r.GetOrders(ctx, "user", models.ListFilter{})
+		require.NoError(t, err)
+		require.Len(t, after, len(all))
+
+		for i := range all {
+			require.Equal(t, all[i].Number, after[i].Number)
+			require.True(t, all[i].UploadedAt.Equal(*after[i].UploadedAt))
+		}
+	})
+
+	t.Run("token revocation", func(t *testing.T) {
+		r := newRepo(t)
+		require.NoError(t, r.CreateUser(ctx, models.User{Login: "user", Password: "pwd"}))
+		require.NoError(t, r.CreateUser(ctx, models.User{Login: "other", Password: "pwd"}))
+
+		issued := time.Now().Add(-time.Minute).Truncate(time.Second)
+
+		revoked, err := r.IsTokenRevoked(ctx, "first", "user", issued)
+		require.NoError(t, err)
+		require.False(t, revoked)
+
+		require.NoError(t, r.RevokeToken(ctx, "first", "user", time.Now().Add(time.Hour)))
+		require.NoError(t, r.RevokeToken(ctx, "first", "user", time.Now().Add(time.Hour)))
+
+		revoked, err = r.IsTokenRevoked(ctx, "first", "user", issued)
+		require.NoError(t, err)
+		require.True(t, revoked)
+
+		revoked, err = r.IsTokenRevoked(ctx, "second", "user", issued)
+		require.NoError(t, err)
+		require.False(t, revoked)
+
+		require.NoError(t, r.RevokeLoginTokens(ctx, "user", issued))
+		require.NoError(t, r.RevokeLoginTokens(ctx, "user", issued.Add(-time.Hour)))
+
+		for _, tt := range []struct {
+			login    string
+			issuedAt time.Time
+			revoked  bool
+		}{
+			{"user", issued.Add(-time.Second), true},
+			{"user", issued.Add(-time.Millisecond), true},
+			{"user", issued, false},
+			{"user", issued.Add(time.Millisecond), false},
+			{"other", issued, false},
+		} {
+			revoked, err = r.IsTokenRevoked(ctx, "second", tt.login, tt.issuedAt)
+			require.NoError(t, err)
+			assert.Equal(t, tt.revoked, revoked, "%s issued at %s", tt.login, tt.issuedAt)
+		}
+	})
+
+	t.Run("refresh tokens", func(t *testing.T) {
+		r := newRepo(t)
+		require.NoError(t, r.CreateUser(ctx, models.User{Login: "user", Password: "pwd"}))
+
+		exp := time.Now().Add(time.Hour)
+		rt := func(hash string) models.RefreshToken {
+			return models.RefreshToken{Hash: hash, ExpiresAt: exp}
+		}
+
+		require.NoError(t, r.CreateRefreshToken(ctx, models.RefreshToken{Hash: "a1", Family: "a", Login: "user", ExpiresAt: exp}))
+		require.NoError(t, r.CreateRefreshToken(ctx, models.RefreshToken{Hash: "b1", Family: "b", Login: "user", ExpiresAt: exp}))
+		require.NoError(t, r.CreateRefreshToken(ctx, models.RefreshToken{
+			Hash: "old", Family: "c", Login: "user", ExpiresAt: time.Now().Add(-time.Minute),
+		}))
+
+		next, err := r.RotateRefreshToken(ctx, "a1", rt("a2"))
+		require.NoError(t, err)
+		require.Equal(t, models.RefreshToken{Hash: "a2", Family: "a", Login: "user", ExpiresAt: exp}, *next)
+
+		_, err = r.RotateRefreshToken(ctx, "unknown", rt("x"))
+		require.ErrorIs(t, err, ErrRefreshTokenInvalid)
+
+		_, err = r.RotateRefreshToken(ctx, "old", rt("x"))
+		require.ErrorIs(t, err, ErrRefreshTokenInvalid)
+
+		// Reusing a rotated token revokes the family, the other one is intact.
+		_, err = r.RotateRefreshToken(ctx, "a1", rt("a3"))
+		require.ErrorIs(t, err, ErrRefreshTokenReused)
+
+		_, err = r.RotateRefreshToken(ctx, "a2", rt("a3"))
+		require.ErrorIs(t, err, ErrRefreshTokenInvalid)
+
+		next, err = r.RotateRefreshToken(ctx, "b1", rt("b2"))
+		require.NoError(t, err)
+		require.Equal(t, "b", next.Family)
+
+		require.NoError(t, r.RevokeRefreshTokenFamily(ctx, "b1"))
+		_, err = r.RotateRefreshToken(ctx, "b2", rt("b3"))
+		require.ErrorIs(t, err, ErrRefreshTokenInvalid)
+
+		require.NoError(t, r.CreateRefreshToken(ctx, models.RefreshToken{Hash: "d1", Family: "d", Login: "user", ExpiresAt: exp}))
+		require.NoError(t, r.RevokeLoginRefreshTokens(ctx, "user"))
+		_, err = r.RotateRefreshToken(ctx, "d1", rt("d2"))
+		require.ErrorIs(t, err, ErrRefreshTokenInvalid)
+	})
+
+	t.Run("idempotency", func(t *testing.T) {
+		r := newRepo(t)
+		require.NoError(t, r.CreateUser(ctx, models.User{Login: "user", Password: "pwd"}))
+		require.NoError(t, r.CreateUser(ctx, models.User{Login: "other", Password: "pwd"}))
+
+		stored, err := r.StartIdempotentRequest(ctx, "user", "key", "fp")
+		require.NoError(t, err)
+		require.Nil(t, stored)
+
+		_, err = r.StartIdempotentRequest(ctx, "user", "key", "fp")
+		require.ErrorIs(t, err, ErrIdempotencyInProgress)
+
+		stored, err = r.StartIdempotentRequest(ctx, "other", "key", "fp")
+		require.NoError(t, err)
+		require.Nil(t, stored)
+
+		resp := models.IdempotentResponse{StatusCode: 202, ContentType: "text/plain", Body: []byte("ok")}
+		require.NoError(t, r.SaveIdempotentResponse(ctx, "user", "key", resp))
+
+		stored, err = r.StartIdempotentRequest(ctx, "user", "key", "fp")
+		require.NoError(t, err)
+		require.Equal(t, resp, *stored)
+
+		_, err = r.StartIdempotentRequest(ctx, "user", "key", "another")
+		require.ErrorIs(t, err, ErrIdempotencyMismatch)
+
+		require.NoError(t, r.DeleteIdempotentRequest(ctx, "user", "key"))
+		stored, err = r.StartIdempotentRequest(ctx, "user", "key", "fp")
+		require.NoError(t, err)
+		require.Equal(t, resp, *stored)
+
+		require.NoError(t, r.DeleteIdempotentRequest(ctx, "other", "key"))
+		stored, err = r.StartIdempotentRequest(ctx, "other", "key", "fp")
+		require.NoError(t, err)
+		require.Nil(t, stored)
+	})
+
+	t.Run("parallel withdrawals", func(t *testing.T) {
+		r := newRepo(t)
+		require.NoError(t, r.CreateUser(ctx, models.User{Login: "user", Password: "pwd"}))
+
+		accrual := models.Money(1000)
+		require.NoError(t, r.AddOrder(ctx, "12345678903", "user"))
+		require.NoError(t, r.UpdateOrder(ctx, models.Order{Number: "12345678903", Status: models.StatusProcessed, Accrual: &accrual}))
+
+		var (
+			wg        sync.WaitGroup
+			mu        sync.Mutex
+			succeeded int
+		)
+
+		for i := 0; i < 20; i++ {
+			order := strconv.Itoa(i)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := r.DoWithdrawal(ctx, "user", models.OrderBalance{Order: order, Sum: 100})
+
+				if err == nil {
+					mu.Lock()
+					succeeded++
+					mu.Unlock()
+					return
+				}
+
+				if !errors.Is(err, ErrInsufficientFunds) {
+					t.Errorf("unexpected error: %v", err)
+				}
+			}()
+		}
+
+		wg.Wait()
+		require.Equal(t, 10, succeeded)
+
+		b, err := r.GetBalance(ctx, "user")
+		require.NoError(t, err)
+		require.Equal(t, models.Money(0), b.Current)
+	})
+}
+
+func dueNumbers(due []models.OrderSchedule) []string {
+	numbers := make([]string, 0, len(due))
+
+	for _, os := range due {
+		numbers = append(numbers, os.Number)
+	}
+
+	return numbers
+}
+
+func leaseAll(t *testing.T, r repository) []models.OrderSchedule {
+	ctx := context.Background()
+	due, err := r.LeaseDueOrders(ctx, "test", 0, time.Minute)
+	require.NoError(t, err)
+
+	for _, os := range due {
+		require.NoError(t, r.ReleaseOrder(ctx, "test", os.Number))
+	}
+
+	return due
+}
+
+func keys(m map[string]string) []string {
+	k := make([]string, 0, len(m))
+
+	for key := range m {
+		k = append(k, key)
+	}
+
+	return k
+}
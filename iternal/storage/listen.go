@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Tomap-Tomap/go-loyalty-service/iternal/logger"
+	"github.com/jackc/pgx/v5"
+	"go.uber.org/zap"
+)
+
+const (
+	newOrdersChannel = "new_orders"
+	listenRetryMin   = 100 * time.Millisecond
+	listenRetryMax   = 10 * time.Second
+)
+
+// ListenNewOrders subscribes to the orders added by any instance. The
+// returned channel gets a signal after new orders appear and after the
+// listen connection is restored, since notifications may be lost while it
+// is down. The channel is closed when ctx is done.
+func (s *Storage) ListenNewOrders(ctx context.Context) (<-chan struct{}, error) {
+	conn, err := s.listen(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	wake := make(chan struct{}, 1)
+
+	go func() {
+		defer close(wake)
+
+		delay := listenRetryMin
+
+		for {
+			err := waitNotifications(ctx, conn, wake)
+			conn.Close(context.Background())
+
+			if ctx.Err() != nil {
+				return
+			}
+
+			logger.Log.Warn("Listen connection lost", zap.Error(err))
+
+			for {
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+					return
+				}
+
+				conn, err = s.listen(ctx)
+
+				if err == nil {
+					break
+				}
+
+				logger.Log.Warn("Restore listen connection", zap.Error(err))
+				delay = min(delay*2, listenRetryMax)
+			}
+
+			logger.Log.Info("Listen connection restored")
+			delay = listenRetryMin
+			notify(wake)
+		}
+	}()
+
+	return wake, nil
+}
+
+func (s *Storage) listen(ctx context.Context) (*pgx.Conn, error) {
+	conn, err := pgx.ConnectConfig(ctx, s.pool.Config().ConnConfig)
+
+	if err != nil {
+		return nil, fmt.Errorf("connect for listen: %w", err)
+	}
+
+	if _, err := conn.Exec(ctx, "LISTEN "+newOrdersChannel); err != nil {
+		conn.Close(context.Background())
+		return nil, fmt.Errorf("listen %s: %w", newOrdersChannel, err)
+	}
+
+	return conn, nil
+}
+
+func waitNotifications(ctx context.Context, conn *pgx.Conn, wake chan<- struct{}) error {
+	for {
+		if _, err := conn.WaitForNotification(ctx); err != nil {
+			return err
+		}
+
+		notify(wake)
+	}
+}
+
+// notify signals the channel without blocking, a pending signal is enough
+// to wake the listener up.
+func notify(wake chan<- struct{}) {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
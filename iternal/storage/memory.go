@@ -0,0 +1,604 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Tomap-Tomap/go-loyalty-service/iternal/hasher"
+	"github.com/Tomap-Tomap/go-loyalty-service/iternal/models"
+)
+
+type memoryOrder struct {
+	number     string
+	login      string
+	status     string
+	uploadedAt time.Time
+	schedule   models.OrderSchedule
+	history    []models.OrderStatusChange
+	leaseOwner string
+	leaseUntil time.Time
+}
+
+type memoryBalance struct {
+	login       string
+	order       string
+	processedAt time.Time
+	sum         models.Money
+}
+
+type memoryIdempotency struct {
+	fingerprint string
+	response    *models.IdempotentResponse
+	createdAt   time.Time
+}
+
+type memoryRefreshToken struct {
+	token   models.RefreshToken
+	used    bool
+	revoked bool
+}
+
+type MemoryStorage struct {
+	mu          sync.Mutex
+	users       map[string]models.User
+	orders      map[string]*memoryOrder
+	balances    []memoryBalance
+	idempotency map[[2]string]*memoryIdempotency
+	listeners   []chan struct{}
+	revoked     map[string]time.Time
+	revokedFrom map[string]time.Time
+	refresh     map[string]*memoryRefreshToken
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		users:       make(map[string]models.User),
+		orders:      make(map[string]*memoryOrder),
+		idempotency: make(map[[2]string]*memoryIdempotency),
+		revoked:     make(map[string]time.Time),
+		revokedFrom: make(map[string]time.Time),
+		refresh:     make(map[string]*memoryRefreshToken),
+	}
+}
+
+func (ms *MemoryStorage) CreateUser(ctx context.Context, u models.User) error {
+	hash, err := hasher.Hash(u.Password)
+
+	if err != nil {
+		return fmt.Errorf("generate password hash: %w", err)
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.users[u.Login]; ok {
+		return ErrLoginExist
+	}
+
+	ms.users[u.Login] = models.User{Login: u.Login, Password: hash}
+
+	return nil
+}
+
+func (ms *MemoryStorage) UpdatePassword(ctx context.Context, login string, password string) error {
+	hash, err := hasher.Hash(password)
+
+	if err != nil {
+		return fmt.Errorf("generate password hash: %w", err)
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.users[login]; !ok {
+		return fmt.Errorf("update password %s: %w", login, ErrUserNotFound)
+	}
+
+	ms.users[login] = models.User{Login: login, Password: hash}
+
+	return nil
+}
+
+func (ms *MemoryStorage) GetUser(ctx context.Context, login string) (*models.User, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	u, ok := ms.users[login]
+
+	if !ok {
+		return nil, fmt.Errorf("get user %s: %w", login, ErrUserNotFound)
+	}
+
+	return &u, nil
+}
+
+func (ms *MemoryStorage) AddOrder(ctx context.Context, order string, login string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if o, ok := ms.orders[order]; ok {
+		if o.login == login {
+			return ErrIDExistForCurUsr
+		}
+
+		return ErrIDExistForAnotherUsr
+	}
+
+	if _, ok := ms.users[login]; !ok {
+		return fmt.Errorf("add order %s: %w", order, ErrUserNotFound)
+	}
+
+	ms.orders[order] = &memoryOrder{
+		number:     order,
+		login:      login,
+		status:     models.StatusNew,
+		uploadedAt: time.Now(),
+		schedule:   models.OrderSchedule{Number: order, NextAttemptAt: time.Now()},
+		history:    []models.OrderStatusChange{{Status: models.StatusNew, ChangedAt: time.Now()}},
+	}
+
+	for _, l := range ms.listeners {
+		notify(l)
+	}
+
+	return nil
+}
+
+func (ms *MemoryStorage) GetOrders(ctx context.Context, login string, f models.ListFilter) ([]models.Order, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	orders := make([]models.Order, 0)
+	sorted := ms.sortedOrders()
+
+	if f.Desc {
+		slices.Reverse(sorted)
+	}
+
+	for _, o := range sorted {
+		if o.login != login || !f.Match(o.uploadedAt, o.number, o.status) {
+			continue
+		}
+
+		if f.Limit > 0 && len(orders) == f.Limit {
+			break
+		}
+
+		uploadedAt := o.uploadedAt
+		order := models.Order{Number: o.number, Status: o.status, UploadedAt: &uploadedAt}
+
+		for _, b := range ms.balances {
+			if b.order == o.number && b.sum > 0 {
+				accrual := b.sum
+				order.Accrual = &accrual
+				break
+			}
+		}
+
+		orders = append(orders, order)
+	}
+
+	return orders, nil
+}
+
+func (ms *MemoryStorage) GetBalance(ctx context.Context, login string) (*models.UserBalance, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	var b models.UserBalance
+
+	for _, mb := range ms.balances {
+		if mb.login != login {
+			continue
+		}
+
+		b.Current += mb.sum
+
+		if mb.sum < 0 {
+			if b.Withdrawn == nil {
+				b.Withdrawn = new(models.Money)
+			}
+
+			*b.Withdrawn -= mb.sum
+		}
+	}
+
+	return &b, nil
+}
+
+func (ms *MemoryStorage) DoWithdrawal(ctx context.Context, login string, ob models.OrderBalance) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.users[login]; !ok {
+		return fmt.Errorf("withdrawal for %s: %w", login, ErrUserNotFound)
+	}
+
+	for _, b := range ms.balances {
+		if b.order == ob.Order && b.sum < 0 {
+			return existingWithdrawal(login, ob, b.login, -b.sum)
+		}
+	}
+
+	var total models.Money
+	for _, b := range ms.balances {
+		if b.login == login {
+			total += b.sum
+		}
+	}
+
+	if total-ob.Sum < 0 {
+		return ErrInsufficientFunds
+	}
+
+	ms.balances = append(ms.balances, memoryBalance{
+		login:       login,
+		order:       ob.Order,
+		processedAt: time.Now(),
+		sum:         -ob.Sum,
+	})
+
+	return nil
+}
+
+func (ms *MemoryStorage) GetWithdrawal(ctx context.Context, login string, f models.ListFilter) ([]models.OrderBalance, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	orderBalance := make([]models.OrderBalance, 0)
+
+	for _, b := range ms.balances {
+		if b.login != login || b.sum >= 0 || !f.Match(b.processedAt, b.order, "") {
+			continue
+		}
+
+		processedAt := b.processedAt
+		orderBalance = append(orderBalance, models.OrderBalance{
+			Order:       b.order,
+			Sum:         -b.sum,
+			ProcessedAt: &processedAt,
+		})
+	}
+
+	sort.SliceStable(orderBalance, func(i, j int) bool {
+		l, r := orderBalance[i], orderBalance[j]
+
+		if f.Desc {
+			l, r = r, l
+		}
+
+		if l.ProcessedAt.Equal(*r.ProcessedAt) {
+			return l.Order < r.Order
+		}
+
+		return l.ProcessedAt.Before(*r.ProcessedAt)
+	})
+
+	if f.Limit > 0 && len(orderBalance) > f.Limit {
+		orderBalance = orderBalance[:f.Limit]
+	}
+
+	return orderBalance, nil
+}
+
+func (ms *MemoryStorage) LeaseDueOrders(ctx context.Context, owner string, limit int, ttl time.Duration) ([]models.OrderSchedule, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	due := make([]*memoryOrder, 0)
+	now := time.Now()
+
+	for _, o := range ms.sortedOrders() {
+		if models.IsFinalStatus(o.status) {
+			continue
+		}
+
+		if o.schedule.Parked || o.schedule.NextAttemptAt.After(now) || o.leaseUntil.After(now) {
+			continue
+		}
+
+		due = append(due, o)
+	}
+
+	sort.SliceStable(due, func(i, j int) bool {
+		return due[i].schedule.NextAttemptAt.Before(due[j].schedule.NextAttemptAt)
+	})
+
+	if limit > 0 && len(due) > limit {
+		due = due[:limit]
+	}
+
+	schedules := make([]models.OrderSchedule, 0, len(due))
+
+	for _, o := range due {
+		o.leaseOwner = owner
+		o.leaseUntil = now.Add(ttl)
+
+		s := o.schedule
+		s.UploadedAt = o.uploadedAt
+		schedules = append(schedules, s)
+	}
+
+	return schedules, nil
+}
+
+func (ms *MemoryStorage) ExtendLeases(ctx context.Context, owner string, numbers []string, ttl time.Duration) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for _, n := range numbers {
+		if o, ok := ms.orders[n]; ok && o.leaseOwner == owner {
+			o.leaseUntil = time.Now().Add(ttl)
+		}
+	}
+
+	return nil
+}
+
+func (ms *MemoryStorage) ReleaseOrder(ctx context.Context, owner string, number string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if o, ok := ms.orders[number]; ok && o.leaseOwner == owner {
+		o.leaseOwner = ""
+		o.leaseUntil = time.Time{}
+	}
+
+	return nil
+}
+
+func (ms *MemoryStorage) ScheduleOrder(ctx context.Context, os models.OrderSchedule) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if mo, ok := ms.orders[os.Number]; ok {
+		mo.schedule = os
+	}
+
+	return nil
+}
+
+func (ms *MemoryStorage) UpdateOrder(ctx context.Context, o models.Order) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	mo, ok := ms.orders[o.Number]
+
+	if !ok || !models.CanChangeStatus(mo.status, o.Status) {
+		return nil
+	}
+
+	mo.status = o.Status
+	mo.history = append(mo.history, models.OrderStatusChange{Status: o.Status, ChangedAt: time.Now()})
+
+	if o.Status == models.StatusProcessed && o.Accrual != nil && *o.Accrual > 0 {
+		ms.balances = append(ms.balances, memoryBalance{
+			login:       mo.login,
+			order:       mo.number,
+			processedAt: time.Now(),
+			sum:         *o.Accrual,
+		})
+	}
+
+	return nil
+}
+
+func (ms *MemoryStorage) GetOrderHistory(ctx context.Context, number string) ([]models.OrderStatusChange, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	mo, ok := ms.orders[number]
+
+	if !ok {
+		return []models.OrderStatusChange{}, nil
+	}
+
+	return slices.Clone(mo.history), nil
+}
+
+func (ms *MemoryStorage) StartIdempotentRequest(ctx context.Context, login, key, fingerprint string) (*models.IdempotentResponse, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	id := [2]string{login, key}
+	mi, ok := ms.idempotency[id]
+
+	if !ok || time.Since(mi.createdAt) > idempotencyTTL {
+		ms.idempotency[id] = &memoryIdempotency{fingerprint: fingerprint, createdAt: time.Now()}
+		return nil, nil
+	}
+
+	if mi.fingerprint != fingerprint {
+		return nil, ErrIdempotencyMismatch
+	}
+
+	if mi.response == nil {
+		return nil, ErrIdempotencyInProgress
+	}
+
+	resp := *mi.response
+	return &resp, nil
+}
+
+func (ms *MemoryStorage) SaveIdempotentResponse(ctx context.Context, login, key string, resp models.IdempotentResponse) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if mi, ok := ms.idempotency[[2]string{login, key}]; ok {
+		mi.response = &resp
+	}
+
+	return nil
+}
+
+func (ms *MemoryStorage) DeleteIdempotentRequest(ctx context.Context, login, key string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	id := [2]string{login, key}
+
+	if mi, ok := ms.idempotency[id]; ok && mi.response == nil {
+		delete(ms.idempotency, id)
+	}
+
+	return nil
+}
+
+func (ms *MemoryStorage) RevokeToken(ctx context.Context, jti, login string, expiresAt time.Time) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := time.Now()
+
+	for id, exp := range ms.revoked {
+		if exp.Before(now) {
+			delete(ms.revoked, id)
+		}
+	}
+
+	if _, ok := ms.revoked[jti]; !ok {
+		ms.revoked[jti] = expiresAt
+	}
+
+	return nil
+}
+
+func (ms *MemoryStorage) RevokeLoginTokens(ctx context.Context, login string, before time.Time) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if before.After(ms.revokedFrom[login]) {
+		ms.revokedFrom[login] = before
+	}
+
+	return nil
+}
+
+func (ms *MemoryStorage) IsTokenRevoked(ctx context.Context, jti, login string, issuedAt time.Time) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.revoked[jti]; ok {
+		return true, nil
+	}
+
+	before, ok := ms.revokedFrom[login]
+
+	return ok && issuedAt.Before(before), nil
+}
+
+func (ms *MemoryStorage) CreateRefreshToken(ctx context.Context, rt models.RefreshToken) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := time.Now()
+
+	for hash, mr := range ms.refresh {
+		if mr.token.ExpiresAt.Before(now) {
+			delete(ms.refresh, hash)
+		}
+	}
+
+	ms.refresh[rt.Hash] = &memoryRefreshToken{token: rt}
+
+	return nil
+}
+
+func (ms *MemoryStorage) RotateRefreshToken(ctx context.Context, hash string, next models.RefreshToken) (*models.RefreshToken, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	mr, ok := ms.refresh[hash]
+
+	if !ok || mr.revoked || mr.token.ExpiresAt.Before(time.Now()) {
+		return nil, ErrRefreshTokenInvalid
+	}
+
+	if mr.used {
+		ms.revokeRefreshFamily(mr.token.Family)
+		return nil, ErrRefreshTokenReused
+	}
+
+	mr.used = true
+	next.Family = mr.token.Family
+	next.Login = mr.token.Login
+	ms.refresh[next.Hash] = &memoryRefreshToken{token: next}
+
+	return &next, nil
+}
+
+func (ms *MemoryStorage) RevokeRefreshTokenFamily(ctx context.Context, hash string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if mr, ok := ms.refresh[hash]; ok {
+		ms.revokeRefreshFamily(mr.token.Family)
+	}
+
+	return nil
+}
+
+func (ms *MemoryStorage) RevokeLoginRefreshTokens(ctx context.Context, login string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for _, mr := range ms.refresh {
+		if mr.token.Login == login {
+			mr.revoked = true
+		}
+	}
+
+	return nil
+}
+
+func (ms *MemoryStorage) revokeRefreshFamily(family string) {
+	for _, mr := range ms.refresh {
+		if mr.token.Family == family {
+			mr.revoked = true
+		}
+	}
+}
+
+func (ms *MemoryStorage) ListenNewOrders(ctx context.Context) (<-chan struct{}, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	wake := make(chan struct{}, 1)
+	ms.listeners = append(ms.listeners, wake)
+
+	go func() {
+		<-ctx.Done()
+
+		ms.mu.Lock()
+		defer ms.mu.Unlock()
+
+		ms.listeners = slices.DeleteFunc(ms.listeners, func(l chan struct{}) bool {
+			return l == wake
+		})
+		close(wake)
+	}()
+
+	return wake, nil
+}
+
+func (ms *MemoryStorage) sortedOrders() []*memoryOrder {
+	orders := make([]*memoryOrder, 0, len(ms.orders))
+
+	for _, o := range ms.orders {
+		orders = append(orders, o)
+	}
+
+	sort.Slice(orders, func(i, j int) bool {
+		if orders[i].uploadedAt.Equal(orders[j].uploadedAt) {
+			return orders[i].number < orders[j].number
+		}
+
+		return orders[i].uploadedAt.Before(orders[j].uploadedAt)
+	})
+
+	return orders
+}
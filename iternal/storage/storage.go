@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/Tomap-Tomap/go-loyalty-service/iternal/hasher"
@@ -11,11 +12,22 @@ import (
 	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 var ErrIDExistForCurUsr error = fmt.Errorf("id exist for current user")
 var ErrIDExistForAnotherUsr error = fmt.Errorf("id exist for another user")
 var ErrInsufficientFunds error = fmt.Errorf("insufficient funds")
+var ErrLoginExist error = fmt.Errorf("login exist")
+var ErrUserNotFound error = fmt.Errorf("user not found")
+var ErrWithdrawalExist error = fmt.Errorf("withdrawal for order already done")
+var ErrWithdrawalConflict error = fmt.Errorf("order already used for another withdrawal")
+var ErrIdempotencyInProgress error = fmt.Errorf("request with this idempotency key is in progress")
+var ErrIdempotencyMismatch error = fmt.Errorf("idempotency key used for another request")
+var ErrRefreshTokenInvalid error = fmt.Errorf("refresh token is invalid")
+var ErrRefreshTokenReused error = fmt.Errorf("refresh token is already used")
+
+const idempotencyTTL = 24 * time.Hour
 
 type retryPolicy struct {
 	retryCount int
@@ -23,149 +35,107 @@ type retryPolicy struct {
 	increment  int
 }
 
-type Storage struct {
-	conn        *pgx.Conn
-	retryPolicy retryPolicy
+type PoolConfig struct {
+	MaxConns          int32
+	MinConns          int32
+	MaxConnIdleTime   time.Duration
+	HealthCheckPeriod time.Duration
 }
 
-func NewStorage(conn *pgx.Conn) (*Storage, error) {
-	rp := retryPolicy{3, 1, 2}
-	s := &Storage{conn: conn, retryPolicy: rp}
+func NewPool(ctx context.Context, dsn string, pc PoolConfig) (*pgxpool.Pool, error) {
+	cfg, err := newPoolConfig(dsn, pc)
 
-	if err := s.createTables(); err != nil {
-		return nil, fmt.Errorf("create tables in database: %w", err)
+	if err != nil {
+		return nil, err
 	}
 
-	return s, nil
-}
-
-func (s *Storage) createTables() error {
-	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Second)
-	defer cancel()
+	pool, err := pgxpool.NewWithConfig(ctx, cfg)
 
-	createUserQuery := `
-		CREATE TABLE IF NOT EXISTS users (
-			Login VARCHAR(150) PRIMARY KEY,
-			Password CHAR(64),
-			Salt VARCHAR(150)
-		);
-	`
+	if err != nil {
+		return nil, fmt.Errorf("create pool: %w", err)
+	}
 
-	createStatusQuery := `
-		CREATE TABLE IF NOT EXISTS statuses (
-			Name VARCHAR(50) PRIMARY KEY
-		);
-		INSERT INTO statuses VALUES ('NEW'), ('PROCESSING'), ('INVALID'), ('PROCESSED')
-			ON CONFLICT (Name) DO NOTHING;
-	`
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("ping database: %w", err)
+	}
 
-	createOrdersQuery := `
-		CREATE TABLE IF NOT EXISTS orders (
-			Number VARCHAR(150) PRIMARY KEY,
-			Login VARCHAR(150) REFERENCES users(Login),
-			Status VARCHAR(50) REFERENCES statuses(Name),
-			UploadedAt TIMESTAMP WITH TIME ZONE
-		);
-		CREATE INDEX IF NOT EXISTS uploaded_at_idx ON orders (UploadedAt);
-		CREATE OR REPLACE FUNCTION orders_stamp() RETURNS trigger AS $orders_stamp$
-			BEGIN
-				NEW.UploadedAt := current_timestamp;
-				RETURN NEW;
-			END;
-		$orders_stamp$ LANGUAGE plpgsql;
-		CREATE OR REPLACE TRIGGER orders_stamp BEFORE INSERT OR UPDATE ON orders
-			FOR EACH ROW EXECUTE PROCEDURE orders_stamp();
-	`
+	return pool, nil
+}
 
-	createBalanceQuery := `
-		CREATE TABLE IF NOT EXISTS balances (
-			Login VARCHAR(150) REFERENCES users(Login),
-			Order_number VARCHAR(150),
-			ProcessedAt TIMESTAMP WITH TIME ZONE,
-			Sum DOUBLE PRECISION
-		);
-		CREATE INDEX IF NOT EXISTS processed_at_idx ON balances (ProcessedAt);
-		CREATE INDEX IF NOT EXISTS order_number_idx ON balances (Order_number);
-		CREATE OR REPLACE FUNCTION balances_stamp() RETURNS trigger AS $balances_stamp$
-			DECLARE
-				total_balance DOUBLE PRECISION;
-			BEGIN
-				SELECT Sum INTO total_balance FROM balances WHERE Login = NEW.Login FOR UPDATE;
-
-				IF (total_balance IS NULL AND NEW.SUM < 0) OR (SELECT SUM(Sum) FROM balances WHERE Login = NEW.Login) + NEW.SUM < 0 THEN
-					RAISE EXCEPTION 'insufficient funds';
-				END IF;	
-
-				NEW.ProcessedAt := current_timestamp;
-				RETURN NEW;
-			END;
-		$balances_stamp$ LANGUAGE plpgsql;
-		CREATE OR REPLACE TRIGGER balances_stamp BEFORE INSERT OR UPDATE ON balances
-			FOR EACH ROW EXECUTE PROCEDURE balances_stamp();
-	`
-	err := pgx.BeginFunc(ctx, s.conn, func(tx pgx.Tx) error {
-		_, err := retry2(ctx, s.retryPolicy, func() (pgconn.CommandTag, error) {
-			return s.conn.Exec(ctx, createUserQuery)
-		})
+func newPoolConfig(dsn string, pc PoolConfig) (*pgxpool.Config, error) {
+	cfg, err := pgxpool.ParseConfig(dsn)
 
-		if err != nil {
-			return fmt.Errorf("create users table: %w", err)
-		}
+	if err != nil {
+		return nil, fmt.Errorf("parse database uri: %w", err)
+	}
 
-		_, err = retry2(ctx, s.retryPolicy, func() (pgconn.CommandTag, error) {
-			return s.conn.Exec(ctx, createStatusQuery)
-		})
+	if pc.MaxConns > 0 {
+		cfg.MaxConns = pc.MaxConns
+	}
 
-		if err != nil {
-			return fmt.Errorf("create statuses table: %w", err)
-		}
+	if pc.MinConns > 0 {
+		cfg.MinConns = pc.MinConns
+	}
 
-		_, err = retry2(ctx, s.retryPolicy, func() (pgconn.CommandTag, error) {
-			return s.conn.Exec(ctx, createOrdersQuery)
-		})
+	if cfg.MinConns > cfg.MaxConns {
+		return nil, fmt.Errorf("min connections %d greater than max connections %d", cfg.MinConns, cfg.MaxConns)
+	}
 
-		if err != nil {
-			return fmt.Errorf("create orders table: %w", err)
-		}
+	if pc.MaxConnIdleTime > 0 {
+		cfg.MaxConnIdleTime = pc.MaxConnIdleTime
+	}
 
-		_, err = retry2(ctx, s.retryPolicy, func() (pgconn.CommandTag, error) {
-			return s.conn.Exec(ctx, createBalanceQuery)
-		})
+	if pc.HealthCheckPeriod > 0 {
+		cfg.HealthCheckPeriod = pc.HealthCheckPeriod
+	}
 
-		if err != nil {
-			return fmt.Errorf("create balances table: %w", err)
-		}
+	return cfg, nil
+}
 
-		return nil
-	})
+type Storage struct {
+	pool        *pgxpool.Pool
+	retryPolicy retryPolicy
+}
 
-	return err
+func NewStorage(pool *pgxpool.Pool) *Storage {
+	rp := retryPolicy{3, 1, 2}
+	return &Storage{pool: pool, retryPolicy: rp}
 }
 
 func (s *Storage) CreateUser(ctx context.Context, u models.User) error {
 	query := `
-		INSERT INTO users (Login, Password, Salt) VALUES ($1, $2, $3);
+		INSERT INTO users (Login, Password) VALUES ($1, $2);
 	`
 
-	sp, err := hasher.NewSaltPassword(u.Password)
+	hash, err := hasher.Hash(u.Password)
 
 	if err != nil {
 		return fmt.Errorf("generate password hash: %w", err)
 	}
 
 	_, err = retry2(ctx, s.retryPolicy, func() (pgconn.CommandTag, error) {
-		return s.conn.Exec(ctx, query, u.Login, sp.Password, sp.Salt)
+		return s.pool.Exec(ctx, query, u.Login, hash)
 	})
 
+	var tError *pgconn.PgError
+	if errors.As(err, &tError) && tError.Code == pgerrcode.UniqueViolation {
+		return ErrLoginExist
+	}
+
 	return err
 }
 
 func (s *Storage) GetUser(ctx context.Context, login string) (*models.User, error) {
 	u := &models.User{}
 	err := retry(ctx, s.retryPolicy, func() error {
-		return s.conn.QueryRow(ctx, "SELECT Login, Password, Salt FROM users WHERE Login = $1", login).Scan(u)
+		return s.pool.QueryRow(ctx, "SELECT Login, Password, Salt FROM users WHERE Login = $1", login).Scan(u)
 	})
 
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("get user %s: %w", login, ErrUserNotFound)
+	}
+
 	if err != nil {
 		return nil, fmt.Errorf("get user %s: %w", login, err)
 	}
@@ -173,21 +143,51 @@ func (s *Storage) GetUser(ctx context.Context, login string) (*models.User, erro
 	return u, nil
 }
 
+func (s *Storage) UpdatePassword(ctx context.Context, login string, password string) error {
+	query := `
+		UPDATE users SET Password = $1, Salt = NULL WHERE Login = $2;
+	`
+
+	hash, err := hasher.Hash(password)
+
+	if err != nil {
+		return fmt.Errorf("generate password hash: %w", err)
+	}
+
+	tag, err := retry2(ctx, s.retryPolicy, func() (pgconn.CommandTag, error) {
+		return s.pool.Exec(ctx, query, hash, login)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("update password %s: %w", login, ErrUserNotFound)
+	}
+
+	return nil
+}
+
 func (s *Storage) AddOrder(ctx context.Context, order string, login string) error {
 	query := `
-		INSERT INTO orders (Number, Login, Status)
-			VALUES ($1, $2, $3)
+		WITH o AS (
+			INSERT INTO orders (Number, Login, Status)
+				VALUES ($1, $2, $3)
+				RETURNING Number
+		)
+		SELECT pg_notify($4, Number) FROM o
 	`
 
 	_, err := retry2(ctx, s.retryPolicy, func() (pgconn.CommandTag, error) {
-		return s.conn.Exec(ctx, query, order, login, models.StatusNew)
+		return s.pool.Exec(ctx, query, order, login, models.StatusNew, newOrdersChannel)
 	})
 
 	var tError *pgconn.PgError
 	if errors.As(err, &tError) && tError.Code == pgerrcode.UniqueViolation {
 		var l string
 		err := retry(ctx, s.retryPolicy, func() error {
-			return s.conn.QueryRow(ctx, "SELECT Login FROM orders WHERE Number = $1", order).Scan(&l)
+			return s.pool.QueryRow(ctx, "SELECT Login FROM orders WHERE Number = $1", order).Scan(&l)
 		})
 
 		if err != nil {
@@ -204,15 +204,17 @@ func (s *Storage) AddOrder(ctx context.Context, order string, login string) erro
 	return err
 }
 
-func (s *Storage) GetOrders(ctx context.Context, login string) ([]models.Order, error) {
+func (s *Storage) GetOrders(ctx context.Context, login string, f models.ListFilter) ([]models.Order, error) {
 	query := `
 		SELECT o.number, b.sum as accrual, o.uploadedat, o.status FROM orders as o
 		LEFT JOIN balances as b ON o.number = b.Order_number AND b.sum > 0
 		WHERE o.Login = $1
-		ORDER BY UploadedAt;
 	`
+	clause, args := listClause(f, "o.uploadedat", "o.number", "o.status", []any{login})
+	query += clause
+
 	orders, err := retry2(ctx, s.retryPolicy, func() ([]models.Order, error) {
-		rows, err := s.conn.Query(ctx, query, login)
+		rows, err := s.pool.Query(ctx, query, args...)
 
 		if err != nil {
 			return nil, err
@@ -233,7 +235,7 @@ func (s *Storage) GetOrders(ctx context.Context, login string) ([]models.Order,
 			orders = append(orders, o)
 		}
 
-		return orders, nil
+		return orders, rows.Err()
 	})
 
 	return orders, err
@@ -243,17 +245,17 @@ func (s *Storage) GetBalance(ctx context.Context, login string) (*models.UserBal
 	query := `
 		SELECT cur_sum.Current, withdrawn_sum.Withdrawn
 			FROM (
-				SELECT Login, SUM(Sum) as Current
+				SELECT Login, SUM(Sum)::BIGINT as Current
 					FROM balances WHERE Login = $1 GROUP BY Login
 			) as cur_sum
 			LEFT JOIN (
-				SELECT Login, SUM(-Sum) as Withdrawn
+				SELECT Login, SUM(-Sum)::BIGINT as Withdrawn
 					FROM balances WHERE Sum < 0 AND LOGIN = $1 GROUP BY Login
 			) as withdrawn_sum ON cur_sum.Login = withdrawn_sum.Login;
 	`
 	var b models.UserBalance
 	err := retry(ctx, s.retryPolicy, func() error {
-		return s.conn.QueryRow(ctx, query, login).Scan(&b)
+		return s.pool.QueryRow(ctx, query, login).Scan(&b)
 	})
 
 	if errors.Is(err, pgx.ErrNoRows) {
@@ -264,12 +266,43 @@ func (s *Storage) GetBalance(ctx context.Context, login string) (*models.UserBal
 }
 
 func (s *Storage) DoWithdrawal(ctx context.Context, login string, ob models.OrderBalance) error {
+	queryLock := `
+		SELECT Login FROM users WHERE Login = $1 FOR UPDATE
+	`
+	queryExist := `
+		SELECT Login, -Sum FROM balances WHERE Order_number = $1 AND Sum < 0
+	`
 	queryBalances := `
 		INSERT INTO balances (Login, Order_number, Sum)
 			VALUES ($1, $2, $3)
 	`
-	_, err := retry2(ctx, s.retryPolicy, func() (pgconn.CommandTag, error) {
-		return s.conn.Exec(ctx, queryBalances, login, ob.Order, -ob.Sum)
+	err := retry(ctx, s.retryPolicy, func() error {
+		return pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+			var l string
+			err := tx.QueryRow(ctx, queryLock, login).Scan(&l)
+
+			if errors.Is(err, pgx.ErrNoRows) {
+				return fmt.Errorf("withdrawal for %s: %w", login, ErrUserNotFound)
+			}
+
+			if err != nil {
+				return err
+			}
+
+			var sum int64
+			err = tx.QueryRow(ctx, queryExist, ob.Order).Scan(&l, &sum)
+
+			if err == nil {
+				return existingWithdrawal(login, ob, l, models.Money(sum))
+			}
+
+			if !errors.Is(err, pgx.ErrNoRows) {
+				return err
+			}
+
+			_, err = tx.Exec(ctx, queryBalances, login, ob.Order, -ob.Sum)
+			return err
+		})
 	})
 
 	var tError *pgconn.PgError
@@ -277,17 +310,31 @@ func (s *Storage) DoWithdrawal(ctx context.Context, login string, ob models.Orde
 		return ErrInsufficientFunds
 	}
 
+	if errors.As(err, &tError) && tError.Code == pgerrcode.UniqueViolation {
+		return ErrWithdrawalConflict
+	}
+
 	return err
 }
 
-func (s *Storage) GetWithdrawal(ctx context.Context, login string) ([]models.OrderBalance, error) {
+func existingWithdrawal(login string, ob models.OrderBalance, existLogin string, existSum models.Money) error {
+	if existLogin == login && existSum == ob.Sum {
+		return ErrWithdrawalExist
+	}
+
+	return ErrWithdrawalConflict
+}
+
+func (s *Storage) GetWithdrawal(ctx context.Context, login string, f models.ListFilter) ([]models.OrderBalance, error) {
 	query := `
 		SELECT order_number as order, -sum as sum, processedat FROM balances
 		WHERE Login = $1 AND sum < 0
-		ORDER BY processedat
 	`
+	clause, args := listClause(f, "processedat", "order_number", "", []any{login})
+	query += clause
+
 	orderBalance, err := retry2(ctx, s.retryPolicy, func() ([]models.OrderBalance, error) {
-		rows, err := s.conn.Query(ctx, query, login)
+		rows, err := s.pool.Query(ctx, query, args...)
 
 		if err != nil {
 			return nil, err
@@ -308,71 +355,475 @@ func (s *Storage) GetWithdrawal(ctx context.Context, login string) ([]models.Ord
 			orderBalance = append(orderBalance, ob)
 		}
 
-		return orderBalance, nil
+		return orderBalance, rows.Err()
 	})
 
 	return orderBalance, err
 }
 
-func (s *Storage) GetNotProcessedOrders(ctx context.Context) ([]string, error) {
+// LeaseDueOrders atomically leases up to limit due orders to the owner for
+// ttl, skipping orders leased by other owners. Zero limit leases all of them.
+func (s *Storage) LeaseDueOrders(ctx context.Context, owner string, limit int, ttl time.Duration) ([]models.OrderSchedule, error) {
 	query := `
-		SELECT
-			number
-		FROM
-			orders
-		WHERE
-			status NOT IN ($1, $2)
-		ORDER BY
-			uploadedat;
+		WITH due AS (
+			SELECT
+				number
+			FROM
+				orders
+			WHERE
+				status NOT IN ($1, $2) AND parkedat IS NULL AND nextattemptat <= current_timestamp
+				AND (leaseexpiresat IS NULL OR leaseexpiresat <= current_timestamp)
+			ORDER BY
+				nextattemptat, uploadedat
+			LIMIT NULLIF($3, 0)
+			FOR UPDATE SKIP LOCKED
+		)
+		UPDATE orders AS o
+		SET leaseowner = $4, leaseexpiresat = current_timestamp + $5 * interval '1 millisecond'
+		FROM due
+		WHERE o.number = due.number
+		RETURNING o.number, o.attemptcount, o.nextattemptat, o.lasterror, o.uploadedat;
 	`
 
-	numbers, err := retry2(ctx, s.retryPolicy, func() ([]string, error) {
-		rows, err := s.conn.Query(ctx, query, models.StatusInvalid, models.StatusProcessed)
+	schedules, err := retry2(ctx, s.retryPolicy, func() ([]models.OrderSchedule, error) {
+		rows, err := s.pool.Query(ctx, query, models.StatusInvalid, models.StatusProcessed, limit, owner, ttl.Milliseconds())
 
 		if err != nil {
 			return nil, err
 		}
 
-		numbers := make([]string, 0)
+		schedules := make([]models.OrderSchedule, 0)
 
 		defer rows.Close()
 
 		for rows.Next() {
-			var n string
-			err := rows.Scan(&n)
+			var os models.OrderSchedule
+			err := rows.Scan(&os)
 
 			if err != nil {
 				return nil, err
 			}
 
-			numbers = append(numbers, n)
+			schedules = append(schedules, os)
 		}
 
-		return numbers, nil
+		return schedules, rows.Err()
+	})
+
+	return schedules, err
+}
+
+// ExtendLeases prolongs the leases the owner still holds on the orders.
+func (s *Storage) ExtendLeases(ctx context.Context, owner string, numbers []string, ttl time.Duration) error {
+	query := `
+		UPDATE orders
+		SET leaseexpiresat = current_timestamp + $3 * interval '1 millisecond'
+		WHERE number = ANY($2) AND leaseowner = $1
+	`
+
+	_, err := retry2(ctx, s.retryPolicy, func() (pgconn.CommandTag, error) {
+		return s.pool.Exec(ctx, query, owner, numbers, ttl.Milliseconds())
 	})
 
-	return numbers, err
+	return err
 }
 
+// ReleaseOrder drops the lease the owner holds on the order.
+func (s *Storage) ReleaseOrder(ctx context.Context, owner string, number string) error {
+	query := `
+		UPDATE orders
+		SET leaseowner = NULL, leaseexpiresat = NULL
+		WHERE number = $2 AND leaseowner = $1
+	`
+
+	_, err := retry2(ctx, s.retryPolicy, func() (pgconn.CommandTag, error) {
+		return s.pool.Exec(ctx, query, owner, number)
+	})
+
+	return err
+}
+
+// ScheduleOrder stores the polling state of the order.
+func (s *Storage) ScheduleOrder(ctx context.Context, os models.OrderSchedule) error {
+	query := `
+		UPDATE orders
+		SET nextattemptat = $2, attemptcount = $3, lasterror = NULLIF($4, ''),
+			parkedat = CASE WHEN $5 THEN current_timestamp END
+		WHERE number = $1
+	`
+
+	_, err := retry2(ctx, s.retryPolicy, func() (pgconn.CommandTag, error) {
+		return s.pool.Exec(ctx, query, os.Number, os.NextAttemptAt, os.AttemptCount, os.LastError, os.Parked)
+	})
+
+	return err
+}
+
+// UpdateOrder moves the order to the new status and credits the accrual once
+// the order is processed. Orders in a final status and updates that do not
+// change the status are left untouched.
 func (s *Storage) UpdateOrder(ctx context.Context, o models.Order) error {
+	// Statuses only move forward, the rank follows models.CanChangeStatus.
+	queryUpdate := `
+		UPDATE orders
+		SET status = $1
+		WHERE number = $2 AND
+			CASE status WHEN $3 THEN 0 WHEN $4 THEN 1 ELSE 2 END <
+			CASE $1::VARCHAR WHEN $3 THEN 0 WHEN $4 THEN 1 ELSE 2 END
+		RETURNING login
+	`
+	queryCredit := `
+		INSERT INTO balances (login, order_number, sum)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (order_number) WHERE sum > 0 DO NOTHING
+	`
+
+	return retry(ctx, s.retryPolicy, func() error {
+		return pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+			var login string
+			err := tx.QueryRow(ctx, queryUpdate, o.Status, o.Number, models.StatusNew, models.StatusProcessing).Scan(&login)
+
+			if errors.Is(err, pgx.ErrNoRows) {
+				return nil
+			}
+
+			if err != nil {
+				return err
+			}
+
+			if o.Status != models.StatusProcessed || o.Accrual == nil || *o.Accrual <= 0 {
+				return nil
+			}
+
+			_, err = tx.Exec(ctx, queryCredit, login, o.Number, *o.Accrual)
+			return err
+		})
+	})
+}
+
+// GetOrderHistory returns the statuses the order went through, oldest first.
+func (s *Storage) GetOrderHistory(ctx context.Context, number string) ([]models.OrderStatusChange, error) {
 	query := `
-		WITH t AS (
-			UPDATE orders
-			SET status = $1
-			WHERE number = $2
-			RETURNING *
+		SELECT status, changedat FROM order_status_history
+		WHERE order_number = $1
+		ORDER BY changedat, id
+	`
+
+	return retry2(ctx, s.retryPolicy, func() ([]models.OrderStatusChange, error) {
+		rows, err := s.pool.Query(ctx, query, number)
+
+		if err != nil {
+			return nil, err
+		}
+
+		history := make([]models.OrderStatusChange, 0)
+
+		defer rows.Close()
+
+		for rows.Next() {
+			var c models.OrderStatusChange
+			err := rows.Scan(&c.Status, &c.ChangedAt)
+
+			if err != nil {
+				return nil, err
+			}
+
+			history = append(history, c)
+		}
+
+		return history, rows.Err()
+	})
+}
+
+func (s *Storage) StartIdempotentRequest(ctx context.Context, login, key, fingerprint string) (*models.IdempotentResponse, error) {
+	queryStart := `
+		INSERT INTO idempotency_keys (Login, Key, Fingerprint) VALUES ($1, $2, $3)
+			ON CONFLICT (Login, Key) DO UPDATE
+			SET Fingerprint = EXCLUDED.Fingerprint, StatusCode = NULL, ContentType = NULL,
+				Body = NULL, CreatedAt = current_timestamp
+			WHERE idempotency_keys.CreatedAt < $4
+			RETURNING Key
+	`
+	queryGet := `
+		SELECT Fingerprint, StatusCode, ContentType, Body FROM idempotency_keys
+			WHERE Login = $1 AND Key = $2
+	`
+
+	return retry2(ctx, s.retryPolicy, func() (*models.IdempotentResponse, error) {
+		var k string
+		err := s.pool.QueryRow(ctx, queryStart, login, key, fingerprint, time.Now().Add(-idempotencyTTL)).Scan(&k)
+
+		if err == nil {
+			return nil, nil
+		}
+
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return nil, err
+		}
+
+		var (
+			fp          string
+			statusCode  *int32
+			contentType *string
+			body        []byte
 		)
-		INSERT INTO balances (login, order_number, sum)
-		SELECT t.login, t.number, $3 FROM t;
+
+		err = s.pool.QueryRow(ctx, queryGet, login, key).Scan(&fp, &statusCode, &contentType, &body)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return storedResponse(fingerprint, fp, statusCode, contentType, body)
+	})
+}
+
+func (s *Storage) SaveIdempotentResponse(ctx context.Context, login, key string, resp models.IdempotentResponse) error {
+	query := `
+		UPDATE idempotency_keys SET StatusCode = $1, ContentType = $2, Body = $3
+			WHERE Login = $4 AND Key = $5
+	`
+
+	_, err := retry2(ctx, s.retryPolicy, func() (pgconn.CommandTag, error) {
+		return s.pool.Exec(ctx, query, resp.StatusCode, resp.ContentType, resp.Body, login, key)
+	})
+
+	return err
+}
+
+func (s *Storage) DeleteIdempotentRequest(ctx context.Context, login, key string) error {
+	query := `
+		DELETE FROM idempotency_keys WHERE Login = $1 AND Key = $2 AND StatusCode IS NULL
+	`
+
+	_, err := retry2(ctx, s.retryPolicy, func() (pgconn.CommandTag, error) {
+		return s.pool.Exec(ctx, query, login, key)
+	})
+
+	return err
+}
+
+// RevokeToken revokes the token with the given id until it expires and drops
+// the revocations of the tokens that have expired already.
+func (s *Storage) RevokeToken(ctx context.Context, jti, login string, expiresAt time.Time) error {
+	query := `
+		WITH expired AS (
+			DELETE FROM revoked_tokens WHERE ExpiresAt < now()
+		)
+		INSERT INTO revoked_tokens (Jti, Login, ExpiresAt) VALUES ($1, $2, $3)
+			ON CONFLICT (Jti) DO NOTHING
+	`
+
+	_, err := retry2(ctx, s.retryPolicy, func() (pgconn.CommandTag, error) {
+		return s.pool.Exec(ctx, query, jti, login, expiresAt)
+	})
+
+	return err
+}
+
+// RevokeLoginTokens revokes every token issued to the login before the given
+// time.
+func (s *Storage) RevokeLoginTokens(ctx context.Context, login string, before time.Time) error {
+	query := `
+		INSERT INTO login_revocations (Login, RevokedBefore) VALUES ($1, $2)
+			ON CONFLICT (Login) DO UPDATE
+			SET RevokedBefore = GREATEST(login_revocations.RevokedBefore, EXCLUDED.RevokedBefore)
+	`
+
+	_, err := retry2(ctx, s.retryPolicy, func() (pgconn.CommandTag, error) {
+		return s.pool.Exec(ctx, query, login, before)
+	})
+
+	return err
+}
+
+// IsTokenRevoked reports whether the token was revoked by its id or by a
+// revocation of all the tokens of the login.
+func (s *Storage) IsTokenRevoked(ctx context.Context, jti, login string, issuedAt time.Time) (bool, error) {
+	query := `
+		SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE Jti = $1)
+			OR EXISTS (SELECT 1 FROM login_revocations WHERE Login = $2 AND RevokedBefore > $3)
+	`
+
+	return retry2(ctx, s.retryPolicy, func() (bool, error) {
+		var revoked bool
+		err := s.pool.QueryRow(ctx, query, jti, login, issuedAt).Scan(&revoked)
+
+		return revoked, err
+	})
+}
+
+// CreateRefreshToken stores a refresh token starting or continuing a family
+// and drops the expired ones.
+func (s *Storage) CreateRefreshToken(ctx context.Context, rt models.RefreshToken) error {
+	query := `
+		WITH expired AS (
+			DELETE FROM refresh_tokens WHERE ExpiresAt < now()
+		)
+		INSERT INTO refresh_tokens (TokenHash, FamilyID, Login, ExpiresAt) VALUES ($1, $2, $3, $4)
+	`
+
+	_, err := retry2(ctx, s.retryPolicy, func() (pgconn.CommandTag, error) {
+		return s.pool.Exec(ctx, query, rt.Hash, rt.Family, rt.Login, rt.ExpiresAt)
+	})
+
+	return err
+}
+
+// RotateRefreshToken marks the refresh token used and stores the next one in
+// the same family. A token used for the second time revokes the whole family
+// and returns ErrRefreshTokenReused.
+func (s *Storage) RotateRefreshToken(ctx context.Context, hash string, next models.RefreshToken) (*models.RefreshToken, error) {
+	querySelect := `
+		SELECT FamilyID, Login, ExpiresAt, UsedAt, RevokedAt FROM refresh_tokens
+			WHERE TokenHash = $1
+			FOR UPDATE
+	`
+	queryRevoke := `
+		UPDATE refresh_tokens SET RevokedAt = now() WHERE FamilyID = $1 AND RevokedAt IS NULL
+	`
+	queryUse := `
+		UPDATE refresh_tokens SET UsedAt = now() WHERE TokenHash = $1
+	`
+	queryNext := `
+		INSERT INTO refresh_tokens (TokenHash, FamilyID, Login, ExpiresAt) VALUES ($1, $2, $3, $4)
+	`
+
+	return retry2(ctx, s.retryPolicy, func() (*models.RefreshToken, error) {
+		var reused bool
+		rotated := next
+
+		err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+			var (
+				expiresAt         time.Time
+				usedAt, revokedAt *time.Time
+			)
+
+			err := tx.QueryRow(ctx, querySelect, hash).Scan(&rotated.Family, &rotated.Login, &expiresAt, &usedAt, &revokedAt)
+
+			if errors.Is(err, pgx.ErrNoRows) {
+				return ErrRefreshTokenInvalid
+			}
+
+			if err != nil {
+				return err
+			}
+
+			if revokedAt != nil || expiresAt.Before(time.Now()) {
+				return ErrRefreshTokenInvalid
+			}
+
+			if usedAt != nil {
+				// Commit the revocation, the error is returned after the transaction.
+				reused = true
+				_, err = tx.Exec(ctx, queryRevoke, rotated.Family)
+				return err
+			}
+
+			if _, err := tx.Exec(ctx, queryUse, hash); err != nil {
+				return err
+			}
+
+			_, err = tx.Exec(ctx, queryNext, rotated.Hash, rotated.Family, rotated.Login, rotated.ExpiresAt)
+			return err
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		if reused {
+			return nil, ErrRefreshTokenReused
+		}
+
+		return &rotated, nil
+	})
+}
+
+// RevokeRefreshTokenFamily revokes the family the refresh token belongs to.
+func (s *Storage) RevokeRefreshTokenFamily(ctx context.Context, hash string) error {
+	query := `
+		UPDATE refresh_tokens SET RevokedAt = now()
+			WHERE FamilyID = (SELECT FamilyID FROM refresh_tokens WHERE TokenHash = $1)
+				AND RevokedAt IS NULL
+	`
+
+	_, err := retry2(ctx, s.retryPolicy, func() (pgconn.CommandTag, error) {
+		return s.pool.Exec(ctx, query, hash)
+	})
+
+	return err
+}
+
+// RevokeLoginRefreshTokens revokes all the refresh tokens of the login.
+func (s *Storage) RevokeLoginRefreshTokens(ctx context.Context, login string) error {
+	query := `
+		UPDATE refresh_tokens SET RevokedAt = now() WHERE Login = $1 AND RevokedAt IS NULL
 	`
 
 	_, err := retry2(ctx, s.retryPolicy, func() (pgconn.CommandTag, error) {
-		return s.conn.Exec(ctx, query, o.Status, o.Number, o.Accrual)
+		return s.pool.Exec(ctx, query, login)
 	})
 
 	return err
 }
 
+func storedResponse(fingerprint, storedFingerprint string, statusCode *int32, contentType *string, body []byte) (*models.IdempotentResponse, error) {
+	if storedFingerprint != fingerprint {
+		return nil, ErrIdempotencyMismatch
+	}
+
+	if statusCode == nil {
+		return nil, ErrIdempotencyInProgress
+	}
+
+	resp := &models.IdempotentResponse{StatusCode: int(*statusCode), Body: body}
+
+	if contentType != nil {
+		resp.ContentType = *contentType
+	}
+
+	return resp, nil
+}
+
+func listClause(f models.ListFilter, timeCol, keyCol, statusCol string, args []any) (string, []any) {
+	var sb strings.Builder
+
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if len(f.Statuses) > 0 && statusCol != "" {
+		fmt.Fprintf(&sb, " AND %s = ANY(%s)", statusCol, arg(f.Statuses))
+	}
+
+	if f.From != nil {
+		fmt.Fprintf(&sb, " AND %s >= %s", timeCol, arg(*f.From))
+	}
+
+	if f.To != nil {
+		fmt.Fprintf(&sb, " AND %s <= %s", timeCol, arg(*f.To))
+	}
+
+	direction, op := "ASC", ">"
+	if f.Desc {
+		direction, op = "DESC", "<"
+	}
+
+	if f.Cursor != nil {
+		fmt.Fprintf(&sb, " AND (%s, %s) %s (%s, %s)", timeCol, keyCol, op, arg(f.Cursor.Time), arg(f.Cursor.Key))
+	}
+
+	fmt.Fprintf(&sb, " ORDER BY %s %s, %s %s", timeCol, direction, keyCol, direction)
+
+	if f.Limit > 0 {
+		fmt.Fprintf(&sb, " LIMIT %s", arg(f.Limit))
+	}
+
+	return sb.String(), args
+}
+
 func retry(ctx context.Context, rp retryPolicy, fn func() error) error {
 	fnWithReturn := func() (struct{}, error) {
 		return struct{}{}, fn()
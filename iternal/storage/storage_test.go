@@ -115,3 +115,60 @@ func Test_retry2(t *testing.T) {
 		require.NoError(t, err)
 	})
 }
+
+func Test_newPoolConfig(t *testing.T) {
+	dsn := "host=localhost user=test password=test dbname=test sslmode=disable"
+
+	t.Run("invalid uri", func(t *testing.T) {
+		_, err := newPoolConfig("postgres://%", PoolConfig{})
+		require.Error(t, err)
+	})
+
+	t.Run("min greater than max", func(t *testing.T) {
+		_, err := newPoolConfig(dsn, PoolConfig{MaxConns: 2, MinConns: 3})
+		require.Error(t, err)
+	})
+
+	t.Run("defaults", func(t *testing.T) {
+		cfg, err := newPoolConfig(dsn, PoolConfig{})
+		require.NoError(t, err)
+		require.Equal(t, int32(0), cfg.MinConns)
+		require.Positive(t, cfg.MaxConns)
+	})
+
+	t.Run("database uri values survive", func(t *testing.T) {
+		cfg, err := newPoolConfig(dsn+" pool_max_conns=7 pool_min_conns=3 pool_max_conn_idle_time=5m pool_health_check_period=30s",
+			PoolConfig{})
+		require.NoError(t, err)
+		require.Equal(t, int32(7), cfg.MaxConns)
+		require.Equal(t, int32(3), cfg.MinConns)
+		require.Equal(t, 5*time.Minute, cfg.MaxConnIdleTime)
+		require.Equal(t, 30*time.Second, cfg.HealthCheckPeriod)
+	})
+
+	t.Run("flags override database uri", func(t *testing.T) {
+		cfg, err := newPoolConfig(dsn+" pool_max_conns=7 pool_min_conns=3", PoolConfig{MaxConns: 9})
+		require.NoError(t, err)
+		require.Equal(t, int32(9), cfg.MaxConns)
+		require.Equal(t, int32(3), cfg.MinConns)
+	})
+
+	t.Run("database uri min greater than max", func(t *testing.T) {
+		_, err := newPoolConfig(dsn+" pool_min_conns=3", PoolConfig{MaxConns: 2})
+		require.Error(t, err)
+	})
+
+	t.Run("positive test", func(t *testing.T) {
+		cfg, err := newPoolConfig(dsn, PoolConfig{
+			MaxConns:          10,
+			MinConns:          2,
+			MaxConnIdleTime:   time.Minute,
+			HealthCheckPeriod: 10 * time.Second,
+		})
+		require.NoError(t, err)
+		require.Equal(t, int32(10), cfg.MaxConns)
+		require.Equal(t, int32(2), cfg.MinConns)
+		require.Equal(t, time.Minute, cfg.MaxConnIdleTime)
+		require.Equal(t, 10*time.Second, cfg.HealthCheckPeriod)
+	})
+}
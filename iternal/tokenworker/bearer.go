@@ -0,0 +1,104 @@
+package tokenworker
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// authRealm is the realm of the WWW-Authenticate challenges, RFC 6750.
+const authRealm = "gophermart"
+
+// TokenSource is where RequestToken looks for the access token.
+type TokenSource string
+
+const (
+	SourceHeader TokenSource = "header"
+	SourceCookie TokenSource = "cookie"
+)
+
+// DefaultTokenSources prefers the Authorization header, a client sending it
+// explicitly means it over a cookie the browser may still keep.
+var DefaultTokenSources = []TokenSource{SourceHeader, SourceCookie}
+
+var errMalformedAuthorization error = fmt.Errorf("authorization header must be written as Bearer <token>")
+
+// ParseTokenSources reads the precedence written as "header,cookie". Sources
+// left out are not accepted at all.
+func ParseTokenSources(s string) ([]TokenSource, error) {
+	var sources []TokenSource
+
+	for _, part := range strings.Split(s, ",") {
+		source := TokenSource(strings.ToLower(strings.TrimSpace(part)))
+
+		switch source {
+		case SourceHeader, SourceCookie:
+		default:
+			return nil, fmt.Errorf("unknown token source %q", part)
+		}
+
+		for _, seen := range sources {
+			if seen == source {
+				return nil, fmt.Errorf("duplicate token source %q", part)
+			}
+		}
+
+		sources = append(sources, source)
+	}
+
+	return sources, nil
+}
+
+// tokenFromRequest returns the token of the first source the request has. A
+// token found there is final: an invalid header token is not replaced by the
+// cookie.
+func (t *TokenWorker) tokenFromRequest(r *http.Request) (string, error) {
+	for _, source := range t.sources {
+		switch source {
+		case SourceHeader:
+			auth := r.Header.Get("Authorization")
+
+			if auth == "" {
+				continue
+			}
+
+			scheme, token, ok := strings.Cut(strings.TrimSpace(auth), " ")
+			token = strings.TrimSpace(token)
+
+			if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+				return "", errMalformedAuthorization
+			}
+
+			return token, nil
+		case SourceCookie:
+			c, err := r.Cookie("token")
+
+			if err != nil || c.Value == "" {
+				continue
+			}
+
+			return c.Value, nil
+		}
+	}
+
+	return "", nil
+}
+
+// authError answers with the bearer challenge. Without errCode the request had
+// no token and the challenge carries the realm only.
+func authError(w http.ResponseWriter, status int, errCode, description string) {
+	challenge := fmt.Sprintf("Bearer realm=%q", authRealm)
+
+	if errCode != "" {
+		challenge += fmt.Sprintf(", error=%q, error_description=%q", errCode, description)
+	}
+
+	w.Header().Set("WWW-Authenticate", challenge)
+	http.Error(w, description, status)
+}
+
+// WriteTokenHeader sets the Authorization response header for clients that
+// do not keep cookies.
+func (t *TokenWorker) WriteTokenHeader(w http.ResponseWriter, pair TokenPair) {
+	w.Header().Set("Authorization", pair.TokenType+" "+pair.AccessToken)
+}
@@ -0,0 +1,68 @@
+package tokenworker
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+	"sort"
+	"time"
+)
+
+// JWK is a public key in the JSON Web Key format, RFC 7517.
+type JWK struct {
+	KeyType string `json:"kty"`
+	ID      string `json:"kid"`
+	Use     string `json:"use"`
+	Alg     string `json:"alg"`
+	Curve   string `json:"crv,omitempty"`
+	X       string `json:"x,omitempty"`
+	N       string `json:"n,omitempty"`
+	E       string `json:"e,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys of the keyring that are not retired, so other
+// services can verify the tokens without the secrets. HMAC keys are never
+// published.
+func (kr *Keyring) JWKS() JWKS {
+	now := time.Now()
+	set := JWKS{Keys: []JWK{}}
+
+	for _, k := range kr.keys {
+		if k.retired(now) {
+			continue
+		}
+
+		jwk := JWK{ID: k.ID, Use: "sig", Alg: k.method.Alg()}
+
+		switch pub := k.verifyKey.(type) {
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		default:
+			continue
+		}
+
+		set.Keys = append(set.Keys, jwk)
+	}
+
+	sort.Slice(set.Keys, func(i, j int) bool {
+		return set.Keys[i].ID < set.Keys[j].ID
+	})
+
+	return set
+}
+
+// JWKS returns the public keys tokens are verified with.
+func (t *TokenWorker) JWKS() JWKS {
+	return t.keyring.JWKS()
+}
@@ -0,0 +1,149 @@
+package tokenworker
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/require"
+)
+
+func writePEM(t *testing.T, name, blockType string, der []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600))
+
+	return path
+}
+
+func TestKeyring_Asymmetric(t *testing.T) {
+	edPub, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	edDER, err := x509.MarshalPKCS8PrivateKey(edPriv)
+	require.NoError(t, err)
+	edPubDER, err := x509.MarshalPKIXPublicKey(edPub)
+	require.NoError(t, err)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	edFile := writePEM(t, "ed25519.pem", "PRIVATE KEY", edDER)
+	edPubFile := writePEM(t, "ed25519.pub.pem", "PUBLIC KEY", edPubDER)
+	rsaFile := writePEM(t, "rsa.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey))
+
+	tests := []struct {
+		name   string
+		key    SigningKey
+		alg    string
+		verify func(t *testing.T, jwk JWK, token string)
+	}{
+		{
+			name: "ed25519",
+			key:  SigningKey{ID: "ed", PrivateKeyFile: edFile},
+			alg:  "EdDSA",
+			verify: func(t *testing.T, jwk JWK, token string) {
+				require.Equal(t, "OKP", jwk.KeyType)
+				x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+				require.NoError(t, err)
+
+				_, err = jwt.Parse(token, func(*jwt.Token) (interface{}, error) {
+					return ed25519.PublicKey(x), nil
+				})
+				require.NoError(t, err)
+			},
+		},
+		{
+			name: "rsa",
+			key:  SigningKey{ID: "rsa", PrivateKeyFile: rsaFile},
+			alg:  "RS256",
+			verify: func(t *testing.T, jwk JWK, token string) {
+				require.Equal(t, "RSA", jwk.KeyType)
+				n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+				require.NoError(t, err)
+				e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+				require.NoError(t, err)
+				pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+
+				_, err = jwt.Parse(token, func(*jwt.Token) (interface{}, error) {
+					return pub, nil
+				})
+				require.NoError(t, err)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kr, err := NewKeyring(tt.key.ID, tt.key, SigningKey{ID: "hmac", Secret: "secret"})
+			require.NoError(t, err)
+			tw := NewToken(kr, time.Hour, nil, nil, nil)
+
+			token, err := tw.GetToken("test")
+			require.NoError(t, err)
+
+			parsed, _, err := new(jwt.Parser).ParseUnverified(token, &Claims{})
+			require.NoError(t, err)
+			require.Equal(t, tt.alg, parsed.Method.Alg())
+
+			login, ok := tw.GetSubFromToken(token)
+			require.True(t, ok)
+			require.Equal(t, "test", login)
+
+			jwks := tw.JWKS()
+			require.Len(t, jwks.Keys, 1, "hmac keys are not published")
+			require.Equal(t, tt.key.ID, jwks.Keys[0].ID)
+			require.Equal(t, tt.alg, jwks.Keys[0].Alg)
+			tt.verify(t, jwks.Keys[0], token)
+		})
+	}
+
+	t.Run("public key verifies only", func(t *testing.T) {
+		signer, err := NewKeyring("ed", SigningKey{ID: "ed", PrivateKeyFile: edFile})
+		require.NoError(t, err)
+		token, err := NewToken(signer, time.Hour, nil, nil, nil).GetToken("test")
+		require.NoError(t, err)
+
+		verifier, err := NewKeyring("hmac", SigningKey{ID: "hmac", Secret: "secret"},
+			SigningKey{ID: "ed", PublicKeyFile: edPubFile})
+		require.NoError(t, err)
+
+		login, ok := NewToken(verifier, time.Hour, nil, nil, nil).GetSubFromToken(token)
+		require.True(t, ok)
+		require.Equal(t, "test", login)
+
+		_, err = NewKeyring("ed", SigningKey{ID: "ed", PublicKeyFile: edPubFile})
+		require.Error(t, err)
+	})
+
+	t.Run("algorithm confusion", func(t *testing.T) {
+		kr, err := NewKeyring("ed", SigningKey{ID: "ed", PrivateKeyFile: edFile})
+		require.NoError(t, err)
+
+		forged := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				Subject:   "test",
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+			},
+		})
+		forged.Header["kid"] = "ed"
+		token, err := forged.SignedString([]byte(edPub))
+		require.NoError(t, err)
+
+		_, ok := NewToken(kr, time.Hour, nil, nil, nil).GetSubFromToken(token)
+		require.False(t, ok)
+	})
+
+	t.Run("parse keyring with pem", func(t *testing.T) {
+		kr, err := ParseKeyring("ed:@"+edFile+",old:secret", "")
+		require.NoError(t, err)
+		require.Equal(t, jwt.SigningMethodEdDSA, kr.activeKey().method)
+	})
+}
@@ -0,0 +1,274 @@
+package tokenworker
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// defaultKeyID identifies the key built from a single secret.
+const defaultKeyID = "default"
+
+var ErrUnknownKey error = fmt.Errorf("unknown signing key")
+
+// SigningKey is a key of the keyring: an HMAC secret, an Ed25519 or RSA
+// private key from a PEM file, or a public key from a PEM file that only
+// verifies tokens. A key with RetireAt set stops verifying tokens after that
+// time.
+type SigningKey struct {
+	ID             string    `json:"kid"`
+	Secret         string    `json:"secret,omitempty"`
+	PrivateKeyFile string    `json:"private_key_file,omitempty"`
+	PublicKeyFile  string    `json:"public_key_file,omitempty"`
+	RetireAt       time.Time `json:"retire_at,omitempty"`
+
+	method    jwt.SigningMethod
+	signKey   any
+	verifyKey any
+}
+
+// load reads the key material and picks the signing method by the key type:
+// HS256 for secrets, EdDSA for Ed25519 and RS256 for RSA keys.
+func (sk *SigningKey) load() error {
+	set := 0
+	for _, v := range []string{sk.Secret, sk.PrivateKeyFile, sk.PublicKeyFile} {
+		if v != "" {
+			set++
+		}
+	}
+
+	if sk.ID == "" || set != 1 {
+		return fmt.Errorf("signing key must have kid and one of secret, private_key_file, public_key_file")
+	}
+
+	switch {
+	case sk.Secret != "":
+		sk.method = jwt.SigningMethodHS256
+		sk.signKey = []byte(sk.Secret)
+		sk.verifyKey = sk.signKey
+	case sk.PrivateKeyFile != "":
+		block, err := readPEM(sk.PrivateKeyFile)
+
+		if err != nil {
+			return err
+		}
+
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+
+		if err != nil {
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		}
+
+		if err != nil {
+			return fmt.Errorf("parse private key %s: %w", sk.ID, err)
+		}
+
+		switch k := key.(type) {
+		case ed25519.PrivateKey:
+			sk.method, sk.signKey, sk.verifyKey = jwt.SigningMethodEdDSA, k, k.Public()
+		case *rsa.PrivateKey:
+			sk.method, sk.signKey, sk.verifyKey = jwt.SigningMethodRS256, k, &k.PublicKey
+		default:
+			return fmt.Errorf("private key %s: unsupported type %T", sk.ID, key)
+		}
+	default:
+		block, err := readPEM(sk.PublicKeyFile)
+
+		if err != nil {
+			return err
+		}
+
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+
+		if err != nil {
+			return fmt.Errorf("parse public key %s: %w", sk.ID, err)
+		}
+
+		switch k := key.(type) {
+		case ed25519.PublicKey:
+			sk.method, sk.verifyKey = jwt.SigningMethodEdDSA, k
+		case *rsa.PublicKey:
+			sk.method, sk.verifyKey = jwt.SigningMethodRS256, k
+		default:
+			return fmt.Errorf("public key %s: unsupported type %T", sk.ID, key)
+		}
+	}
+
+	return nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, fmt.Errorf("read key: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+
+	if block == nil {
+		return nil, fmt.Errorf("read key %s: no PEM data", path)
+	}
+
+	return block, nil
+}
+
+func (sk SigningKey) retired(t time.Time) bool {
+	return !sk.RetireAt.IsZero() && !t.Before(sk.RetireAt)
+}
+
+// Keyring holds the keys tokens are signed with. Tokens are signed with the
+// active key and carry its id in the kid header, every key that is not
+// retired verifies the tokens signed with it. Rotating a secret is adding the
+// new key, making it active once every instance knows it and dropping the old
+// one after the tokens signed with it have expired.
+type Keyring struct {
+	active string
+	keys   map[string]SigningKey
+}
+
+func NewKeyring(active string, keys ...SigningKey) (*Keyring, error) {
+	kr := &Keyring{active: active, keys: make(map[string]SigningKey, len(keys))}
+
+	for _, k := range keys {
+		if err := k.load(); err != nil {
+			return nil, err
+		}
+
+		if _, ok := kr.keys[k.ID]; ok {
+			return nil, fmt.Errorf("duplicate signing key %s", k.ID)
+		}
+
+		kr.keys[k.ID] = k
+	}
+
+	ak, ok := kr.keys[active]
+
+	if !ok {
+		return nil, fmt.Errorf("active signing key %q: %w", active, ErrUnknownKey)
+	}
+
+	if ak.retired(time.Now()) {
+		return nil, fmt.Errorf("active signing key %s is retired", active)
+	}
+
+	if ak.signKey == nil {
+		return nil, fmt.Errorf("active signing key %s has no private key", active)
+	}
+
+	return kr, nil
+}
+
+// NewSecretKeyring returns a keyring of a single key.
+func NewSecretKeyring(secret string) *Keyring {
+	key := SigningKey{
+		ID:        defaultKeyID,
+		Secret:    secret,
+		method:    jwt.SigningMethodHS256,
+		signKey:   []byte(secret),
+		verifyKey: []byte(secret),
+	}
+
+	return &Keyring{
+		active: defaultKeyID,
+		keys:   map[string]SigningKey{defaultKeyID: key},
+	}
+}
+
+// ParseKeyring reads keys written as "kid:secret,kid:@private.pem". A value
+// starting with @ is the path to a PEM private key. An empty active makes the
+// first key active.
+func ParseKeyring(s, active string) (*Keyring, error) {
+	var keys []SigningKey
+
+	for _, part := range strings.Split(s, ",") {
+		kid, secret, ok := strings.Cut(strings.TrimSpace(part), ":")
+
+		if !ok {
+			return nil, fmt.Errorf("signing key must be written as kid:secret")
+		}
+
+		if path, ok := strings.CutPrefix(secret, "@"); ok {
+			keys = append(keys, SigningKey{ID: kid, PrivateKeyFile: path})
+			continue
+		}
+
+		keys = append(keys, SigningKey{ID: kid, Secret: secret})
+	}
+
+	if active == "" {
+		active = keys[0].ID
+	}
+
+	return NewKeyring(active, keys...)
+}
+
+// LoadKeyring reads a keyring file:
+//
+//	{"active": "2024-06", "keys": [{"kid": "2024-06", "private_key_file": "ed25519.pem"},
+//		{"kid": "2024-01", "secret": "...", "retire_at": "2024-07-01T00:00:00Z"}]}
+func LoadKeyring(r io.Reader) (*Keyring, error) {
+	var file struct {
+		Active string       `json:"active"`
+		Keys   []SigningKey `json:"keys"`
+	}
+
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("decode keyring: %w", err)
+	}
+
+	return NewKeyring(file.Active, file.Keys...)
+}
+
+func LoadKeyringFile(path string) (*Keyring, error) {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return nil, fmt.Errorf("open keyring: %w", err)
+	}
+	defer f.Close()
+
+	return LoadKeyring(f)
+}
+
+func (kr *Keyring) activeKey() SigningKey {
+	return kr.keys[kr.active]
+}
+
+// verificationKeys returns the key the token names in its kid header. Tokens
+// issued before the keyring have no kid and are tried with every key.
+func (kr *Keyring) verificationKeys(kid string) ([]SigningKey, error) {
+	now := time.Now()
+
+	if kid == "" {
+		keys := make([]SigningKey, 0, len(kr.keys))
+
+		for _, k := range kr.keys {
+			if !k.retired(now) {
+				keys = append(keys, k)
+			}
+		}
+
+		return keys, nil
+	}
+
+	k, ok := kr.keys[kid]
+
+	if !ok || k.retired(now) {
+		return nil, fmt.Errorf("key %q: %w", kid, ErrUnknownKey)
+	}
+
+	return []SigningKey{k}, nil
+}
@@ -0,0 +1,122 @@
+package tokenworker
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyring_Rotation(t *testing.T) {
+	oldKey := SigningKey{ID: "old", Secret: "old secret"}
+	newKey := SigningKey{ID: "new", Secret: "new secret"}
+
+	before, err := NewKeyring("old", oldKey)
+	require.NoError(t, err)
+	token, err := NewToken(before, time.Hour, nil, nil, nil).GetToken("test")
+	require.NoError(t, err)
+
+	t.Run("kid header", func(t *testing.T) {
+		parsed, _, err := new(jwt.Parser).ParseUnverified(token, &Claims{})
+		require.NoError(t, err)
+		require.Equal(t, "old", parsed.Header["kid"])
+	})
+
+	t.Run("old key verifies after rotation", func(t *testing.T) {
+		after, err := NewKeyring("new", newKey, oldKey)
+		require.NoError(t, err)
+		tw := NewToken(after, time.Hour, nil, nil, nil)
+
+		login, ok := tw.GetSubFromToken(token)
+		require.True(t, ok)
+		require.Equal(t, "test", login)
+
+		fresh, err := tw.GetToken("test")
+		require.NoError(t, err)
+		parsed, _, err := new(jwt.Parser).ParseUnverified(fresh, &Claims{})
+		require.NoError(t, err)
+		require.Equal(t, "new", parsed.Header["kid"])
+	})
+
+	t.Run("retired key", func(t *testing.T) {
+		retired := oldKey
+		retired.RetireAt = time.Now().Add(-time.Minute)
+		after, err := NewKeyring("new", newKey, retired)
+		require.NoError(t, err)
+
+		_, ok := NewToken(after, time.Hour, nil, nil, nil).GetSubFromToken(token)
+		require.False(t, ok)
+	})
+
+	t.Run("dropped key", func(t *testing.T) {
+		after, err := NewKeyring("new", newKey)
+		require.NoError(t, err)
+
+		_, ok := NewToken(after, time.Hour, nil, nil, nil).GetSubFromToken(token)
+		require.False(t, ok)
+	})
+
+	t.Run("token without kid", func(t *testing.T) {
+		legacy, err := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				Subject:   "test",
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+			},
+		}).SignedString([]byte(oldKey.Secret))
+		require.NoError(t, err)
+
+		after, err := NewKeyring("new", newKey, oldKey)
+		require.NoError(t, err)
+
+		login, ok := NewToken(after, time.Hour, nil, nil, nil).GetSubFromToken(legacy)
+		require.True(t, ok)
+		require.Equal(t, "test", login)
+	})
+}
+
+func TestNewKeyring(t *testing.T) {
+	key := SigningKey{ID: "key", Secret: "secret"}
+
+	_, err := NewKeyring("other", key)
+	require.ErrorIs(t, err, ErrUnknownKey)
+
+	_, err = NewKeyring("key", key, key)
+	require.Error(t, err)
+
+	_, err = NewKeyring("key", SigningKey{ID: "key"})
+	require.Error(t, err)
+
+	_, err = NewKeyring("key", SigningKey{ID: "key", Secret: "secret", RetireAt: time.Now().Add(-time.Second)})
+	require.Error(t, err)
+}
+
+func TestParseKeyring(t *testing.T) {
+	kr, err := ParseKeyring("first:one, second:two", "")
+	require.NoError(t, err)
+	require.Equal(t, "first", kr.activeKey().ID)
+
+	kr, err = ParseKeyring("first:one,second:two", "second")
+	require.NoError(t, err)
+	require.Equal(t, "two", kr.activeKey().Secret)
+
+	_, err = ParseKeyring("first", "")
+	require.Error(t, err)
+}
+
+func TestLoadKeyring(t *testing.T) {
+	kr, err := LoadKeyring(strings.NewReader(`{
+		"active": "new",
+		"keys": [
+			{"kid": "new", "secret": "new secret"},
+			{"kid": "old", "secret": "old secret", "retire_at": "2030-01-01T00:00:00Z"}
+		]
+	}`))
+	require.NoError(t, err)
+	require.Equal(t, "new", kr.activeKey().ID)
+	require.Equal(t, time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC), kr.keys["old"].RetireAt)
+
+	_, err = LoadKeyring(strings.NewReader(`{"active": "new", "keys": [], "unknown": 1}`))
+	require.Error(t, err)
+}
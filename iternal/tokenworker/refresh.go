@@ -0,0 +1,185 @@
+package tokenworker
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Tomap-Tomap/go-loyalty-service/iternal/models"
+)
+
+const refreshCookieName = "refresh_token"
+
+// refreshCookiePath is the common prefix of the token refresh and logout
+// routes. A cookie has a single path, so the refresh token is sent with every
+// user API call too; HttpOnly and SameSite strict keep it from scripts and
+// other sites.
+const refreshCookiePath = "/api/user"
+
+var ErrRefreshDisabled error = fmt.Errorf("refresh tokens are not configured")
+
+// RefreshStore keeps the hashes of the issued refresh tokens.
+type RefreshStore interface {
+	CreateRefreshToken(ctx context.Context, rt models.RefreshToken) error
+	RotateRefreshToken(ctx context.Context, hash string, next models.RefreshToken) (*models.RefreshToken, error)
+	RevokeRefreshTokenFamily(ctx context.Context, hash string) error
+	RevokeLoginRefreshTokens(ctx context.Context, login string) error
+}
+
+// Sessions issues refresh tokens living for life. Every refresh rotates the
+// token, a rotated token presented again revokes the whole family it belongs
+// to.
+type Sessions struct {
+	store RefreshStore
+	life  time.Duration
+}
+
+func NewSessions(store RefreshStore, life time.Duration) *Sessions {
+	return &Sessions{store: store, life: life}
+}
+
+type TokenPair struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// IssueTokens starts a new session for the login: an access token and, when
+// sessions are configured, a refresh token starting a new family.
+func (t *TokenWorker) IssueTokens(ctx context.Context, login string) (TokenPair, error) {
+	if t.sessions == nil {
+		return t.newPair(login, "")
+	}
+
+	family, err := newTokenID()
+
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	refresh, rt, err := t.sessions.newRefreshToken()
+
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	rt.Family = family
+	rt.Login = login
+
+	if err := t.sessions.store.CreateRefreshToken(ctx, rt); err != nil {
+		return TokenPair{}, fmt.Errorf("create refresh token: %w", err)
+	}
+
+	return t.newPair(login, refresh)
+}
+
+// RefreshTokens exchanges the refresh token for a new pair.
+func (t *TokenWorker) RefreshTokens(ctx context.Context, refresh string) (TokenPair, error) {
+	if t.sessions == nil {
+		return TokenPair{}, ErrRefreshDisabled
+	}
+
+	next, rt, err := t.sessions.newRefreshToken()
+
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	rotated, err := t.sessions.store.RotateRefreshToken(ctx, hashRefreshToken(refresh), rt)
+
+	if err != nil {
+		return TokenPair{}, fmt.Errorf("rotate refresh token: %w", err)
+	}
+
+	return t.newPair(rotated.Login, next)
+}
+
+// RevokeSession revokes the family of the refresh token.
+func (t *TokenWorker) RevokeSession(ctx context.Context, refresh string) error {
+	if t.sessions == nil {
+		return ErrRefreshDisabled
+	}
+
+	if err := t.sessions.store.RevokeRefreshTokenFamily(ctx, hashRefreshToken(refresh)); err != nil {
+		return fmt.Errorf("revoke refresh tokens: %w", err)
+	}
+
+	return nil
+}
+
+// WriteTokensInCookie sets the access token cookie and the refresh token one
+// if the pair has it.
+func (t *TokenWorker) WriteTokensInCookie(w http.ResponseWriter, pair TokenPair) {
+	http.SetCookie(w, &http.Cookie{
+		Name:  "token",
+		Value: pair.AccessToken,
+	})
+
+	if pair.RefreshToken == "" || t.sessions == nil {
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshCookieName,
+		Value:    pair.RefreshToken,
+		Path:     refreshCookiePath,
+		MaxAge:   int(t.sessions.life.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// RefreshTokenFromRequest returns the refresh token cookie of the request.
+func (t *TokenWorker) RefreshTokenFromRequest(r *http.Request) (string, bool) {
+	c, err := r.Cookie(refreshCookieName)
+
+	if err != nil || c.Value == "" {
+		return "", false
+	}
+
+	return c.Value, true
+}
+
+func (t *TokenWorker) newPair(login, refresh string) (TokenPair, error) {
+	access, err := t.GetToken(login)
+
+	if err != nil {
+		return TokenPair{}, fmt.Errorf("get token: %w", err)
+	}
+
+	return TokenPair{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(t.exp.Seconds()),
+	}, nil
+}
+
+// newRefreshToken returns a random refresh token and its stored form.
+func (s *Sessions) newRefreshToken() (string, models.RefreshToken, error) {
+	b := make([]byte, 32)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", models.RefreshToken{}, fmt.Errorf("generate refresh token: %w", err)
+	}
+
+	refresh := base64.RawURLEncoding.EncodeToString(b)
+
+	return refresh, models.RefreshToken{
+		Hash:      hashRefreshToken(refresh),
+		ExpiresAt: time.Now().Add(s.life),
+	}, nil
+}
+
+// hashRefreshToken hashes the token before it reaches the storage. Refresh
+// tokens are random, so a plain hash is enough to make a leaked table useless.
+func hashRefreshToken(refresh string) string {
+	sum := sha256.Sum256([]byte(refresh))
+	return hex.EncodeToString(sum[:])
+}
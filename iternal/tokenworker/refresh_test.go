@@ -0,0 +1,106 @@
+package tokenworker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Tomap-Tomap/go-loyalty-service/iternal/models"
+	"github.com/Tomap-Tomap/go-loyalty-service/iternal/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenWorker_RefreshTokens(t *testing.T) {
+	ctx := context.Background()
+	ms := storage.NewMemoryStorage()
+	require.NoError(t, ms.CreateUser(ctx, models.User{Login: "test", Password: "test"}))
+	tw := NewToken(NewSecretKeyring("test"), time.Minute, NewRevocations(ms, time.Hour), NewSessions(ms, time.Hour), nil)
+
+	first, err := tw.IssueTokens(ctx, "test")
+	require.NoError(t, err)
+	require.NotEmpty(t, first.RefreshToken)
+	require.Equal(t, int64(60), first.ExpiresIn)
+
+	login, ok := tw.GetSubFromToken(first.AccessToken)
+	require.True(t, ok)
+	require.Equal(t, "test", login)
+
+	t.Run("rotate", func(t *testing.T) {
+		second, err := tw.RefreshTokens(ctx, first.RefreshToken)
+		require.NoError(t, err)
+		require.NotEqual(t, first.RefreshToken, second.RefreshToken)
+
+		login, ok := tw.GetSubFromToken(second.AccessToken)
+		require.True(t, ok)
+		require.Equal(t, "test", login)
+
+		// The rotated token is used again: the whole family goes away.
+		_, err = tw.RefreshTokens(ctx, first.RefreshToken)
+		require.ErrorIs(t, err, storage.ErrRefreshTokenReused)
+
+		_, err = tw.RefreshTokens(ctx, second.RefreshToken)
+		require.ErrorIs(t, err, storage.ErrRefreshTokenInvalid)
+	})
+
+	t.Run("revoke session", func(t *testing.T) {
+		pair, err := tw.IssueTokens(ctx, "test")
+		require.NoError(t, err)
+		other, err := tw.IssueTokens(ctx, "test")
+		require.NoError(t, err)
+
+		require.NoError(t, tw.RevokeSession(ctx, pair.RefreshToken))
+
+		_, err = tw.RefreshTokens(ctx, pair.RefreshToken)
+		require.ErrorIs(t, err, storage.ErrRefreshTokenInvalid)
+
+		_, err = tw.RefreshTokens(ctx, other.RefreshToken)
+		require.NoError(t, err)
+	})
+
+	t.Run("revoke all", func(t *testing.T) {
+		pair, err := tw.IssueTokens(ctx, "test")
+		require.NoError(t, err)
+
+		require.NoError(t, tw.RevokeAll(ctx, "test", time.Now()))
+
+		_, err = tw.RefreshTokens(ctx, pair.RefreshToken)
+		require.ErrorIs(t, err, storage.ErrRefreshTokenInvalid)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		tw := NewToken(NewSecretKeyring("test"), time.Minute, nil, nil, nil)
+
+		pair, err := tw.IssueTokens(ctx, "test")
+		require.NoError(t, err)
+		require.Empty(t, pair.RefreshToken)
+
+		_, err = tw.RefreshTokens(ctx, "refresh")
+		require.ErrorIs(t, err, ErrRefreshDisabled)
+	})
+}
+
+func TestTokenWorker_WriteTokensInCookie(t *testing.T) {
+	tw := NewToken(NewSecretKeyring("test"), time.Minute, nil, NewSessions(storage.NewMemoryStorage(), time.Hour), nil)
+
+	w := httptest.NewRecorder()
+	tw.WriteTokensInCookie(w, TokenPair{AccessToken: "access", RefreshToken: "refresh"})
+
+	r := &http.Request{Header: http.Header{"Cookie": w.Header().Values("Set-Cookie")}}
+	refresh, ok := tw.RefreshTokenFromRequest(r)
+	require.True(t, ok)
+	require.Equal(t, "refresh", refresh)
+
+	c, err := r.Cookie("token")
+	require.NoError(t, err)
+	require.Equal(t, "access", c.Value)
+
+	for _, c := range w.Result().Cookies() {
+		if c.Name == refreshCookieName {
+			require.True(t, c.HttpOnly)
+			require.Equal(t, refreshCookiePath, c.Path)
+			require.Equal(t, 3600, c.MaxAge)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package tokenworker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var ErrRevocationDisabled error = fmt.Errorf("token revocation is not configured")
+
+// RevocationStore keeps the revoked tokens shared between the instances.
+type RevocationStore interface {
+	RevokeToken(ctx context.Context, jti, login string, expiresAt time.Time) error
+	RevokeLoginTokens(ctx context.Context, login string, before time.Time) error
+	IsTokenRevoked(ctx context.Context, jti, login string, issuedAt time.Time) (bool, error)
+}
+
+type cachedRevocation struct {
+	login     string
+	issuedAt  time.Time
+	expiresAt time.Time
+	revoked   bool
+	checkedAt time.Time
+}
+
+// Revocations checks tokens against the store and caches the answers. A
+// revoked token stays revoked until it expires, so positive answers are kept
+// until then. Negative answers are kept for ttl, which bounds how long a
+// token revoked by another instance may still be accepted here.
+type Revocations struct {
+	store RevocationStore
+	ttl   time.Duration
+
+	mu        sync.Mutex
+	tokens    map[string]*cachedRevocation
+	lastPrune time.Time
+}
+
+func NewRevocations(store RevocationStore, ttl time.Duration) *Revocations {
+	return &Revocations{
+		store:  store,
+		ttl:    ttl,
+		tokens: make(map[string]*cachedRevocation),
+	}
+}
+
+// Revoke revokes a single token until it expires.
+func (rv *Revocations) Revoke(ctx context.Context, id Identity) error {
+	if err := rv.store.RevokeToken(ctx, id.TokenID, id.Login, id.ExpiresAt); err != nil {
+		return fmt.Errorf("revoke token: %w", err)
+	}
+
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+
+	rv.tokens[id.TokenID] = &cachedRevocation{
+		login:     id.Login,
+		issuedAt:  id.IssuedAt,
+		expiresAt: id.ExpiresAt,
+		revoked:   true,
+		checkedAt: time.Now(),
+	}
+
+	return nil
+}
+
+// RevokeBefore revokes every token issued to the login before the given
+// time. A token issued at the cutoff or later, like the one of the next
+// login, stays valid.
+func (rv *Revocations) RevokeBefore(ctx context.Context, login string, before time.Time) error {
+	if err := rv.store.RevokeLoginTokens(ctx, login, before); err != nil {
+		return fmt.Errorf("revoke login tokens: %w", err)
+	}
+
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+
+	for _, cr := range rv.tokens {
+		if cr.login == login && cr.issuedAt.Before(before) {
+			cr.revoked = true
+		}
+	}
+
+	return nil
+}
+
+// IsRevoked reports whether the token was revoked.
+func (rv *Revocations) IsRevoked(ctx context.Context, id Identity) (bool, error) {
+	now := time.Now()
+
+	rv.mu.Lock()
+	cr, ok := rv.tokens[id.TokenID]
+
+	if ok && (cr.revoked || now.Sub(cr.checkedAt) < rv.ttl) {
+		rv.mu.Unlock()
+		return cr.revoked, nil
+	}
+	rv.mu.Unlock()
+
+	revoked, err := rv.store.IsTokenRevoked(ctx, id.TokenID, id.Login, id.IssuedAt)
+
+	if err != nil {
+		return false, fmt.Errorf("check token revocation: %w", err)
+	}
+
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+
+	// Keep a revocation made here while the store was being asked.
+	if cr, ok := rv.tokens[id.TokenID]; ok && cr.revoked {
+		return true, nil
+	}
+
+	rv.prune(now)
+	rv.tokens[id.TokenID] = &cachedRevocation{
+		login:     id.Login,
+		issuedAt:  id.IssuedAt,
+		expiresAt: id.ExpiresAt,
+		revoked:   revoked,
+		checkedAt: now,
+	}
+
+	return revoked, nil
+}
+
+// prune drops the expired tokens and the stale negative answers, at most
+// once per ttl.
+func (rv *Revocations) prune(now time.Time) {
+	if now.Sub(rv.lastPrune) < rv.ttl {
+		return
+	}
+
+	rv.lastPrune = now
+
+	for jti, cr := range rv.tokens {
+		if now.After(cr.expiresAt) || (!cr.revoked && now.Sub(cr.checkedAt) >= rv.ttl) {
+			delete(rv.tokens, jti)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package tokenworker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type countingStore struct {
+	revoked map[string]bool
+	before  map[string]time.Time
+	checks  int
+	err     error
+}
+
+func newCountingStore() *countingStore {
+	return &countingStore{revoked: make(map[string]bool), before: make(map[string]time.Time)}
+}
+
+func (cs *countingStore) RevokeToken(ctx context.Context, jti, login string, expiresAt time.Time) error {
+	cs.revoked[jti] = true
+	return cs.err
+}
+
+func (cs *countingStore) RevokeLoginTokens(ctx context.Context, login string, before time.Time) error {
+	cs.before[login] = before
+	return cs.err
+}
+
+func (cs *countingStore) IsTokenRevoked(ctx context.Context, jti, login string, issuedAt time.Time) (bool, error) {
+	cs.checks++
+
+	if b, ok := cs.before[login]; ok && !issuedAt.After(b) {
+		return true, cs.err
+	}
+
+	return cs.revoked[jti], cs.err
+}
+
+func TestRevocations(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	id := Identity{Login: "test", TokenID: "first", IssuedAt: now.Add(-time.Minute), ExpiresAt: now.Add(time.Hour)}
+
+	t.Run("cache negative answers for ttl", func(t *testing.T) {
+		cs := newCountingStore()
+		rv := NewRevocations(cs, time.Hour)
+
+		for i := 0; i < 3; i++ {
+			revoked, err := rv.IsRevoked(ctx, id)
+			require.NoError(t, err)
+			require.False(t, revoked)
+		}
+
+		require.Equal(t, 1, cs.checks)
+
+		// Revoked by another instance, not seen until the answer goes stale.
+		cs.revoked[id.TokenID] = true
+		revoked, err := rv.IsRevoked(ctx, id)
+		require.NoError(t, err)
+		require.False(t, revoked)
+
+		rv = NewRevocations(cs, 0)
+		revoked, err = rv.IsRevoked(ctx, id)
+		require.NoError(t, err)
+		require.True(t, revoked)
+	})
+
+	t.Run("revoke", func(t *testing.T) {
+		cs := newCountingStore()
+		rv := NewRevocations(cs, time.Hour)
+
+		revoked, err := rv.IsRevoked(ctx, id)
+		require.NoError(t, err)
+		require.False(t, revoked)
+
+		require.NoError(t, rv.Revoke(ctx, id))
+
+		revoked, err = rv.IsRevoked(ctx, id)
+		require.NoError(t, err)
+		require.True(t, revoked)
+		require.Equal(t, 1, cs.checks)
+	})
+
+	t.Run("revoke before", func(t *testing.T) {
+		cs := newCountingStore()
+		rv := NewRevocations(cs, time.Hour)
+		later := Identity{Login: "test", TokenID: "second", IssuedAt: now.Add(time.Minute), ExpiresAt: now.Add(time.Hour)}
+
+		for _, i := range []Identity{id, later} {
+			revoked, err := rv.IsRevoked(ctx, i)
+			require.NoError(t, err)
+			require.False(t, revoked)
+		}
+
+		require.NoError(t, rv.RevokeBefore(ctx, "test", now))
+
+		revoked, err := rv.IsRevoked(ctx, id)
+		require.NoError(t, err)
+		require.True(t, revoked)
+
+		revoked, err = rv.IsRevoked(ctx, later)
+		require.NoError(t, err)
+		require.False(t, revoked)
+	})
+
+	t.Run("store error", func(t *testing.T) {
+		cs := newCountingStore()
+		cs.err = fmt.Errorf("test error")
+		rv := NewRevocations(cs, time.Hour)
+
+		_, err := rv.IsRevoked(ctx, id)
+		require.Error(t, err)
+		require.Error(t, rv.Revoke(ctx, id))
+	})
+}
+
+func TestTokenWorker_RequestTokenRevoked(t *testing.T) {
+	tw := NewToken(NewSecretKeyring("test"), 3*time.Hour, NewRevocations(newCountingStore(), time.Hour), nil, nil)
+	h := tw.RequestToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	token, err := tw.GetToken("test")
+	require.NoError(t, err)
+
+	request := func() int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.AddCookie(&http.Cookie{Name: "token", Value: token})
+		h.ServeHTTP(w, r)
+
+		return w.Code
+	}
+
+	require.Equal(t, http.StatusOK, request())
+
+	id, ok := tw.GetIdentityFromToken(token)
+	require.True(t, ok)
+	require.NoError(t, tw.Revoke(context.Background(), id))
+
+	require.Equal(t, http.StatusUnauthorized, request())
+	require.ErrorIs(t, NewToken(NewSecretKeyring("test"), time.Hour, nil, nil, nil).Revoke(context.Background(), id), ErrRevocationDisabled)
+}
@@ -1,6 +1,9 @@
 package tokenworker
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"net/http"
 	"time"
@@ -8,24 +11,90 @@ import (
 	"github.com/golang-jwt/jwt/v4"
 )
 
+const ScopeUser = "user"
+
+// Claims carries the exact issue time in iat_ns next to the whole seconds of
+// iat, so a revocation of every token issued before a moment does not catch
+// the tokens issued right after it.
+type Claims struct {
+	jwt.RegisteredClaims
+	Scopes       []string `json:"scopes,omitempty"`
+	IssuedAtNano int64    `json:"iat_ns,omitempty"`
+}
+
+type Identity struct {
+	Login     string
+	TokenID   string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+	Scopes    []string
+}
+
+type identityKey struct{}
+
+func WithIdentity(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+func IdentityFromContext(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(Identity)
+	return id, ok
+}
+
+func LoginFromContext(ctx context.Context) (string, bool) {
+	id, ok := IdentityFromContext(ctx)
+
+	if !ok || id.Login == "" {
+		return "", false
+	}
+
+	return id.Login, true
+}
+
 type TokenWorker struct {
-	secret string
-	exp    time.Duration
+	keyring     *Keyring
+	exp         time.Duration
+	revocations *Revocations
+	sessions    *Sessions
+	sources     []TokenSource
 }
 
-func NewToken(secret string, exp time.Duration) *TokenWorker {
-	return &TokenWorker{secret: secret, exp: exp}
+// NewToken creates a token worker issuing access tokens living exp signed
+// with the active key of the keyring. Nil revocations disables logout and lets
+// every token live until it expires, nil sessions disables refresh tokens.
+// Sources set where requests carry the token, nil means DefaultTokenSources.
+func NewToken(keyring *Keyring, exp time.Duration, revocations *Revocations, sessions *Sessions, sources []TokenSource) *TokenWorker {
+	if len(sources) == 0 {
+		sources = DefaultTokenSources
+	}
+
+	return &TokenWorker{keyring: keyring, exp: exp, revocations: revocations, sessions: sessions, sources: sources}
 }
 
 func (t *TokenWorker) GetToken(sub string) (string, error) {
+	jti, err := newTokenID()
+
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	key := t.keyring.activeKey()
 	token := jwt.NewWithClaims(
-		jwt.SigningMethodHS256,
-		jwt.RegisteredClaims{
-			Subject:   sub,
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(t.exp)),
+		key.method,
+		Claims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				ID:        jti,
+				Subject:   sub,
+				IssuedAt:  jwt.NewNumericDate(now),
+				ExpiresAt: jwt.NewNumericDate(now.Add(t.exp)),
+			},
+			Scopes:       []string{ScopeUser},
+			IssuedAtNano: now.UnixNano(),
 		},
 	)
-	tokenString, err := token.SignedString([]byte(t.secret))
+	token.Header["kid"] = key.ID
+	tokenString, err := token.SignedString(key.signKey)
 
 	if err != nil {
 		return "", fmt.Errorf("signed token: %w", err)
@@ -34,63 +103,167 @@ func (t *TokenWorker) GetToken(sub string) (string, error) {
 	return tokenString, nil
 }
 
-func (t *TokenWorker) GetSubFromToken(token string) (string, bool) {
-	claims := &jwt.RegisteredClaims{}
-	jwtToken, err := jwt.ParseWithClaims(token, claims, func(jwtT *jwt.Token) (interface{}, error) {
-		if _, ok := jwtT.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", jwtT.Header["alg"])
-		}
+func (t *TokenWorker) GetIdentityFromToken(token string) (Identity, bool) {
+	claims, ok := t.parse(token)
 
-		return []byte(t.secret), nil
-	})
+	if !ok || claims.Subject == "" {
+		return Identity{}, false
+	}
 
-	if err != nil {
-		return "", false
+	id := Identity{
+		Login:   claims.Subject,
+		TokenID: claims.ID,
+		Scopes:  claims.Scopes,
 	}
 
-	if !jwtToken.Valid {
-		return "", false
+	switch {
+	case claims.IssuedAtNano != 0:
+		id.IssuedAt = time.Unix(0, claims.IssuedAtNano)
+	case claims.IssuedAt != nil:
+		id.IssuedAt = claims.IssuedAt.Time
+	}
+
+	if claims.ExpiresAt != nil {
+		id.ExpiresAt = claims.ExpiresAt.Time
 	}
 
-	return claims.Subject, true
+	return id, true
 }
 
-func (t *TokenWorker) WriteTokenInCookie(w http.ResponseWriter, login string) error {
-	tokenString, err := t.GetToken(login)
+// parse verifies the token with the key named by its kid header. The token
+// must be signed with the method of the key, so a public key is never taken
+// for an HMAC secret.
+func (t *TokenWorker) parse(token string) (*Claims, bool) {
+	unverified, _, err := new(jwt.Parser).ParseUnverified(token, &Claims{})
+
+	if err != nil {
+		return nil, false
+	}
+
+	kid, _ := unverified.Header["kid"].(string)
+	keys, err := t.keyring.verificationKeys(kid)
 
 	if err != nil {
-		return fmt.Errorf("get token: %w", err)
+		return nil, false
 	}
 
-	cookie := &http.Cookie{
-		Name:  "token",
-		Value: tokenString,
+	for _, k := range keys {
+		claims := &Claims{}
+		jwtToken, err := jwt.ParseWithClaims(token, claims, func(jwtT *jwt.Token) (interface{}, error) {
+			if jwtT.Method.Alg() != k.method.Alg() {
+				return nil, fmt.Errorf("unexpected signing method: %v", jwtT.Header["alg"])
+			}
+
+			return k.verifyKey, nil
+		})
+
+		if err == nil && jwtToken.Valid {
+			return claims, true
+		}
+	}
+
+	return nil, false
+}
+
+func (t *TokenWorker) GetSubFromToken(token string) (string, bool) {
+	id, ok := t.GetIdentityFromToken(token)
+	return id.Login, ok
+}
+
+// ClearTokenCookie asks the client to drop the token cookies.
+func (t *TokenWorker) ClearTokenCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:   "token",
+		Value:  "",
+		MaxAge: -1,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:   refreshCookieName,
+		Value:  "",
+		Path:   refreshCookiePath,
+		MaxAge: -1,
+	})
+}
+
+// Revoke revokes the token of the identity.
+func (t *TokenWorker) Revoke(ctx context.Context, id Identity) error {
+	if t.revocations == nil {
+		return ErrRevocationDisabled
 	}
 
-	http.SetCookie(w, cookie)
+	return t.revocations.Revoke(ctx, id)
+}
+
+// RevokeAll revokes every token issued to the login before the given time together with all its refresh tokens.
+func (t *TokenWorker) RevokeAll(ctx context.Context, login string, before time.Time) error {
+	if t.revocations == nil {
+		return ErrRevocationDisabled
+	}
+
+	if err := t.revocations.RevokeBefore(ctx, login, before); err != nil {
+		return err
+	}
+
+	if t.sessions == nil {
+		return nil
+	}
+
+	if err := t.sessions.store.RevokeLoginRefreshTokens(ctx, login); err != nil {
+		return fmt.Errorf("revoke refresh tokens: %w", err)
+	}
 
 	return nil
 }
 
+// RequestToken authenticates the request by the bearer token from the
+// Authorization header or the token cookie, in the order of the sources.
 func (t *TokenWorker) RequestToken(h http.Handler) http.Handler {
 	logFn := func(w http.ResponseWriter, r *http.Request) {
-		tokenCookie, err := r.Cookie("token")
+		token, err := t.tokenFromRequest(r)
 
-		if err != nil || tokenCookie == nil {
-			http.Error(w, "invalid token", http.StatusUnauthorized)
+		if err != nil {
+			authError(w, http.StatusBadRequest, "invalid_request", err.Error())
 			return
 		}
 
-		sub, tokenValid := t.GetSubFromToken(tokenCookie.Value)
+		if token == "" {
+			authError(w, http.StatusUnauthorized, "", "invalid token")
+			return
+		}
+
+		id, tokenValid := t.GetIdentityFromToken(token)
 
 		if !tokenValid {
-			http.Error(w, "invalid token", http.StatusUnauthorized)
+			authError(w, http.StatusUnauthorized, "invalid_token", "invalid token")
 			return
 		}
 
-		r.Header.Add("login", sub)
-		h.ServeHTTP(w, r)
+		if t.revocations != nil {
+			revoked, err := t.revocations.IsRevoked(r.Context(), id)
+
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			if revoked {
+				authError(w, http.StatusUnauthorized, "invalid_token", "token is revoked")
+				return
+			}
+		}
+
+		h.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), id)))
 	}
 
 	return http.HandlerFunc(logFn)
 }
+
+func newTokenID() (string, error) {
+	b := make([]byte, 16)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate token id: %w", err)
+	}
+
+	return hex.EncodeToString(b), nil
+}
@@ -1,6 +1,9 @@
 package tokenworker
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -9,7 +12,7 @@ import (
 
 func TestTokenWorker_GetSubFromToken(t *testing.T) {
 	t.Run("invalid token", func(t *testing.T) {
-		tw := NewToken("test", 3*time.Hour)
+		tw := NewToken(NewSecretKeyring("test"), 3*time.Hour, nil, nil, nil)
 		token, err := tw.GetToken("test")
 		require.NoError(t, err)
 		_, b := tw.GetSubFromToken(token + "1")
@@ -17,7 +20,7 @@ func TestTokenWorker_GetSubFromToken(t *testing.T) {
 	})
 
 	t.Run("positive test", func(t *testing.T) {
-		tw := NewToken("test", 3*time.Hour)
+		tw := NewToken(NewSecretKeyring("test"), 3*time.Hour, nil, nil, nil)
 		token, err := tw.GetToken("test")
 		require.NoError(t, err)
 		s, b := tw.GetSubFromToken(token)
@@ -25,3 +28,156 @@ func TestTokenWorker_GetSubFromToken(t *testing.T) {
 		require.Equal(t, "test", s)
 	})
 }
+
+func TestTokenWorker_GetIdentityFromToken(t *testing.T) {
+	t.Run("positive test", func(t *testing.T) {
+		tw := NewToken(NewSecretKeyring("test"), 3*time.Hour, nil, nil, nil)
+		token, err := tw.GetToken("test")
+		require.NoError(t, err)
+		id, b := tw.GetIdentityFromToken(token)
+		require.True(t, b)
+		require.Equal(t, "test", id.Login)
+		require.NotEmpty(t, id.TokenID)
+		require.WithinDuration(t, time.Now(), id.IssuedAt, time.Minute)
+		require.Equal(t, []string{ScopeUser}, id.Scopes)
+	})
+
+	t.Run("unique token id", func(t *testing.T) {
+		tw := NewToken(NewSecretKeyring("test"), 3*time.Hour, nil, nil, nil)
+		first, err := tw.GetToken("test")
+		require.NoError(t, err)
+		second, err := tw.GetToken("test")
+		require.NoError(t, err)
+		firstID, _ := tw.GetIdentityFromToken(first)
+		secondID, _ := tw.GetIdentityFromToken(second)
+		require.NotEqual(t, firstID.TokenID, secondID.TokenID)
+	})
+
+	t.Run("another secret", func(t *testing.T) {
+		token, err := NewToken(NewSecretKeyring("test"), 3*time.Hour, nil, nil, nil).GetToken("test")
+		require.NoError(t, err)
+		_, b := NewToken(NewSecretKeyring("other"), 3*time.Hour, nil, nil, nil).GetIdentityFromToken(token)
+		require.False(t, b)
+	})
+}
+
+func TestTokenWorker_RequestToken(t *testing.T) {
+	tw := NewToken(NewSecretKeyring("test"), 3*time.Hour, nil, nil, nil)
+	var got Identity
+	var gotOK bool
+	h := tw.RequestToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, gotOK = IdentityFromContext(r.Context())
+	}))
+
+	t.Run("no cookie", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("login", "test")
+		h.ServeHTTP(w, r)
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("identity in context", func(t *testing.T) {
+		token, err := tw.GetToken("test")
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.AddCookie(&http.Cookie{Name: "token", Value: token})
+		r.Header.Set("login", "spoofed")
+		h.ServeHTTP(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.True(t, gotOK)
+		require.Equal(t, "test", got.Login)
+	})
+}
+
+func TestTokenWorker_RequestTokenSources(t *testing.T) {
+	tw := NewToken(NewSecretKeyring("test"), 3*time.Hour, nil, nil, nil)
+	header, err := tw.GetToken("header")
+	require.NoError(t, err)
+	cookie, err := tw.GetToken("cookie")
+	require.NoError(t, err)
+
+	serve := func(tw *TokenWorker, r *http.Request) (*httptest.ResponseRecorder, string) {
+		var login string
+		h := tw.RequestToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			login, _ = LoginFromContext(r.Context())
+		}))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w, login
+	}
+
+	request := func(auth, cookie string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+
+		if cookie != "" {
+			r.AddCookie(&http.Cookie{Name: "token", Value: cookie})
+		}
+
+		return r
+	}
+
+	t.Run("bearer token", func(t *testing.T) {
+		w, login := serve(tw, request("Bearer "+header, ""))
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "header", login)
+	})
+
+	t.Run("header takes precedence", func(t *testing.T) {
+		_, login := serve(tw, request("Bearer "+header, cookie))
+		require.Equal(t, "header", login)
+	})
+
+	t.Run("cookie takes precedence", func(t *testing.T) {
+		cookieFirst := NewToken(NewSecretKeyring("test"), 3*time.Hour, nil, nil, []TokenSource{SourceCookie, SourceHeader})
+		_, login := serve(cookieFirst, request("Bearer "+header, cookie))
+		require.Equal(t, "cookie", login)
+	})
+
+	t.Run("source not accepted", func(t *testing.T) {
+		cookieOnly := NewToken(NewSecretKeyring("test"), 3*time.Hour, nil, nil, []TokenSource{SourceCookie})
+		w, _ := serve(cookieOnly, request("Bearer "+header, ""))
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+		require.Equal(t, `Bearer realm="gophermart"`, w.Header().Get("WWW-Authenticate"))
+	})
+
+	t.Run("invalid header token is final", func(t *testing.T) {
+		w, _ := serve(tw, request("Bearer "+header+"1", cookie))
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+		require.Equal(t, `Bearer realm="gophermart", error="invalid_token", error_description="invalid token"`,
+			w.Header().Get("WWW-Authenticate"))
+	})
+
+	t.Run("malformed header", func(t *testing.T) {
+		w, _ := serve(tw, request("Basic dXNlcjpwd2Q=", ""))
+		require.Equal(t, http.StatusBadRequest, w.Code)
+		require.Contains(t, w.Header().Get("WWW-Authenticate"), `error="invalid_request"`)
+	})
+}
+
+func TestParseTokenSources(t *testing.T) {
+	sources, err := ParseTokenSources("cookie, Header")
+	require.NoError(t, err)
+	require.Equal(t, []TokenSource{SourceCookie, SourceHeader}, sources)
+
+	_, err = ParseTokenSources("header,query")
+	require.Error(t, err)
+
+	_, err = ParseTokenSources("cookie,cookie")
+	require.Error(t, err)
+}
+
+func TestLoginFromContext(t *testing.T) {
+	_, ok := LoginFromContext(context.Background())
+	require.False(t, ok)
+
+	login, ok := LoginFromContext(WithIdentity(context.Background(), Identity{Login: "test"}))
+	require.True(t, ok)
+	require.Equal(t, "test", login)
+}